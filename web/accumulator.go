@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Accumulator keeps running statistics of a stream of values.
+type Accumulator struct {
+	Count int
+	Sum float64
+	SumSquares float64
+	Min float64
+	Max float64
+	// All of the values, only kept if KeepValues is set since they are needed
+	// for medians and percentiles.
+	KeepValues bool
+	Values []float64
+}
+
+func (acc *Accumulator) Add(v float64) {
+	if acc.Count == 0 || v < acc.Min {
+		acc.Min = v
+	}
+	if acc.Count == 0 || v > acc.Max {
+		acc.Max = v
+	}
+	acc.Count++
+	acc.Sum += v
+	acc.SumSquares += v * v
+	if acc.KeepValues {
+		acc.Values = append(acc.Values, v)
+	}
+}
+
+func (acc *Accumulator) Mean() float64 {
+	if acc.Count == 0 {
+		return 0
+	}
+	return acc.Sum / float64(acc.Count)
+}
+
+// Returns the population standard deviation.
+func (acc *Accumulator) Stddev() float64 {
+	if acc.Count == 0 {
+		return 0
+	}
+	mean := acc.Mean()
+	variance := acc.SumSquares / float64(acc.Count) - mean * mean
+	if variance < 0 {
+		return 0
+	}
+	return math.Sqrt(variance)
+}
+
+// Returns the given percentile (0 to 100) of the values, interpolating
+// linearly between the closest ranks. KeepValues must be set.
+func (acc *Accumulator) Percentile(percentile float64) float64 {
+	if len(acc.Values) == 0 {
+		return 0
+	}
+	values := append([]float64{}, acc.Values...)
+	sort.Float64s(values)
+	rank := percentile / 100 * float64(len(values)-1)
+	lo := int(math.Floor(rank))
+	hi := int(math.Ceil(rank))
+	return values[lo] + (values[hi]-values[lo]) * (rank - float64(lo))
+}
+
+// Reducer computes an aggregate from an accumulator.
+type Reducer struct {
+	Reduce func(acc *Accumulator) float64
+	// Whether the accumulator needs to keep all of its values.
+	NeedsValues bool
+}
+
+var Reducers = map[string]Reducer{
+	"count": {Reduce: func(acc *Accumulator) float64 { return float64(acc.Count) }},
+	"sum": {Reduce: func(acc *Accumulator) float64 { return acc.Sum }},
+	"mean": {Reduce: (*Accumulator).Mean},
+	"min": {Reduce: func(acc *Accumulator) float64 { return acc.Min }},
+	"max": {Reduce: func(acc *Accumulator) float64 { return acc.Max }},
+	"stddev": {Reduce: (*Accumulator).Stddev},
+	"median": {
+		Reduce: func(acc *Accumulator) float64 { return acc.Percentile(50) },
+		NeedsValues: true,
+	},
+}
+
+// Returns the named reducer. Besides those in Reducers, "pNN" is the NN-th
+// percentile, e.g. "p85".
+func GetReducer(name string) (Reducer, error) {
+	if reducer, ok := Reducers[name]; ok {
+		return reducer, nil
+	}
+	if strings.HasPrefix(name, "p") {
+		percentile, err := strconv.ParseFloat(name[1:], 64)
+		if err == nil && percentile >= 0 && percentile <= 100 {
+			return Reducer{
+				Reduce: func(acc *Accumulator) float64 { return acc.Percentile(percentile) },
+				NeedsValues: true,
+			}, nil
+		}
+	}
+	return Reducer{}, fmt.Errorf("no such reducer %s", name)
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"github.com/mitroadmaps/gomapinfer/common"
+	gomapimage "github.com/mitroadmaps/gomapinfer/image"
+
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Options for rendering an animation of a table over time.
+type AnimateOptions struct {
+	// Options for rendering matrices. Frame is ignored, and the value range
+	// defaults to the range over all observations so that colors are
+	// comparable between animation frames.
+	VisualizeOptions
+
+	// The time range to animate (see Window for the format), defaulting to the
+	// whole video.
+	From string
+	To string
+	// The time between animation frames (default: at most 100 animation
+	// frames).
+	Step string
+	// Length of the sequence tails (default 30s).
+	Tail string
+	// Maximum width of the animation frames in pixels (default 800).
+	MaxWidth int
+	// Delay between GIF frames in milliseconds (default 200).
+	Delay int
+}
+
+type AnimationFrame struct {
+	// The video frame that is rendered.
+	Frame int
+	// The image file in the animation directory.
+	Image string
+	// The clock time at the frame, if StartClock is set.
+	Clock string `json:",omitempty"`
+}
+
+// The animation index, written to index.json in the animation directory.
+type AnimationIndex struct {
+	Frames []AnimationFrame
+	GIF string
+	Width int
+	Height int
+}
+
+func ParseAnimateOptions(s string) (AnimateOptions, error) {
+	var options AnimateOptions
+	if s == "" {
+		return options, nil
+	}
+	if err := json.Unmarshal([]byte(s), &options); err != nil {
+		return options, fmt.Errorf("error decoding animation options %s: %v", s, err)
+	}
+	return options, nil
+}
+
+// Returns the directory where animations are written.
+func GetAnimationDir() string {
+	return filepath.Join(Config.DataDir, "anim")
+}
+
+// Formats the clock time at a frame given the clock time at frame 0.
+func formatFrameClock(frameIdx int, startClock string) (string, error) {
+	start, err := parseClock(startClock)
+	if err != nil {
+		return "", err
+	}
+	t := start + time.Duration(float64(frameIdx) / FramesPerSecond * float64(time.Second))
+	t = t % (24 * time.Hour)
+	return fmt.Sprintf("%02d:%02d:%02d", int(t.Hours()), int(t.Minutes()) % 60, int(t.Seconds()) % 60), nil
+}
+
+/*
+Animate renders the outputs of an operation over time, like Visualize but
+with one image per time step rather than collapsing every frame. Each image
+shows the drone's footprint at that frame, the detections in that frame, the
+recent tails of sequences, and the state of the matrix as of that frame.
+
+The images are written to the animation directory (see GetAnimationDir) along
+with index.json (see AnimationIndex) for scrubbing and anim.gif.
+*/
+func Animate(dir string, options AnimateOptions) error {
+	if options.Tail == "" {
+		options.Tail = "30s"
+	}
+	if options.MaxWidth == 0 {
+		options.MaxWidth = 800
+	}
+	if options.Delay == 0 {
+		options.Delay = 200
+	}
+	tail, err := ParseFrameSpec(options.Tail, "")
+	if err != nil {
+		return err
+	}
+
+	// Load the frame bounds and the output tables.
+	var frames []Frame
+	bytes, err := ioutil.ReadFile(filepath.Join(Config.DataDir, "align-out.json"))
+	if err != nil {
+		return fmt.Errorf("error loading frame bounds: %v", err)
+	}
+	if err := json.Unmarshal(bytes, &frames); err != nil {
+		return fmt.Errorf("error decoding frame bounds: %v", err)
+	}
+	lastFrame := len(frames) - 1
+
+	var detections [][]Detection
+	var sequences []*Sequence
+	var matrix *Matrix
+	if bytes, err := ioutil.ReadFile(filepath.Join(dir, "detect.json")); err == nil {
+		if err := json.Unmarshal(bytes, &detections); err != nil {
+			return err
+		}
+		if len(detections) - 1 > lastFrame {
+			lastFrame = len(detections) - 1
+		}
+	}
+	if bytes, err := ioutil.ReadFile(filepath.Join(dir, "sequences.json")); err == nil {
+		if err := json.Unmarshal(bytes, &sequences); err != nil {
+			return err
+		}
+		for _, seq := range sequences {
+			for _, item := range seq.Items {
+				if item.Frame > lastFrame {
+					lastFrame = item.Frame
+				}
+			}
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "matrix.json")); err == nil {
+		m, err := LoadMatrix(dir)
+		if err != nil {
+			return err
+		}
+		matrix = &m
+		if !matrix.HasChannel(options.Channel) {
+			return fmt.Errorf("matrix has no channel %s", options.Channel)
+		}
+		if options.Colormap == "" {
+			options.Colormap = "viridis"
+		}
+		cmap, err := GetColormap(options.Colormap)
+		if err != nil {
+			return err
+		}
+		var values Accumulator
+		for _, obs := range matrix.Observations {
+			values.Add(obs.Get(options.Channel))
+			if obs.Frame > lastFrame {
+				lastFrame = obs.Frame
+			}
+		}
+		min, max := options.getRange(cmap, values)
+		options.Min, options.Max = &min, &max
+	}
+	if lastFrame < 0 {
+		return fmt.Errorf("nothing to animate")
+	}
+
+	// Get the frames to render.
+	from, to := 0, lastFrame
+	if options.From != "" {
+		from, err = ParseFrameSpec(options.From, options.StartClock)
+		if err != nil {
+			return err
+		}
+	}
+	if options.To != "" {
+		to, err = ParseFrameSpec(options.To, options.StartClock)
+		if err != nil {
+			return err
+		}
+	}
+	if to < from {
+		return fmt.Errorf("animation range ends before it starts")
+	}
+	step := (to - from) / 100 + 1
+	if options.Step != "" {
+		step, err = ParseFrameSpec(options.Step, "")
+		if err != nil {
+			return err
+		}
+		if step <= 0 {
+			return fmt.Errorf("animation step must be positive")
+		}
+	}
+
+	// Downscale the ortho-image once, and draw everything in scaled
+	// coordinates.
+	log.Printf("[animate] loading ortho-image")
+	ortho := gomapimage.ReadImage(filepath.Join(Config.DataDir, "ortho.jpg"))
+	scale := math.Min(1, float64(options.MaxWidth) / float64(len(ortho)))
+	width := int(float64(len(ortho)) * scale)
+	height := int(float64(len(ortho[0])) * scale)
+	base := make([][][3]uint8, width)
+	for x := range base {
+		base[x] = make([][3]uint8, height)
+		for y := range base[x] {
+			base[x][y] = ortho[int(float64(x) / scale)][int(float64(y) / scale)]
+		}
+	}
+	drawLine := func(pix [][][3]uint8, a common.Point, b common.Point, c [3]uint8) {
+		a, b = a.Scale(scale), b.Scale(scale)
+		for _, p := range common.DrawLineOnCells(int(a.X), int(a.Y), int(b.X), int(b.Y), width, height) {
+			gomapimage.DrawRect(pix, p[0], p[1], 0, c)
+		}
+	}
+	drawPoint := func(pix [][][3]uint8, p common.Point, r int, c [3]uint8) {
+		p = p.Scale(scale)
+		if p.X < 0 || p.Y < 0 || int(p.X) >= width || int(p.Y) >= height {
+			return
+		}
+		gomapimage.DrawRect(pix, int(p.X), int(p.Y), r, c)
+	}
+
+	animDir := GetAnimationDir()
+	if err := os.RemoveAll(animDir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(animDir, 0755); err != nil {
+		return err
+	}
+	index := AnimationIndex{
+		Frames: []AnimationFrame{},
+		GIF: "anim.gif",
+		Width: width,
+		Height: height,
+	}
+	anim := &gif.GIF{}
+
+	log.Printf("[animate] rendering frames %d to %d every %d frames", from, to, step)
+	for frameIdx := from; frameIdx <= to; frameIdx += step {
+		pix := make([][][3]uint8, width)
+		for x := range pix {
+			pix[x] = append([][3]uint8{}, base[x]...)
+		}
+
+		if matrix != nil {
+			if err := renderMatrix(pix, *matrix, options.VisualizeOptions, frameIdx, scale); err != nil {
+				return err
+			}
+		}
+
+		// Drone footprint.
+		if frameIdx < len(frames) && len(frames[frameIdx]) > 0 {
+			poly := frames[frameIdx].Polygon()
+			for i := range poly {
+				drawLine(pix, poly[i], poly[(i+1) % len(poly)], [3]uint8{0, 255, 255})
+			}
+		}
+
+		// Sequence tails, ending with the latest position.
+		for _, seq := range sequences {
+			var prev *common.Point
+			for _, item := range seq.Items {
+				if item.Frame < frameIdx - tail || item.Frame > frameIdx {
+					continue
+				}
+				cur := item.Detection.Polygon().Bounds().Center()
+				if prev != nil {
+					drawLine(pix, *prev, cur, [3]uint8{255, 255, 0})
+				}
+				prev = &cur
+			}
+			if prev != nil {
+				drawPoint(pix, *prev, 2, [3]uint8{255, 128, 0})
+			}
+		}
+
+		// Detections in this frame.
+		if frameIdx < len(detections) {
+			for _, d := range detections[frameIdx] {
+				drawPoint(pix, d.Polygon().Bounds().Center(), 2, [3]uint8{255, 0, 0})
+			}
+		}
+
+		// Timestamp label in the top-left corner.
+		animFrame := AnimationFrame{
+			Frame: frameIdx,
+			Image: fmt.Sprintf("%06d.jpg", len(index.Frames)),
+		}
+		label := fmt.Sprintf("%d", frameIdx)
+		if options.StartClock != "" {
+			animFrame.Clock, err = formatFrameClock(frameIdx, options.StartClock)
+			if err != nil {
+				return err
+			}
+			label = animFrame.Clock
+		}
+		for x := 5; x < 15 + len(label)*12 && x < width; x++ {
+			for y := 5; y < 30 && y < height; y++ {
+				blendPixel(pix, x, y, [3]uint8{255, 255, 255}, 0.8)
+			}
+		}
+		drawText(pix, 10, 10, label, 3, [3]uint8{0, 0, 0})
+
+		gomapimage.WriteImage(filepath.Join(animDir, animFrame.Image), pix)
+		index.Frames = append(index.Frames, animFrame)
+		anim.Image = append(anim.Image, toPaletted(pix))
+		anim.Delay = append(anim.Delay, options.Delay / 10)
+	}
+
+	log.Printf("[animate] saving %d frames", len(index.Frames))
+	f, err := os.Create(filepath.Join(animDir, index.GIF))
+	if err != nil {
+		return err
+	}
+	if err := gif.EncodeAll(f, anim); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	bytes, err = json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(animDir, "index.json"), bytes, 0644)
+}
+
+// Converts an image indexed [x][y] to a paletted image for GIF encoding.
+func toPaletted(pix [][][3]uint8) *image.Paletted {
+	rgba := pixToImage(pix)
+	paletted := image.NewPaletted(rgba.Bounds(), palette.Plan9)
+	draw.FloydSteinberg.Draw(paletted, rgba.Bounds(), rgba, image.Point{})
+	return paletted
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"image/gif"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseAnimateOptions(t *testing.T) {
+	options, err := ParseAnimateOptions(`{"Channel": "stddev", "Alpha": 0, "From": "10s", "Step": "2s"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The visualization options are embedded.
+	if options.Channel != "stddev" || options.Alpha == nil || *options.Alpha != 0 {
+		t.Errorf("expected embedded visualization options, got %+v", options.VisualizeOptions)
+	}
+	if options.From != "10s" || options.Step != "2s" {
+		t.Errorf("unexpected animation options %+v", options)
+	}
+	if _, err := ParseAnimateOptions(`{"From": 10}`); err == nil {
+		t.Error("expected error for a non-string From")
+	}
+	if options, err := ParseAnimateOptions(""); err != nil || !reflect.DeepEqual(options, AnimateOptions{}) {
+		t.Errorf("expected default options for the empty string, got %+v, %v", options, err)
+	}
+}
+
+func TestFormatFrameClock(t *testing.T) {
+	// Frames are at FramesPerSecond, and the clock wraps at midnight.
+	for _, tc := range []struct{
+		frame int
+		expected string
+	}{
+		{0, "23:59:58"},
+		{5, "23:59:59"},
+		{10, "00:00:00"},
+		{5*3600, "00:59:58"},
+	} {
+		clock, err := formatFrameClock(tc.frame, "23:59:58")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if clock != tc.expected {
+			t.Errorf("frame %d: expected %s, got %s", tc.frame, tc.expected, clock)
+		}
+	}
+	if _, err := formatFrameClock(0, "noon"); err == nil {
+		t.Error("expected error for an invalid start clock")
+	}
+}
+
+func TestAnimate(t *testing.T) {
+	writeStripedOrtho(t)
+	frames := make([]Frame, 11)
+	for i := range frames {
+		frames[i] = Frame{{0, 0}, {100, 0}, {100, 100}, {0, 100}}
+	}
+	if err := ioutil.WriteFile(filepath.Join(Config.DataDir, "align-out.json"), JsonMarshal(frames), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	sequences := []*Sequence{makeMergeTestSequence(1, 0, repeatCenter([2]int{50, 50}, 11)...)}
+	if err := ioutil.WriteFile(filepath.Join(dir, "sequences.json"), JsonMarshal(sequences), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	options := AnimateOptions{Step: "5", MaxWidth: 300}
+	options.StartClock = "12:00:00"
+	if err := Animate(dir, options); err != nil {
+		t.Fatal(err)
+	}
+
+	animDir := GetAnimationDir()
+	bytes, err := ioutil.ReadFile(filepath.Join(animDir, "index.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var index AnimationIndex
+	if err := json.Unmarshal(bytes, &index); err != nil {
+		t.Fatal(err)
+	}
+	// The 600x300 ortho-image is downscaled to the maximum width.
+	if index.Width != 300 || index.Height != 150 {
+		t.Errorf("expected 300x150 animation frames, got %dx%d", index.Width, index.Height)
+	}
+	expected := []AnimationFrame{
+		{Frame: 0, Image: "000000.jpg", Clock: "12:00:00"},
+		{Frame: 5, Image: "000001.jpg", Clock: "12:00:01"},
+		{Frame: 10, Image: "000002.jpg", Clock: "12:00:02"},
+	}
+	if !reflect.DeepEqual(index.Frames, expected) {
+		t.Fatalf("expected animation frames %+v, got %+v", expected, index.Frames)
+	}
+	for _, frame := range index.Frames {
+		if _, err := os.Stat(filepath.Join(animDir, frame.Image)); err != nil {
+			t.Errorf("missing animation frame: %v", err)
+		}
+	}
+	f, err := os.Open(filepath.Join(animDir, index.GIF))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	anim, err := gif.DecodeAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(anim.Image) != 3 || anim.Delay[0] != 20 {
+		t.Errorf("expected 3 GIF frames with the default delay, got %d frames with delay %v", len(anim.Image), anim.Delay)
+	}
+
+	// Invalid ranges and steps are rejected.
+	for _, options := range []AnimateOptions{
+		{From: "10", To: "5"},
+		{Step: "0"},
+	} {
+		if err := Animate(dir, options); err == nil {
+			t.Errorf("expected error for options %+v", options)
+		}
+	}
+}
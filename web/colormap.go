@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// A colormap maps values in [0, 1] to colors by linear interpolation between
+// evenly spaced control colors.
+type Colormap struct {
+	Colors [][3]uint8
+	// Diverging colormaps have a neutral color in the middle, and their
+	// automatic value range is symmetric around the center value.
+	Diverging bool
+}
+
+var Colormaps = map[string]Colormap{
+	"viridis": {Colors: [][3]uint8{
+		{68, 1, 84}, {72, 40, 120}, {62, 74, 137}, {49, 104, 142}, {38, 130, 142},
+		{31, 158, 137}, {53, 183, 121}, {109, 205, 89}, {180, 222, 44}, {253, 231, 37},
+	}},
+	"heat": {Colors: [][3]uint8{
+		{0, 0, 0}, {128, 0, 0}, {255, 0, 0}, {255, 128, 0}, {255, 255, 0}, {255, 255, 255},
+	}},
+	"gray": {Colors: [][3]uint8{{0, 0, 0}, {255, 255, 255}}},
+	"red": {Colors: [][3]uint8{{255, 245, 240}, {252, 146, 114}, {203, 24, 29}, {103, 0, 13}}},
+	"rdbu": {Colors: [][3]uint8{
+		{5, 48, 97}, {67, 147, 195}, {209, 229, 240}, {247, 247, 247},
+		{253, 219, 199}, {214, 96, 77}, {103, 0, 31},
+	}, Diverging: true},
+	"coolwarm": {Colors: [][3]uint8{
+		{59, 76, 192}, {141, 176, 254}, {221, 221, 221}, {244, 154, 123}, {180, 4, 38},
+	}, Diverging: true},
+}
+
+func (cmap Colormap) Color(t float64) [3]uint8 {
+	if math.IsNaN(t) || t < 0 {
+		t = 0
+	} else if t > 1 {
+		t = 1
+	}
+	pos := t * float64(len(cmap.Colors)-1)
+	i := int(math.Floor(pos))
+	if i >= len(cmap.Colors)-1 {
+		return cmap.Colors[len(cmap.Colors)-1]
+	}
+	frac := pos - float64(i)
+	var c [3]uint8
+	for k := 0; k < 3; k++ {
+		c[k] = uint8(math.Round(float64(cmap.Colors[i][k]) * (1 - frac) + float64(cmap.Colors[i+1][k]) * frac))
+	}
+	return c
+}
+
+func GetColormap(name string) (Colormap, error) {
+	cmap, ok := Colormaps[name]
+	if !ok {
+		return Colormap{}, fmt.Errorf("no such colormap %s", name)
+	}
+	return cmap, nil
+}
+
+// Blends color c over pixel (x, y) with the given alpha.
+func blendPixel(pix [][][3]uint8, x int, y int, c [3]uint8, alpha float64) {
+	if x < 0 || y < 0 || x >= len(pix) || y >= len(pix[x]) {
+		return
+	}
+	for k := 0; k < 3; k++ {
+		pix[x][y][k] = uint8(math.Round(float64(pix[x][y][k]) * (1 - alpha) + float64(c[k]) * alpha))
+	}
+}
+
+// 3x5 bitmap glyphs for legend and timestamp labels. Each row is three bits, most
+// significant bit on the left.
+var legendGlyphs = map[rune][5]uint8{
+	'0': {7, 5, 5, 5, 7},
+	'1': {2, 6, 2, 2, 7},
+	'2': {7, 1, 7, 4, 7},
+	'3': {7, 1, 7, 1, 7},
+	'4': {5, 5, 7, 1, 1},
+	'5': {7, 4, 7, 1, 7},
+	'6': {7, 4, 7, 5, 7},
+	'7': {7, 1, 1, 1, 1},
+	'8': {7, 5, 7, 5, 7},
+	'9': {7, 5, 7, 1, 7},
+	'.': {0, 0, 0, 0, 2},
+	'-': {0, 0, 7, 0, 0},
+	'e': {7, 5, 7, 4, 7},
+	'+': {0, 2, 7, 2, 0},
+	':': {0, 2, 0, 2, 0},
+}
+
+// Draws text with the top-left corner at (x, y), where each glyph pixel is a
+// scale x scale square. Unknown characters are left blank.
+func drawText(pix [][][3]uint8, x int, y int, text string, scale int, c [3]uint8) {
+	for _, r := range text {
+		glyph := legendGlyphs[r]
+		for row := 0; row < 5; row++ {
+			for col := 0; col < 3; col++ {
+				if glyph[row] & (4 >> uint(col)) == 0 {
+					continue
+				}
+				for dx := 0; dx < scale; dx++ {
+					for dy := 0; dy < scale; dy++ {
+						blendPixel(pix, x + col*scale + dx, y + row*scale + dy, c, 1)
+					}
+				}
+			}
+		}
+		x += 4 * scale
+	}
+}
+
+// Formats a legend label compactly.
+func formatLegendValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', 4, 64)
+}
+
+// Draws a legend in the bottom-left corner: a horizontal color bar from min
+// to max, with the min, center (for diverging colormaps), and max labels.
+func drawLegend(pix [][][3]uint8, cmap Colormap, min float64, max float64) {
+	width := len(pix)
+	height := len(pix[0])
+	const scale = 3
+	barWidth := width / 3
+	if barWidth < 100 {
+		barWidth = 100
+	}
+	barHeight := 6 * scale
+	margin := 10
+	labelHeight := 6 * scale
+	boxX := margin
+	boxY := height - margin - barHeight - labelHeight - 2*margin
+
+	// Background box.
+	for x := boxX; x < boxX + barWidth + 2*margin; x++ {
+		for y := boxY; y < height - margin; y++ {
+			blendPixel(pix, x, y, [3]uint8{255, 255, 255}, 0.8)
+		}
+	}
+
+	barX := boxX + margin
+	barY := boxY + margin
+	for i := 0; i < barWidth; i++ {
+		c := cmap.Color(float64(i) / float64(barWidth-1))
+		for y := barY; y < barY + barHeight; y++ {
+			blendPixel(pix, barX + i, y, c, 1)
+		}
+	}
+
+	labelY := barY + barHeight + scale
+	black := [3]uint8{0, 0, 0}
+	drawText(pix, barX, labelY, formatLegendValue(min), scale, black)
+	maxLabel := formatLegendValue(max)
+	drawText(pix, barX + barWidth - len(maxLabel)*4*scale, labelY, maxLabel, scale, black)
+	if cmap.Diverging {
+		centerLabel := formatLegendValue((min + max) / 2)
+		drawText(pix, barX + barWidth/2 - len(centerLabel)*2*scale, labelY, centerLabel, scale, black)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestColormapColor(t *testing.T) {
+	gray := Colormaps["gray"]
+	for _, c := range []struct {
+		t float64
+		expected uint8
+	}{
+		{0, 0},
+		{0.5, 128},
+		{0.25, 64},
+		{1, 255},
+		{-1, 0},
+		{2, 255},
+		{math.NaN(), 0},
+		{math.Inf(1), 255},
+	} {
+		if color := gray.Color(c.t); color != [3]uint8{c.expected, c.expected, c.expected} {
+			t.Errorf("gray at %v: expected %d, got %v", c.t, c.expected, color)
+		}
+	}
+	// Control colors are evenly spaced.
+	viridis := Colormaps["viridis"]
+	for i, expected := range viridis.Colors {
+		if color := viridis.Color(float64(i) / float64(len(viridis.Colors)-1)); color != expected {
+			t.Errorf("viridis control color %d: expected %v, got %v", i, expected, color)
+		}
+	}
+}
+
+func TestGetMatrixColors(t *testing.T) {
+	matrix := Matrix{GridSize: 32, Observations: []MatrixObservation{
+		{Cell: [2]int{0, 0}, Frame: 0, Value: -1},
+		{Cell: [2]int{1, 0}, Frame: 0, Value: 3},
+		{Cell: [2]int{1, 0}, Frame: 10, Value: 5},
+	}}
+	zero := 0.0
+	colors, err := GetMatrixColors(matrix, VisualizeOptions{Colormap: "gray", Alpha: &zero}, -1, 0.6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if colors.Alpha != 0 {
+		t.Errorf("expected explicit zero alpha, got %v", colors.Alpha)
+	}
+	if colors.Min != -1 || colors.Max != 5 || colors.Colors[[2]int{1, 0}] != [3]uint8{255, 255, 255} {
+		t.Errorf("unexpected colors %+v", colors)
+	}
+
+	// Diverging colormaps are centered, and the frame selects observations.
+	colors, err = GetMatrixColors(matrix, VisualizeOptions{Colormap: "rdbu"}, 5, 0.6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if colors.Alpha != 0.6 || colors.Min != -3 || colors.Max != 3 {
+		t.Errorf("expected default alpha and range [-3, 3], got %+v", colors)
+	}
+
+	invalid := 1.5
+	if _, err := GetMatrixColors(matrix, VisualizeOptions{Alpha: &invalid}, -1, 0.6); err == nil {
+		t.Error("expected error for alpha out of range")
+	}
+}
@@ -4,4 +4,12 @@ var Config struct {
 	DataDir string
 	VideoDir string
 	Python string
+	// Directory of saved programs (see Program).
+	ProgramsDir string
+	// Number of decoded video frames kept in memory by each FrameCache, or 0
+	// for DefaultFrameCacheSize.
+	FrameCacheSize int
 }
+
+// Frame rate of the input video.
+const FramesPerSecond = 5
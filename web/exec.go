@@ -20,6 +20,14 @@ func (g Graph) Exec() (map[string]string, error) {
 			if ready[name] {
 				continue
 			}
+			if node.Name != name {
+				// An alias of an identical node (see Optimize), which shares
+				// its output directory.
+				if ready[node.Name] {
+					ready[name] = true
+				}
+				continue
+			}
 
 			// Are all parents ready?
 			okay := true
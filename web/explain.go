@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+/*
+Explain reports how a graph would execute without running it. For each node,
+we report its operation, inputs, output directory (from the node hashes), and
+whether the outputs are already cached in Config.DataDir. Cached nodes report
+the runtime in their manifest (see RunManifest), and nodes that will run
+report an estimated runtime, which is the mean runtime of previous runs of the
+same operation. If an operation has never run, its nodes report an unknown
+runtime, and the total estimate is marked as partial.
+
+Nodes whose arguments do not match their operation (see ValidateNode) report
+the error, so that mistakes are found before the query runs.
+
+If the graph was optimized (see Optimize), the rewrites are reported too, and
+nodes that were merged into an identical node are reported as aliases of it.
+*/
+
+type ExplainNode struct {
+	Name string
+	// Name of the identical node that computes this node, if any.
+	AliasOf string `json:",omitempty"`
+	Operation string
+	// Names of the input nodes, and the string arguments.
+	Inputs []string
+	Strings []string
+	Hash string
+	OutDir string
+	Cached bool
+	// Runtime in seconds from the manifest of a cached node.
+	Runtime *float64 `json:",omitempty"`
+	// Estimated runtime in seconds of a node that will run, if the operation
+	// has run before.
+	EstimatedRuntime *float64 `json:",omitempty"`
+	// Whether the node will run but its operation has never run before.
+	RuntimeUnknown bool `json:",omitempty"`
+	// Error from validating the node's arguments, if any.
+	Error string `json:",omitempty"`
+}
+
+type ExplainResult struct {
+	// Nodes in execution order.
+	Nodes []ExplainNode
+	// Sum of the estimated runtimes of nodes that will run.
+	EstimatedRuntime float64
+	// Whether some nodes that will run have an unknown runtime, so that
+	// EstimatedRuntime is a lower bound.
+	EstimatedRuntimePartial bool
+	// Whether any node has an error.
+	HasErrors bool
+	// The graph in Graphviz DOT format.
+	DOT string
+	// Rewrites applied by the optimizer.
+	Rewrites []Rewrite
+}
+
+// Returns the nodes in an execution order: parents before children, and
+// otherwise by name. Aliases of other nodes (see Optimize) are skipped.
+func (graph Graph) TopologicalOrder() []*Node {
+	depths := make(map[string]int)
+	var getDepth func(node *Node) int
+	getDepth = func(node *Node) int {
+		if depth, ok := depths[node.Name]; ok {
+			return depth
+		}
+		depth := 0
+		for _, parent := range node.Parents() {
+			if d := getDepth(parent) + 1; d > depth {
+				depth = d
+			}
+		}
+		depths[node.Name] = depth
+		return depth
+	}
+	var nodes []*Node
+	for name, node := range graph {
+		if node.Name != name {
+			continue
+		}
+		getDepth(node)
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		if depths[nodes[i].Name] != depths[nodes[j].Name] {
+			return depths[nodes[i].Name] < depths[nodes[j].Name]
+		}
+		return nodes[i].Name < nodes[j].Name
+	})
+	return nodes
+}
+
+// Returns the mean runtime of each operation over the manifests of output
+// directories in Config.DataDir.
+func getOperationRuntimes() map[string]float64 {
+	files, err := ioutil.ReadDir(Config.DataDir)
+	if err != nil {
+		return nil
+	}
+	sums := make(map[string]float64)
+	counts := make(map[string]int)
+	for _, fi := range files {
+		parts := strings.SplitN(fi.Name(), ".", 2)
+		if !fi.IsDir() || len(parts) != 2 || Ops[parts[0]] == nil {
+			continue
+		}
+		manifest := LoadManifest(filepath.Join(Config.DataDir, fi.Name()))
+		if manifest == nil {
+			continue
+		}
+		sums[parts[0]] += manifest.Runtime
+		counts[parts[0]]++
+	}
+	runtimes := make(map[string]float64)
+	for op, sum := range sums {
+		runtimes[op] = sum / float64(counts[op])
+	}
+	return runtimes
+}
+
+func Explain(graph Graph, rewrites []Rewrite) ExplainResult {
+	hashes := graph.GetHashStrings()
+	runtimes := getOperationRuntimes()
+	result := ExplainResult{Rewrites: rewrites}
+	if result.Rewrites == nil {
+		result.Rewrites = []Rewrite{}
+	}
+	aliases := make(map[string][]string)
+	for name, node := range graph {
+		if node.Name != name {
+			aliases[node.Name] = append(aliases[node.Name], name)
+		}
+	}
+	var dot []string
+	dot = append(dot, "digraph query {", "\tnode [shape=box, style=filled];")
+	for _, node := range graph.TopologicalOrder() {
+		outDir := filepath.Join(Config.DataDir, node.Operation + "." + hashes[node.Name])
+		n := ExplainNode{
+			Name: node.Name,
+			Operation: node.Operation,
+			Inputs: []string{},
+			Strings: []string{},
+			Hash: hashes[node.Name],
+			OutDir: outDir,
+		}
+		for _, arg := range node.Arguments {
+			if arg.Type == "node" {
+				n.Inputs = append(n.Inputs, arg.Node.Name)
+			} else {
+				n.Strings = append(n.Strings, arg.String)
+			}
+		}
+		if _, err := os.Stat(outDir); err == nil {
+			n.Cached = true
+			if manifest := LoadManifest(outDir); manifest != nil {
+				n.Runtime = &manifest.Runtime
+			}
+		} else if runtime, ok := runtimes[node.Operation]; ok {
+			n.EstimatedRuntime = &runtime
+			result.EstimatedRuntime += runtime
+		} else {
+			n.RuntimeUnknown = true
+			result.EstimatedRuntimePartial = true
+		}
+		if err := ValidateNode(node); err != nil {
+			n.Error = err.Error()
+			result.HasErrors = true
+		}
+		result.Nodes = append(result.Nodes, n)
+
+		color := "orange"
+		status := "run"
+		if n.Error != "" {
+			color = "tomato"
+			status = "error: " + n.Error
+		} else if n.Cached {
+			color = "palegreen"
+			status = "cached"
+		} else if n.RuntimeUnknown {
+			status = "run, runtime unknown"
+		}
+		dot = append(dot, fmt.Sprintf("\t%q [label=%q, fillcolor=%s];", n.Name, fmt.Sprintf("%s\n%s (%s)", n.Name, n.Operation, status), color))
+		for _, input := range n.Inputs {
+			dot = append(dot, fmt.Sprintf("\t%q -> %q;", input, n.Name))
+		}
+
+		sort.Strings(aliases[n.Name])
+		for _, alias := range aliases[n.Name] {
+			a := n
+			a.Name = alias
+			a.AliasOf = n.Name
+			a.EstimatedRuntime = nil
+			a.RuntimeUnknown = false
+			result.Nodes = append(result.Nodes, a)
+			dot = append(dot, fmt.Sprintf("\t%q [label=%q, shape=ellipse, fillcolor=white];", alias, alias))
+			dot = append(dot, fmt.Sprintf("\t%q -> %q [style=dashed];", n.Name, alias))
+		}
+	}
+	dot = append(dot, "}")
+	result.DOT = strings.Join(dot, "\n") + "\n"
+	return result
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Returns the explained nodes by name.
+func explainQuery(t *testing.T, query string) (ExplainResult, map[string]ExplainNode) {
+	graph, err := ParseQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := Explain(graph, nil)
+	nodes := make(map[string]ExplainNode)
+	for _, n := range result.Nodes {
+		nodes[n.Name] = n
+	}
+	return result, nodes
+}
+
+func TestExplainValidation(t *testing.T) {
+	Config.DataDir = t.TempDir()
+	result, nodes := explainQuery(t, `seqs = Detect("video")
+tracks = Track(seqs)
+m = ToMatrix(tracks)
+w = Window(tracks; "{"From": 10")
+p = Priorities(w)`)
+	if !result.HasErrors {
+		t.Error("expected the plan to have errors")
+	}
+	for _, name := range []string{"m", "w"} {
+		if nodes[name].Error == "" {
+			t.Errorf("expected error for node %s", name)
+		}
+	}
+	for _, name := range []string{"seqs", "tracks", "p"} {
+		if nodes[name].Error != "" {
+			t.Errorf("unexpected error for node %s: %s", name, nodes[name].Error)
+		}
+	}
+}
+
+func TestExplainUnknownRuntime(t *testing.T) {
+	Config.DataDir = t.TempDir()
+	// A previous run of Detect, but Track has never run.
+	dir := filepath.Join(Config.DataDir, "Detect.previous")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, ManifestName), JsonMarshal(RunManifest{Runtime: 2}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	result, nodes := explainQuery(t, `seqs = Detect("video")
+tracks = Track(seqs)`)
+	if n := nodes["seqs"]; n.EstimatedRuntime == nil || *n.EstimatedRuntime != 2 || n.RuntimeUnknown {
+		t.Errorf("expected estimated runtime for Detect, got %+v", n)
+	}
+	if n := nodes["tracks"]; n.EstimatedRuntime != nil || !n.RuntimeUnknown {
+		t.Errorf("expected unknown runtime for Track, got %+v", n)
+	}
+	if result.EstimatedRuntime != 2 || !result.EstimatedRuntimePartial {
+		t.Errorf("expected partial estimate of 2s, got %v (partial %v)", result.EstimatedRuntime, result.EstimatedRuntimePartial)
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Expr is an arithmetic expression over named float64 variables, e.g.
+// "max(a - b, 0) / 2" or "duration > 10 && length > 5". Comparison and
+// logical operators evaluate to 1 (true) or 0 (false). Division by zero
+// evaluates to 0, so that ratios over empty cells stay finite.
+type Expr interface {
+	Eval(vars func(name string) (float64, error)) (float64, error)
+	// Names of the variables referenced in the expression.
+	Vars() []string
+}
+
+type exprNumber float64
+
+func (e exprNumber) Eval(vars func(string) (float64, error)) (float64, error) {
+	return float64(e), nil
+}
+
+func (e exprNumber) Vars() []string {
+	return nil
+}
+
+type exprVar string
+
+func (e exprVar) Eval(vars func(string) (float64, error)) (float64, error) {
+	return vars(string(e))
+}
+
+func (e exprVar) Vars() []string {
+	return []string{string(e)}
+}
+
+type exprUnary struct {
+	op string
+	x Expr
+}
+
+func (e exprUnary) Eval(vars func(string) (float64, error)) (float64, error) {
+	x, err := e.x.Eval(vars)
+	if err != nil {
+		return 0, err
+	}
+	if e.op == "-" {
+		return -x, nil
+	}
+	return boolToFloat(x == 0), nil
+}
+
+func (e exprUnary) Vars() []string {
+	return e.x.Vars()
+}
+
+type exprBinary struct {
+	op string
+	x, y Expr
+}
+
+func (e exprBinary) Eval(vars func(string) (float64, error)) (float64, error) {
+	x, err := e.x.Eval(vars)
+	if err != nil {
+		return 0, err
+	}
+	y, err := e.y.Eval(vars)
+	if err != nil {
+		return 0, err
+	}
+	switch e.op {
+	case "+":
+		return x + y, nil
+	case "-":
+		return x - y, nil
+	case "*":
+		return x * y, nil
+	case "/":
+		if y == 0 {
+			return 0, nil
+		}
+		return x / y, nil
+	case "<":
+		return boolToFloat(x < y), nil
+	case "<=":
+		return boolToFloat(x <= y), nil
+	case ">":
+		return boolToFloat(x > y), nil
+	case ">=":
+		return boolToFloat(x >= y), nil
+	case "==":
+		return boolToFloat(x == y), nil
+	case "!=":
+		return boolToFloat(x != y), nil
+	case "&&":
+		return boolToFloat(x != 0 && y != 0), nil
+	case "||":
+		return boolToFloat(x != 0 || y != 0), nil
+	}
+	return 0, fmt.Errorf("unknown operator %s", e.op)
+}
+
+func (e exprBinary) Vars() []string {
+	return append(e.x.Vars(), e.y.Vars()...)
+}
+
+var exprFuncs = map[string]func(args []float64) (float64, error){
+	"min": func(args []float64) (float64, error) {
+		if len(args) == 0 {
+			return 0, fmt.Errorf("min needs at least one argument")
+		}
+		v := args[0]
+		for _, x := range args[1:] {
+			v = math.Min(v, x)
+		}
+		return v, nil
+	},
+	"max": func(args []float64) (float64, error) {
+		if len(args) == 0 {
+			return 0, fmt.Errorf("max needs at least one argument")
+		}
+		v := args[0]
+		for _, x := range args[1:] {
+			v = math.Max(v, x)
+		}
+		return v, nil
+	},
+	"abs": func(args []float64) (float64, error) {
+		if len(args) != 1 {
+			return 0, fmt.Errorf("abs needs one argument")
+		}
+		return math.Abs(args[0]), nil
+	},
+	"sqrt": func(args []float64) (float64, error) {
+		if len(args) != 1 {
+			return 0, fmt.Errorf("sqrt needs one argument")
+		}
+		return math.Sqrt(args[0]), nil
+	},
+}
+
+type exprCall struct {
+	name string
+	args []Expr
+}
+
+func (e exprCall) Eval(vars func(string) (float64, error)) (float64, error) {
+	var args []float64
+	for _, arg := range e.args {
+		x, err := arg.Eval(vars)
+		if err != nil {
+			return 0, err
+		}
+		args = append(args, x)
+	}
+	return exprFuncs[e.name](args)
+}
+
+func (e exprCall) Vars() []string {
+	var vars []string
+	for _, arg := range e.args {
+		vars = append(vars, arg.Vars()...)
+	}
+	return vars
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Binary operators from lowest to highest precedence.
+var exprPrecedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"<=", ">=", "==", "!=", "<", ">"},
+	{"+", "-"},
+	{"*", "/"},
+}
+
+type exprParser struct {
+	tokens []string
+	pos int
+}
+
+func (p *exprParser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() string {
+	token := p.peek()
+	p.pos++
+	return token
+}
+
+func (p *exprParser) parseBinary(level int) (Expr, error) {
+	if level >= len(exprPrecedence) {
+		return p.parseUnary()
+	}
+	x, err := p.parseBinary(level+1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		found := false
+		for _, candidate := range exprPrecedence[level] {
+			if op == candidate {
+				found = true
+			}
+		}
+		if !found {
+			return x, nil
+		}
+		p.next()
+		y, err := p.parseBinary(level+1)
+		if err != nil {
+			return nil, err
+		}
+		x = exprBinary{op, x, y}
+	}
+}
+
+func (p *exprParser) parseUnary() (Expr, error) {
+	if p.peek() == "-" || p.peek() == "!" {
+		op := p.next()
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return exprUnary{op, x}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (Expr, error) {
+	token := p.next()
+	if token == "" {
+		return nil, fmt.Errorf("unexpected end of expression")
+	} else if token == "(" {
+		x, err := p.parseBinary(0)
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("expected )")
+		}
+		return x, nil
+	} else if unicode.IsDigit(rune(token[0])) || token[0] == '.' {
+		// Only tokens that start like a number are literals, since ParseFloat
+		// also accepts "inf" and "nan".
+		v, err := strconv.ParseFloat(token, 64)
+		if err != nil || math.IsInf(v, 0) {
+			return nil, fmt.Errorf("invalid number %s", token)
+		}
+		return exprNumber(v), nil
+	} else if !isIdentStart(rune(token[0])) {
+		return nil, fmt.Errorf("unexpected token %s", token)
+	}
+
+	if p.peek() != "(" {
+		return exprVar(token), nil
+	}
+	// Function call.
+	if exprFuncs[token] == nil {
+		return nil, fmt.Errorf("unknown function %s", token)
+	}
+	p.next()
+	call := exprCall{name: token}
+	if p.peek() == ")" {
+		p.next()
+		return call, nil
+	}
+	for {
+		arg, err := p.parseBinary(0)
+		if err != nil {
+			return nil, err
+		}
+		call.args = append(call.args, arg)
+		sep := p.next()
+		if sep == ")" {
+			return call, nil
+		} else if sep != "," {
+			return nil, fmt.Errorf("expected , or ) in call to %s", token)
+		}
+	}
+}
+
+func isTwoCharOp(s string) bool {
+	for _, op := range []string{"<=", ">=", "==", "!=", "&&", "||"} {
+		if s == op {
+			return true
+		}
+	}
+	return false
+}
+
+func isIdentStart(r rune) bool {
+	return unicode.IsLetter(r) || r == '_'
+}
+
+// Splits an expression into numbers, identifiers (which may contain dots,
+// e.g. "a.stddev"), operators, and parentheses.
+func tokenizeExpr(s string) ([]string, error) {
+	var tokens []string
+	runes := []rune(s)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		if unicode.IsSpace(r) {
+			i++
+		} else if unicode.IsDigit(r) || r == '.' {
+			j := i
+			for j < len(runes) && (unicode.IsDigit(runes[j]) || runes[j] == '.' || runes[j] == 'e' || ((runes[j] == '-' || runes[j] == '+') && runes[j-1] == 'e')) {
+				j++
+			}
+			tokens = append(tokens, string(runes[i:j]))
+			i = j
+		} else if isIdentStart(r) {
+			j := i
+			for j < len(runes) && (isIdentStart(runes[j]) || unicode.IsDigit(runes[j]) || runes[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, string(runes[i:j]))
+			i = j
+		} else if i+1 < len(runes) && isTwoCharOp(string(runes[i:i+2])) {
+			tokens = append(tokens, string(runes[i:i+2]))
+			i += 2
+		} else if strings.ContainsRune("+-*/<>()!,", r) {
+			tokens = append(tokens, string(r))
+			i++
+		} else {
+			return nil, fmt.Errorf("unexpected character %c", r)
+		}
+	}
+	return tokens, nil
+}
+
+func ParseExpr(s string) (Expr, error) {
+	tokens, err := tokenizeExpr(s)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing expression %s: %v", s, err)
+	}
+	p := &exprParser{tokens: tokens}
+	expr, err := p.parseBinary(0)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing expression %s: %v", s, err)
+	}
+	if p.pos < len(tokens) {
+		return nil, fmt.Errorf("error parsing expression %s: unexpected token %s", s, p.peek())
+	}
+	return expr, nil
+}
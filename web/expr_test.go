@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// Evaluates the expression with variables a = 2 and a.stddev = 0.5.
+func evalTestExpr(s string) (float64, error) {
+	expr, err := ParseExpr(s)
+	if err != nil {
+		return 0, err
+	}
+	return expr.Eval(func(name string) (float64, error) {
+		switch name {
+		case "a":
+			return 2, nil
+		case "a.stddev":
+			return 0.5, nil
+		}
+		return 0, fmt.Errorf("unknown variable %s", name)
+	})
+}
+
+func TestExprEval(t *testing.T) {
+	for s, expected := range map[string]float64{
+		"1 + 2 * 3": 7,
+		"(1 + 2) * 3": 9,
+		"8 / 2 / 2": 2,
+		"5 - 3 - 1": 1,
+		"1 < 2 && 3 > 4": 0,
+		"1 || 0 && 0": 1,
+		"1 + 1 == 2": 1,
+		"-2 * 3": -6,
+		"- -2": 2,
+		"1 - -1": 2,
+		"-a + 1": -1,
+		"!0": 1,
+		"!a": 0,
+		"a / 0": 0,
+		"a.stddev * 4": 2,
+		"max(a, a.stddev, 3) - min(a, 1)": 2,
+		"abs(-a) + sqrt(4)": 4,
+		"1.5e1": 15,
+	} {
+		v, err := evalTestExpr(s)
+		if err != nil {
+			t.Errorf("%s: %v", s, err)
+		} else if v != expected {
+			t.Errorf("%s: expected %v, got %v", s, expected, v)
+		}
+	}
+}
+
+func TestExprVars(t *testing.T) {
+	expr, err := ParseExpr("max(a - b.stddev, 0) / c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := expr.Vars()
+	if len(vars) != 3 || vars[0] != "a" || vars[1] != "b.stddev" || vars[2] != "c" {
+		t.Errorf("unexpected variables %v", vars)
+	}
+}
+
+func TestExprErrors(t *testing.T) {
+	for _, s := range []string{"", "1 +", "(1", "1)", "foo(1)", "1 $ 2", "max(1 2)", "inf", "nan", "Inf + 1", "1e999"} {
+		if _, err := evalTestExpr(s); err == nil {
+			t.Errorf("expected error for %q", s)
+		}
+	}
+	// These parse but fail to evaluate.
+	for _, s := range []string{"min()", "b + 1", "sqrt(1, 2)"} {
+		if _, err := ParseExpr(s); err != nil {
+			t.Errorf("%s: %v", s, err)
+		} else if _, err := evalTestExpr(s); err == nil {
+			t.Errorf("expected evaluation error for %q", s)
+		}
+	}
+}
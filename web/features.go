@@ -0,0 +1,179 @@
+package main
+
+import (
+	"github.com/mitroadmaps/gomapinfer/common"
+
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+type GeoJSONGeometry struct {
+	Type string `json:"type"`
+	Coordinates interface{} `json:"coordinates"`
+}
+
+type GeoJSONFeature struct {
+	Type string `json:"type"`
+	Geometry GeoJSONGeometry `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type GeoJSONFeatureCollection struct {
+	Type string `json:"type"`
+	Features []GeoJSONFeature `json:"features"`
+}
+
+// Returns the coordinates of a closed GeoJSON polygon ring.
+func polygonToGeoJSON(poly common.Polygon) [][][2]float64 {
+	var ring [][2]float64
+	for _, p := range poly {
+		ring = append(ring, [2]float64{p.X, p.Y})
+	}
+	if len(ring) > 0 {
+		ring = append(ring, ring[0])
+	}
+	return [][][2]float64{ring}
+}
+
+/*
+GetFeatures returns the outputs of an operation as a GeoJSON feature
+collection, so that the web UI can render each object as its own vector
+element with metadata. Coordinates are in ortho-image pixels rather than
+longitude and latitude. Features have a Kind property:
+- "sequence": a LineString through the detection centers, with ID, StartFrame,
+  EndFrame, Duration (seconds), Detections, Length (pixels along the path),
+  Speed (displacement in pixels per second, see Sequence.Speed), and Parents
+  (if merged)
+- "detection": a Polygon of each detection, with Frame, and either Index in
+  that frame for detection tables, or SequenceID and Index in the sequence
+  for sequence items
+- "cell": a MultiPolygon of each matrix cell with an observation, with the Cell,
+  and the Frame, Value, and other channels of its last observation
+*/
+func GetFeatures(dir string) (GeoJSONFeatureCollection, error) {
+	collection := GeoJSONFeatureCollection{
+		Type: "FeatureCollection",
+		Features: []GeoJSONFeature{},
+	}
+	addFeature := func(geometryType string, coordinates interface{}, properties map[string]interface{}) {
+		collection.Features = append(collection.Features, GeoJSONFeature{
+			Type: "Feature",
+			Geometry: GeoJSONGeometry{geometryType, coordinates},
+			Properties: properties,
+		})
+	}
+
+	// Matrix cells go first so that they are drawn below the objects.
+	if _, err := os.Stat(filepath.Join(dir, "matrix.json")); err == nil {
+		matrix, err := LoadMatrix(dir)
+		if err != nil {
+			return collection, err
+		}
+		tessellation, err := matrix.GetTessellation()
+		if err != nil {
+			return collection, err
+		}
+		cells := GetMatrixAt(matrix, -1)
+		var cellList [][2]int
+		for cell := range cells {
+			cellList = append(cellList, cell)
+		}
+		sort.Slice(cellList, func(i, j int) bool {
+			return cellList[i][0] < cellList[j][0] || (cellList[i][0] == cellList[j][0] && cellList[i][1] < cellList[j][1])
+		})
+		for _, cell := range cellList {
+			obs := cells[cell]
+			properties := map[string]interface{}{
+				"Kind": "cell",
+				"Cell": cell,
+				"Frame": obs.Frame,
+				"Value": obs.Value,
+			}
+			for channel, value := range obs.Channels {
+				properties[channel] = value
+			}
+			var coordinates [][][][2]float64
+			for _, poly := range tessellation.CellPolygons(cell) {
+				coordinates = append(coordinates, polygonToGeoJSON(poly))
+			}
+			addFeature("MultiPolygon", coordinates, properties)
+		}
+	}
+
+	var sequences []*Sequence
+	if bytes, err := ioutil.ReadFile(filepath.Join(dir, "sequences.json")); err == nil {
+		if err := json.Unmarshal(bytes, &sequences); err != nil {
+			return collection, err
+		}
+	}
+	for _, seq := range sequences {
+		if len(seq.Items) == 0 {
+			continue
+		}
+		var coordinates [][2]float64
+		var length float64
+		for i, item := range seq.Items {
+			p := item.Detection.Polygon().Bounds().Center()
+			coordinates = append(coordinates, [2]float64{p.X, p.Y})
+			if i > 0 {
+				length += seq.Items[i-1].Detection.Polygon().Bounds().Center().Distance(p)
+			}
+		}
+		startFrame := seq.Items[0].Frame
+		endFrame := seq.Items[len(seq.Items)-1].Frame
+		duration := float64(endFrame - startFrame) / FramesPerSecond
+		properties := map[string]interface{}{
+			"Kind": "sequence",
+			"ID": seq.ID,
+			"StartFrame": startFrame,
+			"EndFrame": endFrame,
+			"Duration": duration,
+			"Detections": len(seq.Items),
+			"Length": length,
+		}
+		if speed, ok := seq.Speed(); ok {
+			properties["Speed"] = speed
+		}
+		if len(seq.Parents) > 0 {
+			properties["Parents"] = seq.Parents
+		}
+		// A LineString needs at least two positions.
+		if len(coordinates) == 1 {
+			addFeature("Point", coordinates[0], properties)
+		} else {
+			addFeature("LineString", coordinates, properties)
+		}
+	}
+
+	// Detections go last so that they are drawn above their sequences.
+	for _, seq := range sequences {
+		for i, item := range seq.Items {
+			addFeature("Polygon", polygonToGeoJSON(item.Detection.Polygon()), map[string]interface{}{
+				"Kind": "detection",
+				"Frame": item.Frame,
+				"SequenceID": seq.ID,
+				"Index": i,
+			})
+		}
+	}
+	var detections [][]Detection
+	if bytes, err := ioutil.ReadFile(filepath.Join(dir, "detect.json")); err == nil {
+		if err := json.Unmarshal(bytes, &detections); err != nil {
+			return collection, err
+		}
+	}
+	for frameIdx, dlist := range detections {
+		for i, d := range dlist {
+			addFeature("Polygon", polygonToGeoJSON(d.Polygon()), map[string]interface{}{
+				"Kind": "detection",
+				"Frame": frameIdx,
+				"Index": i,
+			})
+		}
+	}
+
+	return collection, nil
+}
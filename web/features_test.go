@@ -0,0 +1,32 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestGetFeaturesSequenceDetections(t *testing.T) {
+	dir := t.TempDir()
+	sequences := []*Sequence{makeMergeTestSequence(7, 10, [2]int{0, 0}, [2]int{10, 0}, [2]int{20, 0})}
+	if err := ioutil.WriteFile(filepath.Join(dir, "sequences.json"), JsonMarshal(sequences), 0644); err != nil {
+		t.Fatal(err)
+	}
+	collection, err := GetFeatures(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var numDetections int
+	for _, feature := range collection.Features {
+		if feature.Properties["Kind"] != "detection" {
+			continue
+		}
+		if feature.Properties["SequenceID"] != 7 || feature.Properties["Frame"] != 10 + numDetections {
+			t.Errorf("unexpected detection properties %v", feature.Properties)
+		}
+		numDetections++
+	}
+	if len(collection.Features) != 4 || numDetections != 3 {
+		t.Errorf("expected a sequence and 3 detections, got %d features", len(collection.Features))
+	}
+}
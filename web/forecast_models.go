@@ -0,0 +1,396 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// ForecastModel forecasts the value at one cell of a matrix. The time unit is
+// the forecast interval (see ForecastOp).
+type ForecastModel interface {
+	// Updates the model with a value observed at an interval. Intervals are
+	// non-decreasing across calls.
+	Observe(interval int, value float64)
+	// Returns the prediction at an interval after the last observation.
+	// Predict is called once per interval.
+	Predict(interval int) ForecastPrediction
+}
+
+type ForecastPrediction struct {
+	Value float64
+	// The standard deviation of the prediction.
+	Stddev float64
+	// Whether the model had too few samples to estimate the standard
+	// deviation, in which case Stddev is only a placeholder.
+	Sparse bool
+}
+
+// Returns the prediction interval for z standard deviations, assuming normally
+// distributed errors. For sparse predictions, we use fallbackStddev instead
+// of the placeholder Stddev.
+func (pred ForecastPrediction) Interval(z float64, fallbackStddev float64) (float64, float64) {
+	stddev := pred.Stddev
+	if pred.Sparse {
+		stddev = fallbackStddev
+	}
+	return pred.Value - z * stddev, pred.Value + z * stddev
+}
+
+type ForecastParams struct {
+	// The number of intervals in a cycle.
+	Period int
+	// Smoothing factors of the level, trend, and seasonal components.
+	Alpha float64
+	Beta float64
+	Gamma float64
+	// The placeholder standard deviation when a model has too few samples to
+	// estimate it.
+	UnknownStddev float64
+}
+
+// Model parameters in Forecast and Simulate operands. They are pointers so
+// that zero can be set explicitly, e.g. Beta 0 for a model without trend.
+type ForecastParamOperands struct {
+	Alpha *float64
+	Beta *float64
+	Gamma *float64
+	UnknownStddev *float64
+}
+
+// Returns the model parameters, with defaults for those that are not set.
+func (operands ForecastParamOperands) Params(period int) (ForecastParams, error) {
+	params := ForecastParams{
+		Period: period,
+		Alpha: 0.3,
+		Beta: 0.05,
+		Gamma: 0.2,
+		UnknownStddev: 99,
+	}
+	for _, p := range []struct{
+		name string
+		operand *float64
+		param *float64
+	}{
+		{"Alpha", operands.Alpha, &params.Alpha},
+		{"Beta", operands.Beta, &params.Beta},
+		{"Gamma", operands.Gamma, &params.Gamma},
+	} {
+		if p.operand == nil {
+			continue
+		}
+		if *p.operand < 0 || *p.operand > 1 {
+			return ForecastParams{}, fmt.Errorf("forecast parameter %s must be between 0 and 1", p.name)
+		}
+		*p.param = *p.operand
+	}
+	if operands.UnknownStddev != nil {
+		if *operands.UnknownStddev < 0 {
+			return ForecastParams{}, fmt.Errorf("forecast parameter UnknownStddev must not be negative")
+		}
+		params.UnknownStddev = *operands.UnknownStddev
+	}
+	return params, nil
+}
+
+// Minimum number of samples before we trust the standard deviation.
+const ForecastMinSamples = 3
+
+var ForecastModels = map[string]func(params ForecastParams) ForecastModel{
+	"cyclic": func(params ForecastParams) ForecastModel {
+		return &cyclicModel{
+			params: params,
+			cyclicSamples: make(map[[2]int][]float64),
+		}
+	},
+	"ewma": func(params ForecastParams) ForecastModel {
+		return &ewmaModel{params: params}
+	},
+	"seasonal_naive": func(params ForecastParams) ForecastModel {
+		return &seasonalNaiveModel{
+			params: params,
+			lastByCycle: make(map[int]float64),
+		}
+	},
+	"holt_winters": func(params ForecastParams) ForecastModel {
+		return &holtWintersModel{
+			params: params,
+			seasonal: make([]float64, params.Period),
+		}
+	},
+}
+
+// Returns whether the model needs a Period.
+func forecastModelIsSeasonal(name string) bool {
+	return name != "ewma"
+}
+
+// The original Forecast model. This assumes a cyclic pattern, e.g. where the
+// user expects consistent daily changes in the input matrix value. We predict
+// the last value plus the mean of historical changes over the same number of
+// intervals, ending at the same point in the cycle.
+type cyclicModel struct {
+	params ForecastParams
+
+	// Map: (cycle, histsize) -> samples.
+	// Cycle: the cycle between 0 and Period for this sample.
+	// HistSize: history size.
+	// The samples describe the amount of change in the value between Cycle-HistSize and Cycle.
+	cyclicSamples map[[2]int][]float64
+
+	// Previous sample values and the intervals when those values were captured.
+	prevSamples []PrevSample
+
+	stddev float64
+}
+
+func (m *cyclicModel) Observe(interval int, value float64) {
+	period := m.params.Period
+	if len(m.prevSamples) > 0 {
+		// Tabulate previous values for the last (period) intervals.
+		// We use linear interpolation to get values in between samples when needed.
+		var prevTable []float64
+		curSample := PrevSample{
+			interval: interval,
+			val: value,
+		}
+		prevIdx := len(m.prevSamples) - 1
+		for histsize := 0; histsize < period; histsize++ {
+			// Get value at (interval - histsize).
+			prevSample := m.prevSamples[prevIdx]
+			wantInterval := interval - histsize
+			curWeight := wantInterval - prevSample.interval
+			prevWeight := curSample.interval - wantInterval
+			interp := (float64(curWeight) * curSample.val + float64(prevWeight) * prevSample.val) / float64(curWeight + prevWeight)
+			prevTable = append(prevTable, interp)
+
+			// If we got sample(s) at (interval - histsize), update curSample.
+			// This way, for the next histsize, we will interpolate between a more accurate sample.
+			for prevIdx >= 0 && wantInterval == m.prevSamples[prevIdx].interval {
+				curSample = m.prevSamples[prevIdx]
+				prevIdx--
+			}
+			if prevIdx < 0 {
+				break
+			}
+		}
+
+		// Extend the table so we don't need to worry about running past the end.
+		for len(prevTable) < 2*period {
+			prevTable = append(prevTable, prevTable[len(prevTable) - 1])
+		}
+
+		// Update cyclicSamples to reflect the new information.
+		// For each interval T between that of the previous sample and now, we update
+		// cyclicSamples with the estimated amount of change between T-histsize and T,
+		// for each histsize that's possible to compute given prevTable (i.e.), at
+		// most up to 2*period.
+		prevSample := m.prevSamples[len(m.prevSamples) - 1]
+		for curInterval := prevSample.interval + 1; curInterval <= interval; curInterval++ {
+			age := interval - curInterval
+			for histsize := 1; histsize < len(prevTable) - age; histsize++ {
+				curCycle := curInterval % period
+				cur := prevTable[age]
+				prev := prevTable[age + histsize]
+				rate := cur - prev
+				k := [2]int{curCycle, histsize}
+				m.cyclicSamples[k] = append(m.cyclicSamples[k], rate)
+			}
+		}
+	}
+
+	m.prevSamples = append(m.prevSamples, PrevSample{
+		interval: interval,
+		val: value,
+	})
+	m.stddev = 0
+}
+
+func (m *cyclicModel) Predict(interval int) ForecastPrediction {
+	prevSample := m.prevSamples[len(m.prevSamples) - 1]
+
+	// Use the samples of rate changes between prevSample and now to determine
+	// the variance at this cell.
+	histsize := interval - prevSample.interval
+	if histsize >= m.params.Period {
+		histsize = m.params.Period - 1
+	}
+	k := [2]int{interval % m.params.Period, histsize}
+
+	// Get stddev.
+	sparse := len(m.cyclicSamples[k]) < ForecastMinSamples
+	if sparse {
+		// If there were too few samples so far, then add a large amount to stddev.
+		// This means we really want to prioritize more observations at this cell before
+		// trusting our variance estimates.
+		m.stddev += m.params.UnknownStddev
+	} else {
+		m.stddev = getStddev(m.cyclicSamples[k], 0)
+	}
+
+	// Get mean.
+	pred := ForecastPrediction{
+		Value: prevSample.val,
+		Stddev: m.stddev,
+		Sparse: sparse,
+	}
+	if len(m.cyclicSamples[k]) >= 1 {
+		pred.Value += getMean(m.cyclicSamples[k])
+		if pred.Value < 0 {
+			pred.Value = 0
+		}
+	}
+	return pred
+}
+
+// Exponentially weighted moving average of the values. The stddev is the RMS
+// of the one-step errors, growing with the square root of the number of
+// intervals since the last observation.
+type ewmaModel struct {
+	params ForecastParams
+	level float64
+	lastInterval int
+	numObservations int
+	errors Accumulator
+}
+
+func (m *ewmaModel) Observe(interval int, value float64) {
+	if m.numObservations == 0 {
+		m.level = value
+	} else {
+		m.errors.Add(value - m.level)
+		m.level = m.params.Alpha * value + (1 - m.params.Alpha) * m.level
+	}
+	m.lastInterval = interval
+	m.numObservations++
+}
+
+func (m *ewmaModel) Predict(interval int) ForecastPrediction {
+	return errorPrediction(m.level, m.errors, interval - m.lastInterval, m.params)
+}
+
+// Predicts the most recent value observed at the same point in the cycle, or
+// the last value if there is none. The stddev is that of the changes between
+// values a cycle apart.
+type seasonalNaiveModel struct {
+	params ForecastParams
+	lastByCycle map[int]float64
+	last float64
+	lastInterval int
+	changes Accumulator
+}
+
+func (m *seasonalNaiveModel) Observe(interval int, value float64) {
+	cycle := interval % m.params.Period
+	if prev, ok := m.lastByCycle[cycle]; ok {
+		m.changes.Add(value - prev)
+	}
+	m.lastByCycle[cycle] = value
+	m.last = value
+	m.lastInterval = interval
+}
+
+func (m *seasonalNaiveModel) Predict(interval int) ForecastPrediction {
+	pred := ForecastPrediction{Value: m.last}
+	if value, ok := m.lastByCycle[interval % m.params.Period]; ok {
+		pred.Value = value
+	}
+	if m.changes.Count < ForecastMinSamples {
+		pred.Stddev = m.params.UnknownStddev
+		pred.Sparse = true
+	} else {
+		pred.Stddev = math.Sqrt(m.changes.SumSquares / float64(m.changes.Count))
+	}
+	return pred
+}
+
+// Additive Holt-Winters (triple exponential smoothing). Observations may be
+// several intervals apart, in which case the trend is applied over the gap.
+// The stddev is computed as for ewma.
+type holtWintersModel struct {
+	params ForecastParams
+	level float64
+	trend float64
+	seasonal []float64
+	lastInterval int
+	numObservations int
+	errors Accumulator
+}
+
+func (m *holtWintersModel) forecast(interval int) float64 {
+	h := float64(interval - m.lastInterval)
+	return m.level + h * m.trend + m.seasonal[interval % m.params.Period]
+}
+
+func (m *holtWintersModel) Observe(interval int, value float64) {
+	cycle := interval % m.params.Period
+	if m.numObservations == 0 {
+		m.level = value
+	} else {
+		m.errors.Add(value - m.forecast(interval))
+		h := float64(interval - m.lastInterval)
+		prevLevel := m.level
+		m.level = m.params.Alpha * (value - m.seasonal[cycle]) + (1 - m.params.Alpha) * (m.level + h * m.trend)
+		if h > 0 {
+			m.trend = m.params.Beta * (m.level - prevLevel) / h + (1 - m.params.Beta) * m.trend
+		}
+		m.seasonal[cycle] = m.params.Gamma * (value - m.level) + (1 - m.params.Gamma) * m.seasonal[cycle]
+	}
+	m.lastInterval = interval
+	m.numObservations++
+}
+
+func (m *holtWintersModel) Predict(interval int) ForecastPrediction {
+	return errorPrediction(m.forecast(interval), m.errors, interval - m.lastInterval, m.params)
+}
+
+// Returns the prediction of a value forecast h intervals ahead, where the
+// stddev is estimated from the one-step errors.
+func errorPrediction(value float64, errors Accumulator, h int, params ForecastParams) ForecastPrediction {
+	if errors.Count < ForecastMinSamples {
+		return ForecastPrediction{
+			Value: value,
+			Stddev: params.UnknownStddev,
+			Sparse: true,
+		}
+	}
+	rms := math.Sqrt(errors.SumSquares / float64(errors.Count))
+	if h < 1 {
+		h = 1
+	}
+	return ForecastPrediction{
+		Value: value,
+		Stddev: rms * math.Sqrt(float64(h)),
+	}
+}
+
+// A value at a cell and the interval when it was observed.
+type ForecastSample struct {
+	Interval int
+	Value float64
+}
+
+// Runs the model over intervals [0, numIntervals) at one cell, observing the
+// first numObserved samples, and calls emit with the prediction at each
+// interval after the first observation. At intervals where we observe the
+// cell, the prediction is the observed value with zero stddev, since we should
+// not need to observe it again immediately.
+func RunForecastModel(model ForecastModel, samples []ForecastSample, numObserved int, numIntervals int, emit func(interval int, pred ForecastPrediction)) {
+	sampleIdx := 0
+	for interval := 0; interval < numIntervals; interval++ {
+		observed := false
+		var lastValue float64
+		for ; sampleIdx < numObserved && samples[sampleIdx].Interval <= interval; sampleIdx++ {
+			model.Observe(samples[sampleIdx].Interval, samples[sampleIdx].Value)
+			observed = true
+			lastValue = samples[sampleIdx].Value
+		}
+		if sampleIdx == 0 {
+			continue
+		}
+		if observed {
+			emit(interval, ForecastPrediction{Value: lastValue})
+			continue
+		}
+		emit(interval, model.Predict(interval))
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Default number of decoded frames kept in memory by a FrameCache.
+const DefaultFrameCacheSize int = 16
+
+// FrameCache loads video frames from a directory of images named by frame
+// index (e.g. 000123.jpg), and keeps the most recently used frames decoded in
+// memory.
+type FrameCache struct {
+	// Maximum number of decoded frames to keep in memory.
+	Size int
+
+	mu sync.Mutex
+	paths map[int]string
+	images map[int]image.Image
+	// Frame indexes in images ordered from least to most recently used.
+	order []int
+}
+
+// Scans the video directory and returns a cache over its frames, keeping up
+// to size decoded frames, or DefaultFrameCacheSize if size is not positive.
+func NewFrameCache(videoDir string, size int) (*FrameCache, error) {
+	if size <= 0 {
+		size = DefaultFrameCacheSize
+	}
+	files, err := ioutil.ReadDir(videoDir)
+	if err != nil {
+		return nil, fmt.Errorf("error listing frames in %s: %v", videoDir, err)
+	}
+	paths := make(map[int]string)
+	for _, fi := range files {
+		ext := filepath.Ext(fi.Name())
+		if ext != ".jpg" && ext != ".png" {
+			continue
+		}
+		frameIdx, err := strconv.Atoi(strings.TrimSuffix(fi.Name(), ext))
+		if err != nil {
+			continue
+		}
+		paths[frameIdx] = filepath.Join(videoDir, fi.Name())
+	}
+	return &FrameCache{
+		Size: size,
+		paths: paths,
+		images: make(map[int]image.Image),
+	}, nil
+}
+
+// Returns the path of the image for the frame.
+func (c *FrameCache) Path(frameIdx int) (string, error) {
+	path, ok := c.paths[frameIdx]
+	if !ok {
+		return "", fmt.Errorf("frame %d not found in video directory", frameIdx)
+	}
+	return path, nil
+}
+
+// Returns the decoded image for the frame.
+func (c *FrameCache) Get(frameIdx int) (image.Image, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if im, ok := c.images[frameIdx]; ok {
+		c.touch(frameIdx)
+		return im, nil
+	}
+
+	path, err := c.Path(frameIdx)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening frame %d: %v", frameIdx, err)
+	}
+	defer f.Close()
+	im, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding frame %d from %s: %v", frameIdx, path, err)
+	}
+
+	c.images[frameIdx] = im
+	c.order = append(c.order, frameIdx)
+	for len(c.order) > c.Size {
+		delete(c.images, c.order[0])
+		c.order = c.order[1:]
+	}
+	return im, nil
+}
+
+// Moves the frame to the most recently used position.
+func (c *FrameCache) touch(frameIdx int) {
+	for i, idx := range c.order {
+		if idx != frameIdx {
+			continue
+		}
+		c.order = append(c.order[:i], c.order[i+1:]...)
+		break
+	}
+	c.order = append(c.order, frameIdx)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"github.com/mitroadmaps/gomapinfer/common"
+	gomapimage "github.com/mitroadmaps/gomapinfer/image"
+
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Options for rendering a video frame with the outputs of an operation.
+type FrameViewOptions struct {
+	// Whether to draw the cells of the output matrix, filled with the matrix
+	// values as of the frame.
+	Grid bool
+	// Colors of the matrix values.
+	Vis VisualizeOptions
+}
+
+/*
+RenderFrameView renders the original video frame with the outputs of an
+operation drawn over it, for debugging detector misses and alignment errors:
+- detections in the frame (red), from detect.json or from the sequence items
+  at the frame
+- sequences passing through the frame (orange), labeled with their ID
+- optionally the matrix cells (white), with their values
+
+Detections with OrigPoints are drawn at those points. Everything else is in
+ortho-image coordinates and is projected back into the frame through the
+homography that maps the frame corners to its footprint in align-out.json.
+*/
+func RenderFrameView(dir string, frameIdx int, frameCache *FrameCache, options FrameViewOptions) ([][][3]uint8, error) {
+	im, err := frameCache.Get(frameIdx)
+	if err != nil {
+		return nil, err
+	}
+	pix := imageToPix(im)
+	width, height := len(pix), len(pix[0])
+
+	// Get the transform from the ortho-image to the frame.
+	var frames []Frame
+	bytes, err := ioutil.ReadFile(filepath.Join(Config.DataDir, "align-out.json"))
+	if err != nil {
+		return nil, fmt.Errorf("error loading frame bounds: %v", err)
+	}
+	if err := json.Unmarshal(bytes, &frames); err != nil {
+		return nil, fmt.Errorf("error decoding frame bounds: %v", err)
+	}
+	var toFrame *Homography
+	if frameIdx < len(frames) && len(frames[frameIdx]) == 4 {
+		footprint := frames[frameIdx].Polygon()
+		corners := [4]common.Point{
+			{0, 0},
+			{float64(width), 0},
+			{float64(width), float64(height)},
+			{0, float64(height)},
+		}
+		toOrtho, err := GetHomography(corners, [4]common.Point{footprint[0], footprint[1], footprint[2], footprint[3]})
+		if err != nil {
+			return nil, fmt.Errorf("error computing homography of frame %d: %v", frameIdx, err)
+		}
+		h, err := toOrtho.Inverse()
+		if err != nil {
+			return nil, fmt.Errorf("error computing homography of frame %d: %v", frameIdx, err)
+		}
+		h = h.Orient(footprint.Bounds().Center())
+		toFrame = &h
+	}
+	// Projects ortho-image points into the frame, returning false if any
+	// point cannot be projected.
+	project := func(points []common.Point) ([]common.Point, bool) {
+		if toFrame == nil {
+			return nil, false
+		}
+		var out []common.Point
+		for _, p := range points {
+			q, ok := toFrame.Apply(p)
+			if !ok {
+				return nil, false
+			}
+			out = append(out, q)
+		}
+		return out, true
+	}
+	drawLine := func(a common.Point, b common.Point, c [3]uint8) {
+		for _, p := range common.DrawLineOnCells(int(a.X), int(a.Y), int(b.X), int(b.Y), width, height) {
+			gomapimage.DrawRect(pix, p[0], p[1], 1, c)
+		}
+	}
+	drawPolygon := func(poly []common.Point, c [3]uint8) {
+		for i := range poly {
+			drawLine(poly[i], poly[(i+1) % len(poly)], c)
+		}
+	}
+
+	var detections [][]Detection
+	var sequences []*Sequence
+	if bytes, err := ioutil.ReadFile(filepath.Join(dir, "detect.json")); err == nil {
+		if err := json.Unmarshal(bytes, &detections); err != nil {
+			return nil, err
+		}
+	}
+	if bytes, err := ioutil.ReadFile(filepath.Join(dir, "sequences.json")); err == nil {
+		if err := json.Unmarshal(bytes, &sequences); err != nil {
+			return nil, err
+		}
+	}
+
+	if options.Grid {
+		if _, err := os.Stat(filepath.Join(dir, "matrix.json")); err != nil {
+			return nil, fmt.Errorf("output has no matrix to draw the grid of")
+		}
+		matrix, err := LoadMatrix(dir)
+		if err != nil {
+			return nil, err
+		}
+		colors, err := GetMatrixColors(matrix, options.Vis, frameIdx, 0.4)
+		if err != nil {
+			return nil, err
+		}
+		if frameIdx < len(frames) && len(frames[frameIdx]) > 0 {
+			for _, cell := range colors.Tessellation.CellsInRect(frames[frameIdx].Polygon().Bounds()) {
+				for _, poly := range colors.Tessellation.CellPolygons(cell) {
+					projected, ok := project(poly)
+					if !ok {
+						continue
+					}
+					if c, ok := colors.Colors[cell]; ok {
+						fillPolygon(pix, common.Polygon(projected), c, colors.Alpha)
+					}
+					drawPolygon(projected, [3]uint8{255, 255, 255})
+				}
+			}
+		}
+	}
+
+	// Sequences passing through the frame.
+	orange := [3]uint8{255, 128, 0}
+	var frameDetections []Detection
+	for _, seq := range sequences {
+		if len(seq.Items) == 0 || frameIdx < seq.Items[0].Frame || frameIdx > seq.Items[len(seq.Items)-1].Frame {
+			continue
+		}
+		var centers []common.Point
+		for _, item := range seq.Items {
+			centers = append(centers, item.Detection.Polygon().Bounds().Center())
+			if item.Frame == frameIdx {
+				frameDetections = append(frameDetections, item.Detection)
+			}
+		}
+		projected, ok := project(centers)
+		if !ok {
+			continue
+		}
+		for i := 1; i < len(projected); i++ {
+			drawLine(projected[i-1], projected[i], orange)
+		}
+		if loc := seq.LocationAt(frameIdx); loc != nil {
+			if p, ok := project([]common.Point{*loc}); ok {
+				gomapimage.DrawRect(pix, int(p[0].X), int(p[0].Y), 4, orange)
+				drawText(pix, int(p[0].X) + 8, int(p[0].Y) - 8, fmt.Sprintf("%d", seq.ID), 3, orange)
+			}
+		}
+	}
+
+	// Detections in the frame.
+	if frameIdx < len(detections) {
+		frameDetections = append(frameDetections, detections[frameIdx]...)
+	}
+	for _, d := range frameDetections {
+		var poly []common.Point
+		if len(d.OrigPoints) > 0 {
+			for _, p := range d.OrigPoints {
+				poly = append(poly, common.Point{float64(p[0]), float64(p[1])})
+			}
+		} else {
+			var ok bool
+			poly, ok = project(d.Polygon())
+			if !ok {
+				continue
+			}
+		}
+		drawPolygon(poly, [3]uint8{255, 0, 0})
+	}
+
+	return pix, nil
+}
+
+// Converts an image to the [x][y] pixel arrays that we draw on.
+func imageToPix(im image.Image) [][][3]uint8 {
+	bounds := im.Bounds()
+	pix := make([][][3]uint8, bounds.Dx())
+	for x := range pix {
+		pix[x] = make([][3]uint8, bounds.Dy())
+		for y := range pix[x] {
+			r, g, b, _ := im.At(bounds.Min.X + x, bounds.Min.Y + y).RGBA()
+			pix[x][y] = [3]uint8{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8)}
+		}
+	}
+	return pix
+}
+
+func pixToImage(pix [][][3]uint8) *image.RGBA {
+	im := image.NewRGBA(image.Rect(0, 0, len(pix), len(pix[0])))
+	for x := range pix {
+		for y := range pix[x] {
+			im.SetRGBA(x, y, color.RGBA{pix[x][y][0], pix[x][y][1], pix[x][y][2], 255})
+		}
+	}
+	return im
+}
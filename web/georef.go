@@ -0,0 +1,53 @@
+package main
+
+import (
+	"github.com/mitroadmaps/gomapinfer/common"
+
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// Affine transform from ortho-image pixels to longitude and latitude, in the
+// same order as GDAL:
+//	lon = g[0] + x*g[1] + y*g[2]
+//	lat = g[3] + x*g[4] + y*g[5]
+type GeoTransform [6]float64
+
+func (g GeoTransform) ToLonLat(p common.Point) (float64, float64) {
+	return g[0] + p.X*g[1] + p.Y*g[2], g[3] + p.X*g[4] + p.Y*g[5]
+}
+
+// Returns the inverse transform, from longitude and latitude to pixels.
+func (g GeoTransform) Inverse() (GeoTransform, error) {
+	det := g[1]*g[5] - g[2]*g[4]
+	if det == 0 {
+		return GeoTransform{}, fmt.Errorf("geo transform is not invertible")
+	}
+	return GeoTransform{
+		(g[2]*g[3] - g[0]*g[5]) / det, g[5] / det, -g[2] / det,
+		(g[0]*g[4] - g[1]*g[3]) / det, -g[4] / det, g[1] / det,
+	}, nil
+}
+
+// Returns the path of the geo transform of the ortho-image.
+func GetGeoTransformPath() string {
+	return filepath.Join(Config.DataDir, "geotransform.json")
+}
+
+// Loads the geo transform of the ortho-image from
+// Config.DataDir/geotransform.json, which contains the six coefficients as a
+// JSON array (see the README).
+func LoadGeoTransform() (GeoTransform, error) {
+	var g GeoTransform
+	fname := GetGeoTransformPath()
+	bytes, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return g, fmt.Errorf("error loading geo transform from %s: %v", fname, err)
+	}
+	if err := json.Unmarshal(bytes, &g); err != nil {
+		return g, fmt.Errorf("error decoding geo transform: %v", err)
+	}
+	return g, nil
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"io/ioutil"
 )
 
 type Argument struct {
@@ -65,6 +66,13 @@ func (graph Graph) GetHashes() map[string][]byte {
 				}
 			}
 			h.Write([]byte(fmt.Sprintf("%s", node.Operation)))
+			if sources := OpSources[node.Operation]; sources != nil {
+				for _, fname := range sources(node.Arguments) {
+					// A missing file is reported when the operation runs.
+					bytes, _ := ioutil.ReadFile(fname)
+					h.Write([]byte(fmt.Sprintf("\n%x", sha256.Sum256(bytes))))
+				}
+			}
 			hashes[name] = h.Sum(nil)
 		}
 	}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"github.com/mitroadmaps/gomapinfer/common"
+
+	"fmt"
+	"math"
+)
+
+// A 3x3 projective transform in row-major order.
+type Homography [9]float64
+
+// Returns the homography that maps each src point to the corresponding dst
+// point.
+func GetHomography(src [4]common.Point, dst [4]common.Point) (Homography, error) {
+	// Solve the 8x8 linear system for the first eight entries, with Gaussian
+	// elimination and partial pivoting.
+	var a [8][9]float64
+	for i := 0; i < 4; i++ {
+		x, y, u, v := src[i].X, src[i].Y, dst[i].X, dst[i].Y
+		a[2*i] = [9]float64{x, y, 1, 0, 0, 0, -u*x, -u*y, u}
+		a[2*i+1] = [9]float64{0, 0, 0, x, y, 1, -v*x, -v*y, v}
+	}
+	for col := 0; col < 8; col++ {
+		pivot := col
+		for row := col+1; row < 8; row++ {
+			if math.Abs(a[row][col]) > math.Abs(a[pivot][col]) {
+				pivot = row
+			}
+		}
+		if math.Abs(a[pivot][col]) < 1e-9 {
+			return Homography{}, fmt.Errorf("degenerate points for homography")
+		}
+		a[col], a[pivot] = a[pivot], a[col]
+		for row := 0; row < 8; row++ {
+			if row == col {
+				continue
+			}
+			f := a[row][col] / a[col][col]
+			for k := col; k < 9; k++ {
+				a[row][k] -= f * a[col][k]
+			}
+		}
+	}
+	var h Homography
+	for i := 0; i < 8; i++ {
+		h[i] = a[i][8] / a[i][i]
+	}
+	h[8] = 1
+	return h, nil
+}
+
+// Transforms the point. The second return value is false if the point is on
+// or beyond the horizon, i.e., its homogeneous coordinate is not positive (see
+// Orient).
+func (h Homography) Apply(p common.Point) (common.Point, bool) {
+	w := h[6]*p.X + h[7]*p.Y + h[8]
+	if w <= 1e-9 {
+		return common.Point{}, false
+	}
+	return common.Point{
+		(h[0]*p.X + h[1]*p.Y + h[2]) / w,
+		(h[3]*p.X + h[4]*p.Y + h[5]) / w,
+	}, true
+}
+
+func (h Homography) Inverse() (Homography, error) {
+	// Adjugate divided by the determinant.
+	inv := Homography{
+		h[4]*h[8] - h[5]*h[7], h[2]*h[7] - h[1]*h[8], h[1]*h[5] - h[2]*h[4],
+		h[5]*h[6] - h[3]*h[8], h[0]*h[8] - h[2]*h[6], h[2]*h[3] - h[0]*h[5],
+		h[3]*h[7] - h[4]*h[6], h[1]*h[6] - h[0]*h[7], h[0]*h[4] - h[1]*h[3],
+	}
+	det := h[0]*inv[0] + h[1]*inv[3] + h[2]*inv[6]
+	if det == 0 {
+		return Homography{}, fmt.Errorf("homography is not invertible")
+	}
+	for i := range inv {
+		inv[i] /= det
+	}
+	return inv, nil
+}
+
+// Returns the equivalent homography where the point has a positive
+// homogeneous coordinate, so that Apply accepts points on the same side of the
+// horizon as p.
+func (h Homography) Orient(p common.Point) Homography {
+	if h[6]*p.X + h[7]*p.Y + h[8] >= 0 {
+		return h
+	}
+	for i := range h {
+		h[i] = -h[i]
+	}
+	return h
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"github.com/mitroadmaps/gomapinfer/common"
+
+	"testing"
+)
+
+func checkHomographyPoint(t *testing.T, h Homography, p common.Point, expected common.Point) {
+	t.Helper()
+	q, ok := h.Apply(p)
+	if !ok {
+		t.Errorf("point %v is beyond the horizon", p)
+	} else if q.Distance(expected) > 1e-6 {
+		t.Errorf("expected %v to map to %v, got %v", p, expected, q)
+	}
+}
+
+func TestHomographyRoundTrip(t *testing.T) {
+	src := [4]common.Point{{0, 0}, {640, 0}, {640, 480}, {0, 480}}
+	dst := [4]common.Point{{100, 200}, {900, 150}, {1000, 800}, {50, 700}}
+	h, err := GetHomography(src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range src {
+		checkHomographyPoint(t, h, src[i], dst[i])
+	}
+
+	inv, err := h.Inverse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range dst {
+		checkHomographyPoint(t, inv, dst[i], src[i])
+	}
+	// Points other than the corners also round trip.
+	p := common.Point{320, 100}
+	q, ok := h.Apply(p)
+	if !ok {
+		t.Fatalf("point %v is beyond the horizon", p)
+	}
+	checkHomographyPoint(t, inv, q, p)
+}
+
+func TestHomographyDegenerate(t *testing.T) {
+	// Three collinear source points.
+	src := [4]common.Point{{0, 0}, {1, 1}, {2, 2}, {0, 1}}
+	dst := [4]common.Point{{0, 0}, {1, 0}, {1, 1}, {0, 1}}
+	if _, err := GetHomography(src, dst); err == nil {
+		t.Error("expected error for degenerate points")
+	}
+	if _, err := (Homography{}).Inverse(); err == nil {
+		t.Error("expected error inverting a singular homography")
+	}
+}
+
+func TestHomographyOrient(t *testing.T) {
+	// Scaling every entry gives the same transform, but a negative scale puts
+	// every point beyond the horizon until the homography is oriented.
+	h := Homography{-2, 0, 0, 0, -2, 0, 0, 0, -1}
+	p := common.Point{3, 4}
+	if _, ok := h.Apply(p); ok {
+		t.Errorf("expected point %v to be beyond the horizon", p)
+	}
+	checkHomographyPoint(t, h.Orient(p), p, common.Point{6, 8})
+	if oriented := h.Orient(p); oriented.Orient(p) != oriented {
+		t.Error("expected an oriented homography to be unchanged")
+	}
+}
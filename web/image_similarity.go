@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+)
+
+// Padding in pixels around the second detection that is searched when
+// aligning it with the first detection.
+const SimilarityPadding int = 32
+
+// Side length of the square windows over which SSIM statistics are computed.
+const ssimWindowSize int = 7
+
+// Step in pixels of the coarse alignment search, which is then refined around
+// the best coarse offset.
+const similaritySearchStep int = 4
+
+// Returns the image similarity between two detections, which must have
+// OrigPoints set. As in the original seq-merge-imagediff.py script, this is
+// the structural similarity (SSIM) between the bounding box of the first
+// detection and the aligned region of the second frame, so that
+// MergeParams.SimilarityThreshold keeps its meaning. The script aligned the
+// crops with a homography from SIFT matches; we instead search translations
+// of up to SimilarityPadding pixels around the second detection, and take the
+// translation with the highest SSIM. SSIM is computed as in
+// skimage.measure.compare_ssim with multichannel=True: 7x7 uniform windows,
+// sample covariances, and the mean over windows and RGB channels.
+//
+// Returns an error if either detection is outside its frame, or too small or
+// close to the frame edge to compare.
+func GetImageSimilarity(frameCache *FrameCache, frameIdx1 int, detection1 Detection, frameIdx2 int, detection2 Detection) (float64, error) {
+	im1, rect1, err := getDetectionRect(frameCache, frameIdx1, detection1)
+	if err != nil {
+		return 0, err
+	}
+	im2, rect2, err := getDetectionRect(frameCache, frameIdx2, detection2)
+	if err != nil {
+		return 0, err
+	}
+	if rect1.Dx() < ssimWindowSize || rect1.Dy() < ssimWindowSize {
+		return 0, fmt.Errorf("detection at frame %d is smaller than the %dx%d SSIM window", frameIdx1, ssimWindowSize, ssimWindowSize)
+	}
+
+	// Search windows the size of the first detection around the center of the
+	// second detection.
+	center := rect2.Min.Add(rect2.Max).Div(2)
+	corner := center.Sub(image.Pt(rect1.Dx()/2, rect1.Dy()/2))
+	search := image.Rectangle{corner, corner.Add(rect1.Size())}.Inset(-SimilarityPadding).Intersect(im2.Bounds())
+	if search.Dx() < rect1.Dx() || search.Dy() < rect1.Dy() {
+		return 0, fmt.Errorf("detection at frame %d is too close to the frame edge to align", frameIdx2)
+	}
+
+	patch1 := newSSIMImage(im1, rect1)
+	patch2 := newSSIMImage(im2, search)
+	maxX := search.Dx() - rect1.Dx()
+	maxY := search.Dy() - rect1.Dy()
+	best := math.Inf(-1)
+	var bestX, bestY int
+	for ox := 0; ox <= maxX; ox += similaritySearchStep {
+		for oy := 0; oy <= maxY; oy += similaritySearchStep {
+			if s := getSSIM(patch1, patch2, ox, oy); s > best {
+				best, bestX, bestY = s, ox, oy
+			}
+		}
+	}
+	coarseX, coarseY := bestX, bestY
+	for ox := coarseX - similaritySearchStep + 1; ox < coarseX + similaritySearchStep; ox++ {
+		for oy := coarseY - similaritySearchStep + 1; oy < coarseY + similaritySearchStep; oy++ {
+			if ox < 0 || ox > maxX || oy < 0 || oy > maxY {
+				continue
+			}
+			if s := getSSIM(patch1, patch2, ox, oy); s > best {
+				best = s
+			}
+		}
+	}
+	return best, nil
+}
+
+// Returns the frame image and the bounding box of the detection in it.
+func getDetectionRect(frameCache *FrameCache, frameIdx int, detection Detection) (image.Image, image.Rectangle, error) {
+	if len(detection.OrigPoints) == 0 {
+		return nil, image.Rectangle{}, fmt.Errorf("detection at frame %d has no pixel coordinates", frameIdx)
+	}
+	im, err := frameCache.Get(frameIdx)
+	if err != nil {
+		return nil, image.Rectangle{}, err
+	}
+	var rect image.Rectangle
+	for _, p := range detection.OrigPoints {
+		rect = rect.Union(image.Rect(p[0], p[1], p[0]+1, p[1]+1))
+	}
+	rect = rect.Intersect(im.Bounds())
+	if rect.Empty() {
+		return nil, image.Rectangle{}, fmt.Errorf("detection at frame %d is outside the frame bounds", frameIdx)
+	}
+	return im, rect, nil
+}
+
+// The RGB values of an image region in [0, 255], along with integral images
+// of the values and squared values so that window sums take constant time.
+type ssimImage struct {
+	W int
+	H int
+	// Indexed [channel][y*W+x].
+	Pix [3][]float64
+	// Integral images, indexed [channel][y*(W+1)+x].
+	Sum [3][]float64
+	SquareSum [3][]float64
+}
+
+func newSSIMImage(im image.Image, rect image.Rectangle) ssimImage {
+	s := ssimImage{W: rect.Dx(), H: rect.Dy()}
+	for c := 0; c < 3; c++ {
+		s.Pix[c] = make([]float64, s.W*s.H)
+	}
+	for y := 0; y < s.H; y++ {
+		for x := 0; x < s.W; x++ {
+			r, g, b, _ := im.At(rect.Min.X+x, rect.Min.Y+y).RGBA()
+			s.Pix[0][y*s.W+x] = float64(r >> 8)
+			s.Pix[1][y*s.W+x] = float64(g >> 8)
+			s.Pix[2][y*s.W+x] = float64(b >> 8)
+		}
+	}
+	for c := 0; c < 3; c++ {
+		pix := s.Pix[c]
+		s.Sum[c] = getIntegralImage(s.W, s.H, func(x, y int) float64 {
+			return pix[y*s.W+x]
+		})
+		s.SquareSum[c] = getIntegralImage(s.W, s.H, func(x, y int) float64 {
+			return pix[y*s.W+x] * pix[y*s.W+x]
+		})
+	}
+	return s
+}
+
+// Returns the (w+1) x (h+1) integral image of f over [0, w) x [0, h).
+func getIntegralImage(w int, h int, f func(x, y int) float64) []float64 {
+	ii := make([]float64, (w+1)*(h+1))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			ii[(y+1)*(w+1)+x+1] = f(x, y) + ii[y*(w+1)+x+1] + ii[(y+1)*(w+1)+x] - ii[y*(w+1)+x]
+		}
+	}
+	return ii
+}
+
+// Returns the sum over the size x size window at (x, y) of an integral image
+// of width w.
+func getWindowSum(ii []float64, w int, x int, y int, size int) float64 {
+	stride := w+1
+	return ii[(y+size)*stride+x+size] - ii[y*stride+x+size] - ii[(y+size)*stride+x] + ii[y*stride+x]
+}
+
+// Returns the mean SSIM between a and the region of b with the same size at
+// offset (ox, oy).
+func getSSIM(a ssimImage, b ssimImage, ox int, oy int) float64 {
+	const dataRange = 255
+	c1 := (0.01*dataRange) * (0.01*dataRange)
+	c2 := (0.03*dataRange) * (0.03*dataRange)
+	n := float64(ssimWindowSize * ssimWindowSize)
+	covNorm := n / (n - 1)
+
+	var total float64
+	var count int
+	for c := 0; c < 3; c++ {
+		pa := a.Pix[c]
+		pb := b.Pix[c]
+		products := getIntegralImage(a.W, a.H, func(x, y int) float64 {
+			return pa[y*a.W+x] * pb[(y+oy)*b.W+x+ox]
+		})
+		for y := 0; y+ssimWindowSize <= a.H; y++ {
+			for x := 0; x+ssimWindowSize <= a.W; x++ {
+				ux := getWindowSum(a.Sum[c], a.W, x, y, ssimWindowSize) / n
+				uy := getWindowSum(b.Sum[c], b.W, x+ox, y+oy, ssimWindowSize) / n
+				uxx := getWindowSum(a.SquareSum[c], a.W, x, y, ssimWindowSize) / n
+				uyy := getWindowSum(b.SquareSum[c], b.W, x+ox, y+oy, ssimWindowSize) / n
+				uxy := getWindowSum(products, a.W, x, y, ssimWindowSize) / n
+				vx := covNorm * (uxx - ux*ux)
+				vy := covNorm * (uyy - uy*uy)
+				vxy := covNorm * (uxy - ux*uy)
+				total += ((2*ux*uy + c1) * (2*vxy + c2)) / ((ux*ux + uy*uy + c1) * (vx + vy + c2))
+				count++
+			}
+		}
+	}
+	return total / float64(count)
+}
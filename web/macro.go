@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+/*
+A Macro is a named sub-program with node inputs and parameters. Macros are
+defined in a program, or in another program file that is imported:
+	import "common.txt"
+
+	def parked_cars(cars) {
+		param displacement = 75
+		param duration = 600
+		traj = Track(cars)
+		stopped = Select(traj; "displacement < ${displacement}")
+		merged = Merge(stopped; "{"DistanceThreshold": 40}")
+		out = Select(merged; "duration > ${duration}")
+	}
+
+	cars = Detect("cars")
+	parked = parked_cars(cars; "{"duration": 900}")
+
+A call passes one node argument per input, optionally followed by a JSON
+object of parameter values. The body may call other macros, and must define
+the output node "out", which takes the name of the call. Other nodes of the
+body are added to the graph as CALL.NAME, e.g. parked.traj, so that they can
+be inspected. Since node hashes only depend on operations and arguments,
+expanded nodes share cached outputs with identical nodes elsewhere.
+
+Imported files are saved programs, i.e. NAME.txt in Config.ProgramsDir, and
+may be named with or without the extension. They may only contain imports and
+definitions.
+*/
+type Macro struct {
+	Name string
+	Inputs []string
+	// Lines of the body, which may declare and refer to parameters as in a
+	// program (see SubstituteParams).
+	Body string
+}
+
+var macroDefRegexp = regexp.MustCompile(`^def\s+([A-Za-z_][A-Za-z0-9_]*)\s*\(([^)]*)\)\s*\{$`)
+var importRegexp = regexp.MustCompile(`^import\s+"([^"]+)"$`)
+
+// Extracts the macro definitions and imports from the program. Returns the
+// macros, and the program with those lines blanked so that line numbers are
+// unchanged.
+func ParseMacros(text string) (map[string]*Macro, string, error) {
+	macros := make(map[string]*Macro)
+	text, err := parseMacros(text, macros, map[string]bool{}, false)
+	if err != nil {
+		return nil, "", err
+	}
+	return macros, text, nil
+}
+
+// Adds the macros defined in the text to macros. imported holds the files
+// already imported, and if library is set, the text may only contain imports
+// and definitions.
+func parseMacros(text string, macros map[string]*Macro, imported map[string]bool, library bool) (string, error) {
+	lines := strings.Split(text, "\n")
+	var cur *Macro
+	var body []string
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if cur != nil {
+			lines[i] = ""
+			if trimmed != "}" {
+				body = append(body, line)
+				continue
+			}
+			cur.Body = strings.Join(body, "\n")
+			macros[cur.Name] = cur
+			cur = nil
+			continue
+		}
+
+		if match := importRegexp.FindStringSubmatch(trimmed); match != nil {
+			lines[i] = ""
+			fname, err := getProgramPath(strings.TrimSuffix(match[1], ".txt"))
+			if err != nil {
+				return "", fmt.Errorf("line %d: %v", i+1, err)
+			}
+			if imported[fname] {
+				continue
+			}
+			imported[fname] = true
+			bytes, err := ioutil.ReadFile(fname)
+			if err != nil {
+				return "", fmt.Errorf("line %d: error importing %s: %v", i+1, match[1], err)
+			}
+			if _, err := parseMacros(string(bytes), macros, imported, true); err != nil {
+				return "", fmt.Errorf("in %s: %v", match[1], err)
+			}
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, "def ") {
+			match := macroDefRegexp.FindStringSubmatch(trimmed)
+			if match == nil {
+				return "", fmt.Errorf("line %d: expected line like def name(input; ...) {", i+1)
+			}
+			if macros[match[1]] != nil {
+				return "", fmt.Errorf("line %d: macro %s defined twice", i+1, match[1])
+			}
+			if Ops[match[1]] != nil {
+				return "", fmt.Errorf("line %d: macro %s has the same name as an operation", i+1, match[1])
+			}
+			cur = &Macro{Name: match[1]}
+			for _, input := range strings.Split(match[2], ";") {
+				input = strings.TrimSpace(input)
+				if input != "" {
+					cur.Inputs = append(cur.Inputs, input)
+				}
+			}
+			body = nil
+			lines[i] = ""
+			continue
+		}
+
+		if library && trimmed != "" {
+			return "", fmt.Errorf("line %d: imported files may only contain imports and definitions", i+1)
+		}
+	}
+	if cur != nil {
+		return "", fmt.Errorf("macro %s is missing the closing }", cur.Name)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// Expands a call of the macro into the graph, and returns the output node,
+// which is named name.
+func (macro *Macro) Expand(name string, arguments []Argument, graph Graph, macros map[string]*Macro, stack []string) (*Node, error) {
+	for _, caller := range stack {
+		if caller == macro.Name {
+			return nil, fmt.Errorf("macro %s calls itself", macro.Name)
+		}
+	}
+	stack = append(stack, macro.Name)
+
+	// Bind the inputs and parameters.
+	scope := make(map[string]*Node)
+	for i, input := range macro.Inputs {
+		if i >= len(arguments) || arguments[i].Type != "node" {
+			return nil, fmt.Errorf("macro %s expects %d node inputs", macro.Name, len(macro.Inputs))
+		}
+		scope[input] = arguments[i].Node
+	}
+	values := make(map[string]string)
+	if len(arguments) > len(macro.Inputs) + 1 {
+		return nil, fmt.Errorf("macro %s expects %d node inputs and optionally parameters", macro.Name, len(macro.Inputs))
+	} else if len(arguments) == len(macro.Inputs) + 1 {
+		arg := arguments[len(macro.Inputs)]
+		if arg.Type != "string" {
+			return nil, fmt.Errorf("macro %s expects %d node inputs and optionally parameters", macro.Name, len(macro.Inputs))
+		}
+		var params map[string]interface{}
+		if err := json.Unmarshal([]byte(arg.String), &params); err != nil {
+			return nil, fmt.Errorf("error decoding parameters of macro %s: %v", macro.Name, err)
+		}
+		for k, v := range params {
+			if s, ok := v.(string); ok {
+				values[k] = s
+			} else {
+				values[k] = fmt.Sprintf("%v", v)
+			}
+		}
+	}
+	body, err := SubstituteParams(macro.Body, values)
+	if err != nil {
+		return nil, fmt.Errorf("in macro %s: %v", macro.Name, err)
+	}
+
+	// Parse the body, and rename the output node to the call.
+	if err := parseNodes(strings.Split(body, "\n"), graph, scope, name + ".", macros, stack); err != nil {
+		return nil, fmt.Errorf("in macro %s: %v", macro.Name, err)
+	}
+	out := graph[name + ".out"]
+	if out == nil {
+		return nil, fmt.Errorf("macro %s does not define out", macro.Name)
+	}
+	delete(graph, out.Name)
+	out.Name = name
+	graph[name] = out
+	return out, nil
+}
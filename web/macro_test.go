@@ -0,0 +1,136 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testMacroParkedCars = `def parked_cars(cars) {
+	param displacement = 75
+	param duration = 600
+	traj = Track(cars)
+	stopped = Select(traj; "displacement < ${displacement}")
+	out = Select(stopped; "duration > ${duration}")
+}`
+
+func TestMacroSubstitution(t *testing.T) {
+	query := testMacroParkedCars + `
+cars = Detect("cars")
+parked = parked_cars(cars; "{"duration": 900}")`
+	graph, err := ParseQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The output takes the name of the call, and other nodes are prefixed.
+	parked := graph["parked"]
+	if parked == nil || parked.Operation != "Select" || graph["parked.out"] != nil {
+		t.Fatalf("expected the output node parked, got %+v", parked)
+	}
+	if s := parked.Arguments[1].String; s != "duration > 900" {
+		t.Errorf("expected the duration parameter to be substituted, got %s", s)
+	}
+	stopped := parked.Arguments[0].Node
+	if stopped != graph["parked.stopped"] || stopped.Arguments[1].String != "displacement < 75" {
+		t.Errorf("expected parked.stopped with the default displacement, got %+v", stopped)
+	}
+	// The input is bound to the node argument.
+	traj := graph["parked.traj"]
+	if traj == nil || traj.Arguments[0].Node != graph["cars"] {
+		t.Errorf("expected parked.traj to track cars, got %+v", traj)
+	}
+}
+
+func TestMacroNested(t *testing.T) {
+	query := testMacroParkedCars + `
+def parked_count(cars) {
+	p = parked_cars(cars; "{"duration": 300}")
+	out = ToMatrix(p; "{"Func": "count"}")
+}
+cars = Detect("cars")
+m = parked_count(cars)`
+	graph, err := ParseQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"m", "m.p", "m.p.traj", "m.p.stopped"} {
+		if graph[name] == nil {
+			t.Errorf("expected node %s", name)
+		}
+	}
+	if graph["m"].Arguments[0].Node != graph["m.p"] || graph["m.p"].Arguments[1].String != "duration > 300" {
+		t.Errorf("unexpected nested expansion %+v", graph["m.p"])
+	}
+}
+
+func TestMacroErrors(t *testing.T) {
+	for _, query := range []string{
+		// Direct and indirect recursion.
+		"def a(x) {\n\tout = a(x)\n}\nd = Detect(\"cars\")\ny = a(d)",
+		"def a(x) {\n\tout = b(x)\n}\ndef b(x) {\n\tout = a(x)\n}\nd = Detect(\"cars\")\ny = a(d)",
+		// Duplicate definitions.
+		testMacroParkedCars + "\n" + testMacroParkedCars,
+		// Macros may not shadow operations.
+		"def Track(x) {\n\tout = Select(x; \"true\")\n}",
+		// Wrong number of inputs, and a missing output.
+		testMacroParkedCars + "\ny = parked_cars()",
+		"def a(x) {\n\ty = Track(x)\n}\nd = Detect(\"cars\")\nz = a(d)",
+	} {
+		if _, err := ParseQuery(query); err == nil {
+			t.Errorf("expected error for query:\n%s", query)
+		}
+	}
+}
+
+func writeTestProgram(t *testing.T, name string, text string) {
+	if err := ioutil.WriteFile(filepath.Join(Config.ProgramsDir, name + ".txt"), []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMacroImport(t *testing.T) {
+	Config.ProgramsDir = t.TempDir()
+	writeTestProgram(t, "parking", testMacroParkedCars)
+	writeTestProgram(t, "counts", "import \"parking.txt\"\ndef parked_count(cars) {\n\tp = parked_cars(cars)\n\tout = ToMatrix(p; \"{}\")\n}")
+
+	// The library is imported once even though it is imported again
+	// indirectly, so its macros are not defined twice.
+	query := `import "parking.txt"
+import "counts"
+import "parking"
+cars = Detect("cars")
+m = parked_count(cars)`
+	graph, err := ParseQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if graph["m"] == nil || graph["m.p.traj"] == nil {
+		t.Errorf("expected nodes from the imported macros")
+	}
+
+	// Imported files may only contain definitions.
+	writeTestProgram(t, "invalid", "cars = Detect(\"cars\")")
+	if _, err := ParseQuery(`import "invalid"`); err == nil {
+		t.Error("expected error importing a file with nodes")
+	}
+}
+
+func TestMacroImportOutsidePrograms(t *testing.T) {
+	dir := t.TempDir()
+	Config.ProgramsDir = filepath.Join(dir, "programs")
+	if err := os.Mkdir(Config.ProgramsDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "secret.txt"), []byte(testMacroParkedCars), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"../secret.txt", "../secret", "/etc/passwd", "sub/parking.txt"} {
+		_, err := ParseQuery(`import "` + name + `"`)
+		if err == nil || !strings.Contains(err.Error(), "invalid program name") {
+			t.Errorf("expected invalid program name error importing %s, got %v", name, err)
+		}
+	}
+}
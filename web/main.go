@@ -2,20 +2,75 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
+	"fmt"
+	"image/jpeg"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 )
 
 func main() {
-	Config.DataDir = os.Args[1]
-	Config.VideoDir = os.Args[2]
+	explainFile := flag.String("explain", "", "print the plan of this program without running it")
+	explainParams := flag.String("params", "", "JSON object of parameter values for -explain")
+	explainDOT := flag.Bool("dot", false, "print the plan of -explain in DOT format")
+	optimize := flag.Bool("optimize", true, "optimize queries before running them (see Optimize)")
+	frameCacheSize := flag.Int("frame-cache", DefaultFrameCacheSize, "number of decoded video frames to keep in memory")
+	flag.Parse()
+	if flag.NArg() < 2 {
+		fmt.Fprintf(os.Stderr, "usage: %s [-optimize=false] [-explain PROGRAM [-params JSON] [-dot]] DATA_DIR VIDEO_DIR\n", os.Args[0])
+		os.Exit(2)
+	}
+	Config.DataDir = flag.Arg(0)
+	Config.VideoDir = flag.Arg(1)
 	Config.Python = "python3.6"
+	Config.ProgramsDir = "programs"
+	Config.FrameCacheSize = *frameCacheSize
+
+	if *explainFile != "" {
+		bytes, err := ioutil.ReadFile(*explainFile)
+		if err != nil {
+			log.Fatalf("error reading program: %v", err)
+		}
+		var params map[string]string
+		if *explainParams != "" {
+			if err := json.Unmarshal([]byte(*explainParams), &params); err != nil {
+				log.Fatalf("error decoding params: %v", err)
+			}
+		}
+		graph, err := ParseProgram(string(bytes), params)
+		if err != nil {
+			log.Fatalf("error parsing program: %v", err)
+		}
+		var rewrites []Rewrite
+		if *optimize {
+			graph, rewrites = Optimize(graph)
+		}
+		result := Explain(graph, rewrites)
+		if *explainDOT {
+			fmt.Print(result.DOT)
+		} else {
+			bytes, _ := json.MarshalIndent(result, "", "\t")
+			fmt.Println(string(bytes))
+		}
+		if result.HasErrors {
+			os.Exit(1)
+		}
+		return
+	}
 
 	var mu sync.Mutex
 	var running bool
+	// Held while rendering the visualization or animation, which can take a
+	// while, so that mu is not held and /state stays responsive.
+	var renderMu sync.Mutex
+	// Output directories of nodes in the last executed query.
+	var lastOutDirs map[string]string
 
 	fileServer := http.FileServer(http.Dir("web/static/"))
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -27,6 +82,35 @@ func main() {
 	http.HandleFunc("/exec", func(w http.ResponseWriter, r *http.Request) {
 		r.ParseForm()
 		query := r.PostForm.Get("query")
+		var params map[string]string
+		if paramsStr := r.PostForm.Get("params"); paramsStr != "" {
+			if err := json.Unmarshal([]byte(paramsStr), &params); err != nil {
+				http.Error(w, "error decoding params: " + err.Error(), 400)
+				return
+			}
+		}
+		visOptions, err := ParseVisualizeOptions(r.PostForm.Get("vis"))
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		// Parse the query before starting it, so that errors are returned to
+		// the client.
+		log.Printf("[main] parsing query")
+		graph, err := ParseProgram(query, params)
+		if err != nil {
+			http.Error(w, "error parsing query: " + err.Error(), 400)
+			return
+		}
+		if *optimize && r.PostForm.Get("optimize") != "0" {
+			var rewrites []Rewrite
+			graph, rewrites = Optimize(graph)
+			for _, rewrite := range rewrites {
+				log.Printf("[main] optimizer: %s", rewrite.Description)
+			}
+		}
+
 		mu.Lock()
 		defer mu.Unlock()
 		if running {
@@ -41,13 +125,6 @@ func main() {
 				mu.Unlock()
 			}()
 
-			// Parse and execute query.
-			log.Printf("[main] parsing query")
-			graph, err := ParseQuery(query)
-			if err != nil {
-				log.Printf("error parsing query: %v", err)
-				return
-			}
 			log.Printf("[main] executing query")
 			outDirs, err := graph.Exec()
 			if err != nil {
@@ -55,13 +132,18 @@ func main() {
 				return
 			}
 			log.Printf("[main] execution completed")
+			mu.Lock()
+			lastOutDirs = outDirs
+			mu.Unlock()
 
 			// Compute visualization of the "out" table (if set).
 			if graph["out"] == nil {
 				return
 			}
 			log.Printf("[main] visualizing output table")
-			err = Visualize(outDirs["out"])
+			renderMu.Lock()
+			err = Visualize(outDirs["out"], visOptions)
+			renderMu.Unlock()
 			if err != nil {
 				log.Printf("error visualizing output table: %v", err)
 				return
@@ -69,6 +151,26 @@ func main() {
 			log.Printf("[main] visualization ready")
 		}()
 	})
+	http.HandleFunc("/explain", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		var params map[string]string
+		if paramsStr := r.PostForm.Get("params"); paramsStr != "" {
+			if err := json.Unmarshal([]byte(paramsStr), &params); err != nil {
+				http.Error(w, "error decoding params: " + err.Error(), 400)
+				return
+			}
+		}
+		graph, err := ParseProgram(r.PostForm.Get("query"), params)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		var rewrites []Rewrite
+		if *optimize && r.PostForm.Get("optimize") != "0" {
+			graph, rewrites = Optimize(graph)
+		}
+		jsonResponse(w, Explain(graph, rewrites))
+	})
 	http.HandleFunc("/state", func(w http.ResponseWriter, r *http.Request) {
 		var state struct {
 			Running bool
@@ -78,6 +180,248 @@ func main() {
 		mu.Unlock()
 		jsonResponse(w, state)
 	})
+	http.HandleFunc("/visualize", func(w http.ResponseWriter, r *http.Request) {
+		// Re-render the output table of the last query with new options.
+		r.ParseForm()
+		visOptions, err := ParseVisualizeOptions(r.PostForm.Get("vis"))
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		mu.Lock()
+		isRunning := running
+		outDir := lastOutDirs["out"]
+		mu.Unlock()
+		if isRunning {
+			http.Error(w, "a query is running", 400)
+			return
+		}
+		if outDir == "" {
+			http.Error(w, "the last query has no output table", 404)
+			return
+		}
+		renderMu.Lock()
+		defer renderMu.Unlock()
+		if err := Visualize(outDir, visOptions); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	})
+	http.HandleFunc("/animate", func(w http.ResponseWriter, r *http.Request) {
+		// Render an animation of the output table of the last query.
+		r.ParseForm()
+		animOptions, err := ParseAnimateOptions(r.PostForm.Get("anim"))
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		mu.Lock()
+		isRunning := running
+		outDir := lastOutDirs["out"]
+		mu.Unlock()
+		if isRunning {
+			http.Error(w, "a query is running", 400)
+			return
+		}
+		if outDir == "" {
+			http.Error(w, "the last query has no output table", 404)
+			return
+		}
+		renderMu.Lock()
+		defer renderMu.Unlock()
+		if err := Animate(outDir, animOptions); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+	})
+	http.Handle("/anim/", http.StripPrefix("/anim/", http.FileServer(http.Dir(GetAnimationDir()))))
+	tileServer := NewTileServer(4096)
+	http.HandleFunc("/tiles/info", func(w http.ResponseWriter, r *http.Request) {
+		info, err := tileServer.Info()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		jsonResponse(w, info)
+	})
+	http.HandleFunc("/tiles/ortho/", func(w http.ResponseWriter, r *http.Request) {
+		z, x, y, err := ParseTilePath(strings.TrimPrefix(r.URL.Path, "/tiles/ortho/"))
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		bytes, err := tileServer.OrthoTile(z, x, y)
+		if err != nil {
+			http.Error(w, err.Error(), 404)
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(bytes)
+	})
+	http.HandleFunc("/tiles/node/", func(w http.ResponseWriter, r *http.Request) {
+		// Path: /tiles/node/{node}/{z}/{x}/{y}.png, with optional
+		// visualization options in the vis parameter.
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/tiles/node/"), "/", 2)
+		if len(parts) != 2 {
+			http.Error(w, "invalid tile path", 400)
+			return
+		}
+		z, x, y, err := ParseTilePath(parts[1])
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		visKey := r.URL.Query().Get("vis")
+		visOptions, err := ParseVisualizeOptions(visKey)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		mu.Lock()
+		outDir := lastOutDirs[parts[0]]
+		mu.Unlock()
+		if outDir == "" {
+			http.Error(w, "no such node in the last query", 404)
+			return
+		}
+		bytes, err := tileServer.OverlayTile(outDir, visOptions, visKey, z, x, y)
+		if err != nil {
+			http.Error(w, err.Error(), 404)
+			return
+		}
+		// The node's output changes between queries.
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(bytes)
+	})
+	http.HandleFunc("/features", func(w http.ResponseWriter, r *http.Request) {
+		nodeName := r.URL.Query().Get("node")
+		mu.Lock()
+		outDir := lastOutDirs[nodeName]
+		mu.Unlock()
+		if outDir == "" {
+			http.Error(w, "no such node in the last query", 404)
+			return
+		}
+		features, err := GetFeatures(outDir)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		jsonResponse(w, features)
+	})
+	var videoFrames *FrameCache
+	getVideoFrames := func() (*FrameCache, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if videoFrames == nil {
+			frameCache, err := NewFrameCache(Config.VideoDir, Config.FrameCacheSize)
+			if err != nil {
+				return nil, err
+			}
+			videoFrames = frameCache
+		}
+		return videoFrames, nil
+	}
+	http.HandleFunc("/video-frame", func(w http.ResponseWriter, r *http.Request) {
+		// Serve the original video frame.
+		frameIdx, err := strconv.Atoi(r.URL.Query().Get("frame"))
+		if err != nil {
+			http.Error(w, "invalid frame index", 400)
+			return
+		}
+		frameCache, err := getVideoFrames()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		path, err := frameCache.Path(frameIdx)
+		if err != nil {
+			http.Error(w, err.Error(), 404)
+			return
+		}
+		http.ServeFile(w, r, path)
+	})
+	http.HandleFunc("/frame-view", func(w http.ResponseWriter, r *http.Request) {
+		// Render a video frame with the outputs of a node of the last query.
+		frameIdx, err := strconv.Atoi(r.URL.Query().Get("frame"))
+		if err != nil {
+			http.Error(w, "invalid frame index", 400)
+			return
+		}
+		var options FrameViewOptions
+		options.Grid = r.URL.Query().Get("grid") == "1"
+		options.Vis, err = ParseVisualizeOptions(r.URL.Query().Get("vis"))
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		nodeName := r.URL.Query().Get("node")
+		mu.Lock()
+		outDir := lastOutDirs[nodeName]
+		mu.Unlock()
+		if outDir == "" {
+			http.Error(w, "no such node in the last query", 404)
+			return
+		}
+		frameCache, err := getVideoFrames()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		pix, err := RenderFrameView(outDir, frameIdx, frameCache, options)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		jpeg.Encode(w, pixToImage(pix), nil)
+	})
+	http.HandleFunc("/programs", func(w http.ResponseWriter, r *http.Request) {
+		programs, err := ListPrograms()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		jsonResponse(w, programs)
+	})
+	http.HandleFunc("/programs/", func(w http.ResponseWriter, r *http.Request) {
+		// GET loads the program (or a previous version), POST saves it, and
+		// DELETE deletes it.
+		name := strings.TrimPrefix(r.URL.Path, "/programs/")
+		if r.Method == "GET" {
+			var version int
+			if versionStr := r.URL.Query().Get("version"); versionStr != "" {
+				var err error
+				version, err = strconv.Atoi(versionStr)
+				if err != nil {
+					http.Error(w, "invalid version", 400)
+					return
+				}
+			}
+			program, err := LoadProgram(name, version)
+			if err != nil {
+				http.Error(w, err.Error(), 404)
+				return
+			}
+			jsonResponse(w, program)
+		} else if r.Method == "POST" {
+			r.ParseForm()
+			program, err := SaveProgram(name, r.PostForm.Get("text"))
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			jsonResponse(w, program)
+		} else if r.Method == "DELETE" {
+			if err := DeleteProgram(name); err != nil {
+				http.Error(w, err.Error(), 404)
+				return
+			}
+		} else {
+			http.Error(w, "method not allowed", 405)
+		}
+	})
 	http.HandleFunc("/vis", func(w http.ResponseWriter, r *http.Request) {
 		visPath := filepath.Join(Config.DataDir, "out.jpg")
 		if _, err := os.Stat(visPath); err != nil {
@@ -86,6 +430,30 @@ func main() {
 		}
 		http.ServeFile(w, r, visPath)
 	})
+	http.HandleFunc("/merge-candidates", func(w http.ResponseWriter, r *http.Request) {
+		// The Merge node is identified by its hash (see /explain), so that
+		// its outputs can be audited after other queries or a restart.
+		outDir, err := GetMergeDir(r.URL.Query().Get("hash"))
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		id, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil {
+			http.Error(w, "invalid sequence id", 400)
+			return
+		}
+		if _, err := os.Stat(outDir); err != nil {
+			http.Error(w, "no outputs of this Merge node", 404)
+			return
+		}
+		audit, err := GetMergeAudit(outDir, id)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		jsonResponse(w, audit)
+	})
 	log.Printf("starting on :8080")
 	log.Fatal(http.ListenAndServe(":8080", nil))
 }
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Name of the primary channel, which is stored in MatrixObservation.Value.
+const ValueChannel string = "value"
+
+type MatrixObservation struct {
+	Cell [2]int
+	Frame int
+	Value float64
+	// Additional named channels, e.g. "stddev" or "count".
+	Channels map[string]float64 `json:",omitempty"`
+	Metadata string `json:",omitempty"`
+}
+
+// Returns the value of the named channel, or 0 if it is not set.
+func (obs MatrixObservation) Get(channel string) float64 {
+	if channel == ValueChannel || channel == "" {
+		return obs.Value
+	}
+	return obs.Channels[channel]
+}
+
+// Sets the value of the named channel.
+func (obs *MatrixObservation) Set(channel string, value float64) {
+	if channel == ValueChannel || channel == "" {
+		obs.Value = value
+		return
+	}
+	if obs.Channels == nil {
+		obs.Channels = make(map[string]float64)
+	}
+	obs.Channels[channel] = value
+}
+
+type Matrix struct {
+	GridSize int
+	// If set, cells are [zone index, 0] instead of grid cells.
+	Zones []Zone `json:",omitempty"`
+	// The tessellation of the cells. Matrices without one (and without zones)
+	// use a square grid with GridSize.
+	Tessellation *TessellationSpec `json:",omitempty"`
+	Observations []MatrixObservation
+}
+
+// Returns the tessellation that the matrix cells are in.
+func (matrix Matrix) GetTessellation() (Tessellation, error) {
+	if matrix.Zones != nil {
+		return ZoneTessellation(matrix.Zones), nil
+	} else if matrix.Tessellation != nil {
+		return matrix.Tessellation.Tessellation()
+	}
+	return TessellationSpec{Size: matrix.GridSize}.Tessellation()
+}
+
+// Returns whether the matrices have the same cells.
+func (matrix Matrix) SameCells(other Matrix) bool {
+	a, _ := json.Marshal([]interface{}{matrix.GridSize, matrix.Zones, matrix.Tessellation})
+	b, _ := json.Marshal([]interface{}{other.GridSize, other.Zones, other.Tessellation})
+	return string(a) == string(b)
+}
+
+// Returns whether any observation in the matrix has the named channel.
+func (matrix Matrix) HasChannel(channel string) bool {
+	if channel == ValueChannel || channel == "" {
+		return true
+	}
+	for _, obs := range matrix.Observations {
+		if _, ok := obs.Channels[channel]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Loads the matrix.json in the given directory.
+// Matrices written before observations had channels are converted:
+// - Forecast stored a JSON Prediction in Metadata, which becomes the value
+//   and "stddev" channels.
+// - avg_speed stored "sum,count" in Metadata, which becomes the "sum" and
+//   "count" channels.
+func LoadMatrix(dir string) (Matrix, error) {
+	var matrix Matrix
+	inputPath := filepath.Join(dir, "matrix.json")
+	bytes, err := ioutil.ReadFile(inputPath)
+	if err != nil {
+		return matrix, fmt.Errorf("error loading matrix from %s: %v", inputPath, err)
+	}
+	if err := json.Unmarshal(bytes, &matrix); err != nil {
+		return matrix, fmt.Errorf("error decoding matrix from %s: %v", inputPath, err)
+	}
+	for i := range matrix.Observations {
+		obs := &matrix.Observations[i]
+		if obs.Channels != nil || obs.Metadata == "" {
+			continue
+		}
+		if strings.HasPrefix(obs.Metadata, "{") {
+			var prediction Prediction
+			if err := json.Unmarshal([]byte(obs.Metadata), &prediction); err == nil {
+				obs.Value = prediction.Val
+				obs.Set("stddev", prediction.Stddev)
+				obs.Metadata = ""
+			}
+		} else if parts := strings.Split(obs.Metadata, ","); len(parts) == 2 {
+			sum, err1 := strconv.ParseFloat(parts[0], 64)
+			count, err2 := strconv.ParseFloat(parts[1], 64)
+			if err1 == nil && err2 == nil {
+				obs.Set("sum", sum)
+				obs.Set("count", count)
+				obs.Value = sum / count
+				obs.Metadata = ""
+			}
+		}
+	}
+	return matrix, nil
+}
+
+// Writes the matrix to matrix.json in the given directory.
+func WriteMatrix(dir string, matrix Matrix) error {
+	bytes, err := json.Marshal(matrix)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "matrix.json"), bytes, 0644)
+}
@@ -1,7 +1,12 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"time"
 )
 
 type OpArgument struct {
@@ -16,6 +21,79 @@ type OpArgument struct {
 
 var Ops = map[string]func(args []OpArgument, outDir string) error{}
 
+// Source operators that read files outside of their arguments can list the
+// files here, and the file contents become part of the node hash, so that
+// outputs are recomputed when the files change.
+var OpSources = map[string]func(args []Argument) []string{}
+
+// The arguments that an operator accepts, which ValidateNode checks so that
+// mistakes in a query are reported before anything runs.
+type OpSignature struct {
+	MinArgs int
+	// Zero if there is no maximum.
+	MaxArgs int
+	// Whether the last argument, if it is a string, is a JSON object of
+	// operands.
+	JSONOperands bool
+}
+
+var OpSignatures = map[string]OpSignature{}
+
+// Returns an error if the node's arguments do not match the signature of its
+// operation. This only checks the argument count and that JSON operands
+// parse; the operator may still reject the operands when it runs.
+func ValidateNode(node *Node) error {
+	if Ops[node.Operation] == nil {
+		return fmt.Errorf("unknown operation %s", node.Operation)
+	}
+	sig, ok := OpSignatures[node.Operation]
+	if !ok {
+		return nil
+	}
+	if len(node.Arguments) < sig.MinArgs || (sig.MaxArgs > 0 && len(node.Arguments) > sig.MaxArgs) {
+		if sig.MinArgs == sig.MaxArgs {
+			return fmt.Errorf("%s expects %d arguments, got %d", node.Operation, sig.MinArgs, len(node.Arguments))
+		} else if sig.MaxArgs == 0 {
+			return fmt.Errorf("%s expects at least %d arguments, got %d", node.Operation, sig.MinArgs, len(node.Arguments))
+		}
+		return fmt.Errorf("%s expects %d to %d arguments, got %d", node.Operation, sig.MinArgs, sig.MaxArgs, len(node.Arguments))
+	}
+	if sig.JSONOperands && len(node.Arguments) > 0 {
+		last := node.Arguments[len(node.Arguments)-1]
+		if last.Type == "string" {
+			var operands map[string]interface{}
+			if err := json.Unmarshal([]byte(last.String), &operands); err != nil {
+				return fmt.Errorf("error decoding operands %s: %v", last.String, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Records how an output directory was computed, in ManifestName in the
+// directory.
+type RunManifest struct {
+	StartTime time.Time
+	// Seconds taken to compute the outputs.
+	Runtime float64
+}
+
+const ManifestName = "manifest.json"
+
+// Returns the manifest of an output directory, or nil if there is none, e.g.
+// if the outputs were computed before we wrote manifests.
+func LoadManifest(outDir string) *RunManifest {
+	bytes, err := ioutil.ReadFile(filepath.Join(outDir, ManifestName))
+	if err != nil {
+		return nil
+	}
+	var manifest RunManifest
+	if err := json.Unmarshal(bytes, &manifest); err != nil {
+		return nil
+	}
+	return &manifest
+}
+
 // Run a function, but only if the outDir is not created yet.
 // If it isn't there yet, we actually run the function to produce outputs in a temporary directory.
 // Then we atomically rename the temporary directory to outDir.
@@ -31,9 +109,17 @@ func RunIfNeeded(outDir string, f func(string) error) error {
 	}
 	os.MkdirAll(tmpDir, 0755)
 	// Run the function.
+	startTime := time.Now()
 	if err := f(tmpDir); err != nil {
 		return err
 	}
+	manifest := RunManifest{
+		StartTime: startTime,
+		Runtime: time.Since(startTime).Seconds(),
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, ManifestName), JsonMarshal(manifest), 0644); err != nil {
+		return err
+	}
 	// Since function completed successfully, we can rename the tmpDir.
 	if err := os.Rename(tmpDir, outDir); err != nil {
 		return err
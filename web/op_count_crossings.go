@@ -0,0 +1,232 @@
+package main
+
+import (
+	"github.com/mitroadmaps/gomapinfer/common"
+
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+)
+
+/*
+CountCrossings counts sequences crossing virtual lines. Example operands:
+	{"Lines": [{"Name": "north", "Points": [[100, 200], [300, 200]]}], "BinSize": "15m"}
+
+A line is a polyline in ortho-image pixel coordinates. The direction of a
+crossing is 1 if the object moves from the left side to the right side of
+the line, when looking along the line from its first point to its last point
+(in image coordinates, where y points down), and -1 otherwise.
+
+An object that stops exactly on the line crosses it only if it then leaves
+to the other side, so objects that touch the line and turn back, or that
+start or end on the line, are not counted.
+
+Outputs:
+- crossings.json: every crossing event (line, direction, sequence, frame, point)
+- counts.json: number of crossings for each line, direction, and time bin
+*/
+
+type CrossingLine struct {
+	Name string
+	Points [][2]float64
+}
+
+type CrossingEvent struct {
+	Line string
+	Direction int
+	Sequence int
+	Frame int
+	Point [2]float64
+}
+
+type CrossingCount struct {
+	Line string
+	Direction int
+	// First frame of the time bin.
+	Frame int
+	Count int
+}
+
+// Returns the position along a and b where the segments intersect, as a
+// fraction of their lengths, or false if they do not intersect.
+func segmentIntersection(a common.Segment, b common.Segment) (float64, float64, bool) {
+	va := a.End.Sub(a.Start)
+	vb := b.End.Sub(b.Start)
+	denom := va.X*vb.Y - va.Y*vb.X
+	if denom == 0 {
+		return 0, 0, false
+	}
+	d := b.Start.Sub(a.Start)
+	ta := (d.X*vb.Y - d.Y*vb.X) / denom
+	tb := (d.X*va.Y - d.Y*va.X) / denom
+	if ta < 0 || ta > 1 || tb < 0 || tb > 1 {
+		return 0, 0, false
+	}
+	return ta, tb, true
+}
+
+// Returns the crossings of a sequence over a line.
+func GetCrossings(seq *Sequence, line CrossingLine) []CrossingEvent {
+	var lineSegments []common.Segment
+	for i := 0; i < len(line.Points)-1; i++ {
+		lineSegments = append(lineSegments, common.Segment{
+			common.Point{line.Points[i][0], line.Points[i][1]},
+			common.Point{line.Points[i+1][0], line.Points[i+1][1]},
+		})
+	}
+
+	var events []CrossingEvent
+	// A crossing at the end of a movement, which is pending until we see
+	// which side the object leaves the line to.
+	var pending *CrossingEvent
+	for i := 0; i < len(seq.Items)-1; i++ {
+		item1 := seq.Items[i]
+		item2 := seq.Items[i+1]
+		movement := common.Segment{
+			item1.Detection.Polygon().Bounds().Center(),
+			item2.Detection.Polygon().Bounds().Center(),
+		}
+		for _, lineSegment := range lineSegments {
+			t, _, ok := segmentIntersection(movement, lineSegment)
+			if !ok {
+				continue
+			}
+			lv := lineSegment.End.Sub(lineSegment.Start)
+			mv := movement.End.Sub(movement.Start)
+			direction := 1
+			if lv.X*mv.Y - lv.Y*mv.X < 0 {
+				direction = -1
+			}
+			p := movement.Start.Add(mv.Scale(t))
+			event := CrossingEvent{
+				Line: line.Name,
+				Direction: direction,
+				Sequence: seq.ID,
+				Frame: item1.Frame + int(t * float64(item2.Frame - item1.Frame)),
+				Point: [2]float64{p.X, p.Y},
+			}
+			if t == 0 {
+				// The object leaves the line, so it crossed if it keeps going
+				// in the direction it arrived from.
+				if pending != nil && pending.Direction == direction {
+					events = append(events, *pending)
+				}
+				pending = nil
+			} else if t == 1 {
+				pending = &event
+			} else {
+				events = append(events, event)
+			}
+			break
+		}
+	}
+	return events
+}
+
+func CountCrossingsOp(args []OpArgument, outDir string) error {
+	// Parse arguments.
+	var operands struct {
+		Lines []CrossingLine
+		// Size of the time bins for counts (see Window for the format).
+		BinSize string
+		// Count at most one crossing per sequence, line, and direction, e.g. to
+		// ignore jitter of objects that stop on the line.
+		OncePerSequence bool
+	}
+	err := json.Unmarshal([]byte(args[1].String), &operands)
+	if err != nil {
+		return fmt.Errorf("error decoding operands %s: %v", args[1].String, err)
+	}
+	if len(operands.Lines) == 0 {
+		return fmt.Errorf("no lines specified")
+	}
+	for _, line := range operands.Lines {
+		if len(line.Points) < 2 {
+			return fmt.Errorf("line %s needs at least two points", line.Name)
+		}
+	}
+	if operands.BinSize == "" {
+		operands.BinSize = "15m"
+	}
+	binSize, err := ParseFrameSpec(operands.BinSize, "")
+	if err != nil {
+		return err
+	}
+	if binSize <= 0 {
+		return fmt.Errorf("bin size must be positive")
+	}
+
+	// Load the input sequences.
+	var sequences []*Sequence
+	inputPath := filepath.Join(args[0].DirName, "sequences.json")
+	bytes, err := ioutil.ReadFile(inputPath)
+	if err != nil {
+		return fmt.Errorf("error loading sequences from %s: %v", inputPath, err)
+	}
+	if err := json.Unmarshal(bytes, &sequences); err != nil {
+		return fmt.Errorf("error decoding sequences: %v", err)
+	}
+
+	events := []CrossingEvent{}
+	for _, seq := range sequences {
+		counted := make(map[CrossingCount]bool)
+		for _, line := range operands.Lines {
+			for _, event := range GetCrossings(seq, line) {
+				k := CrossingCount{Line: event.Line, Direction: event.Direction}
+				if operands.OncePerSequence && counted[k] {
+					continue
+				}
+				counted[k] = true
+				events = append(events, event)
+			}
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Frame < events[j].Frame
+	})
+
+	// Bin the crossings. We output every bin up to the last crossing, including
+	// empty ones, for each line and direction.
+	countMap := make(map[CrossingCount]int)
+	var numBins int
+	for _, event := range events {
+		bin := event.Frame / binSize
+		countMap[CrossingCount{Line: event.Line, Direction: event.Direction, Frame: bin * binSize}]++
+		if bin+1 > numBins {
+			numBins = bin+1
+		}
+	}
+	counts := []CrossingCount{}
+	for bin := 0; bin < numBins; bin++ {
+		for _, line := range operands.Lines {
+			for _, direction := range []int{1, -1} {
+				k := CrossingCount{Line: line.Name, Direction: direction, Frame: bin * binSize}
+				k.Count = countMap[k]
+				counts = append(counts, k)
+			}
+		}
+	}
+
+	bytes, err = json.Marshal(events)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(outDir, "crossings.json"), bytes, 0644); err != nil {
+		return err
+	}
+	bytes, err = json.Marshal(counts)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(outDir, "counts.json"), bytes, 0644); err != nil {
+		return err
+	}
+	return nil
+}
+
+func init() {
+	Ops["CountCrossings"] = CountCrossingsOp
+	OpSignatures["CountCrossings"] = OpSignature{MinArgs: 2, MaxArgs: 2, JSONOperands: true}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A horizontal line at y = 100 from x = 0 to x = 200.
+var testCrossingLine = CrossingLine{Name: "a", Points: [][2]float64{{0, 100}, {200, 100}}}
+
+func TestGetCrossings(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		centers [][2]int
+		directions []int
+	}{
+		{"down", [][2]int{{50, 50}, {50, 150}}, []int{1}},
+		{"up", [][2]int{{50, 150}, {50, 50}}, []int{-1}},
+		{"down and up", [][2]int{{50, 50}, {50, 150}, {60, 50}}, []int{1, -1}},
+		{"past the end", [][2]int{{250, 50}, {250, 150}}, nil},
+		{"touch and return", [][2]int{{50, 50}, {50, 100}, {50, 50}}, nil},
+		{"touch and continue", [][2]int{{50, 50}, {50, 100}, {50, 150}}, []int{1}},
+		{"along the line", [][2]int{{50, 50}, {50, 100}, {80, 100}, {80, 150}}, []int{1}},
+		{"start on the line", [][2]int{{50, 100}, {50, 150}}, nil},
+		{"end on the line", [][2]int{{50, 50}, {50, 100}}, nil},
+	} {
+		seq := makeMergeTestSequence(1, 0, c.centers...)
+		events := GetCrossings(seq, testCrossingLine)
+		if len(events) != len(c.directions) {
+			t.Errorf("%s: expected %d crossings, got %+v", c.name, len(c.directions), events)
+			continue
+		}
+		for i, event := range events {
+			if event.Direction != c.directions[i] || event.Line != "a" || event.Sequence != 1 {
+				t.Errorf("%s: unexpected crossing %+v", c.name, event)
+			}
+		}
+	}
+}
+
+func TestGetCrossingsFrame(t *testing.T) {
+	seq := &Sequence{ID: 1, Items: []SequenceItem{
+		{Detection: makeMergeTestDetection(50, 50), Frame: 10},
+		{Detection: makeMergeTestDetection(50, 250), Frame: 30},
+	}}
+	events := GetCrossings(seq, testCrossingLine)
+	if len(events) != 1 || events[0].Frame != 15 || events[0].Point != [2]float64{50, 100} {
+		t.Errorf("expected a crossing at frame 15 and (50, 100), got %+v", events)
+	}
+}
+
+func TestCountCrossingsOp(t *testing.T) {
+	dir := t.TempDir()
+	inputDir := filepath.Join(dir, "input")
+	outDir := filepath.Join(dir, "out")
+	for _, d := range []string{inputDir, outDir} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sequences := []*Sequence{
+		// Crosses down and back up.
+		makeMergeTestSequence(1, 0, [2]int{50, 50}, [2]int{50, 150}, [2]int{50, 50}),
+		makeMergeTestSequence(2, 10, [2]int{50, 50}, [2]int{50, 150}),
+	}
+	if err := ioutil.WriteFile(filepath.Join(inputDir, "sequences.json"), JsonMarshal(sequences), 0644); err != nil {
+		t.Fatal(err)
+	}
+	operands := `{"Lines": [{"Name": "a", "Points": [[0, 100], [200, 100]]}], "BinSize": "5"}`
+	args := []OpArgument{
+		{Type: "node", DirName: inputDir},
+		{Type: "string", String: operands},
+	}
+	if err := CountCrossingsOp(args, outDir); err != nil {
+		t.Fatal(err)
+	}
+	bytes, err := ioutil.ReadFile(filepath.Join(outDir, "counts.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var counts []CrossingCount
+	if err := json.Unmarshal(bytes, &counts); err != nil {
+		t.Fatal(err)
+	}
+	// Bins 0, 5, and 10, each with both directions.
+	expected := map[[2]int]int{{0, 1}: 1, {0, -1}: 1, {10, 1}: 1}
+	if len(counts) != 6 {
+		t.Fatalf("expected 6 counts, got %+v", counts)
+	}
+	for _, count := range counts {
+		if count.Count != expected[[2]int{count.Frame, count.Direction}] {
+			t.Errorf("unexpected count %+v", count)
+		}
+	}
+}
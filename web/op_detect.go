@@ -119,4 +119,5 @@ func DetectOp(args []OpArgument, outDir string) error {
 
 func init() {
 	Ops["Detect"] = DetectOp
+	OpSignatures["Detect"] = OpSignature{MinArgs: 1, MaxArgs: 1}
 }
@@ -6,18 +6,52 @@ import (
 	"io/ioutil"
 	"math"
 	"path/filepath"
+	"sort"
 )
 
-// Simple operator for forecasting the value and approximation of a "variance"
-// at each cell. This assumes a cyclic pattern, e.g. where the user expects
-// consistent daily changes in the input matrix value.
+/*
+Operator for forecasting the value and approximation of a "variance" at each
+cell. Model selects the forecasting model (see ForecastModels):
+- "cyclic" (default): assumes a cyclic pattern, e.g. where the user expects
+  consistent daily changes in the input matrix value
+- "ewma": exponentially weighted moving average
+- "seasonal_naive": the last value at the same point in the cycle
+- "holt_winters": additive Holt-Winters
+
+Observations have the prediction in the value channel, and the bounds of the
+prediction interval at the Confidence level (default 0.95) in the "lower" and
+"upper" channels, assuming normally distributed errors with the standard
+deviation in the "stddev" channel. At an interval where the cell is observed,
+the prediction is the observed value and the interval has zero width.
+
+Sparse cells, where the model has fewer than ForecastMinSamples samples to
+estimate its error, fall back to the standard deviation of all input values
+(over every cell and time) for the stddev channel and the interval, i.e., we
+assume nothing beyond the overall spread of the values. These observations
+have the "sparse" channel set to 1. The "model_stddev" channel has the
+standard deviation from the model, which for sparse cells is the placeholder
+UnknownStddev (default 99) that the cyclic model accumulates at each
+interval, so that Priorities on model_stddev visits sparse cells first.
+
+With Backtest set, we also hold out the later observations of each cell,
+forecast them from the earlier ones, and output backtest.json with the mean
+absolute error, root mean squared error, and coverage of the prediction
+intervals for each model in Models (default all models). The matrix is still
+output, from Model over all observations, so that a backtested Forecast can
+feed other operations.
+
+Model parameters (Alpha, Beta, Gamma, UnknownStddev) that are not set have
+defaults, see ForecastParamOperands.
+*/
 
 // Most recent processed sample recorded at a cell.
 type PrevSample struct {
 	interval int
-	val int
+	val float64
 }
 
+// Forecast used to store its output as JSON in the observation metadata.
+// We keep the type so that LoadMatrix can convert those matrices.
 type Prediction struct {
 	Val float64
 	Stddev float64
@@ -34,9 +68,9 @@ func getMean(a []float64) float64 {
 	return sum / float64(len(a))
 }
 
-func getStddev(a []float64, max int) float64 {
+func getStddev(a []float64, max float64) float64 {
 	if len(a) == 0 {
-		return float64(max)
+		return max
 	}
 	mean := getMean(a)
 	var sqdevsum float64 = 0
@@ -48,6 +82,28 @@ func getStddev(a []float64, max int) float64 {
 	return stddev
 }
 
+// Backtest results of one model.
+type ForecastBacktest struct {
+	Model string
+	// The number of cells and held-out observations that were forecast.
+	Cells int
+	Samples int
+	MAE float64
+	RMSE float64
+	// Fraction of held-out observations in the prediction interval at the
+	// backtest confidence level.
+	Coverage float64
+}
+
+// Returns z such that the interval [-z, z] has the given probability under a
+// standard normal distribution, or an error unless 0 < confidence < 1.
+func getNormalInterval(confidence float64) (float64, error) {
+	if !(confidence > 0 && confidence < 1) {
+		return 0, fmt.Errorf("confidence %v must be between 0 and 1", confidence)
+	}
+	return math.Sqrt2 * math.Erfinv(confidence), nil
+}
+
 func ForecastOp(args []OpArgument, outDir string) error {
 	// Parse arguments.
 	var operands struct {
@@ -61,204 +117,208 @@ func ForecastOp(args []OpArgument, outDir string) error {
 		// Then, setting Period=24*4=96 would specify that the period of the
 		// expected cyclic patterns is daily (96 15-min intervals per day).
 		Period int
+
+		// The channel of the input matrix to forecast (default "value").
+		Channel string
+
+		Model string
+		// Model parameters: Alpha, Beta, Gamma, and UnknownStddev.
+		ForecastParamOperands
+
+		Backtest bool
+		// Fraction of each cell's observations to hold out, between 0 and 1
+		// (default 0.25).
+		Holdout float64
+		// Confidence level of the prediction intervals, between 0 and 1
+		// (default 0.95).
+		Confidence float64
+		// Models to backtest.
+		Models []string
 	}
 	err := json.Unmarshal([]byte(args[1].String), &operands)
 	if err != nil {
 		return fmt.Errorf("error decoding operands %s: %v", args[1].String, err)
 	}
-
-	// Load the input matrix.
-	var inputMatrix Matrix
-	inputPath := filepath.Join(args[0].DirName, "matrix.json")
-	bytes, err := ioutil.ReadFile(inputPath)
+	if operands.Frequency <= 0 {
+		return fmt.Errorf("forecast frequency must be positive")
+	}
+	if operands.Model == "" {
+		operands.Model = "cyclic"
+	}
+	if operands.Holdout == 0 {
+		operands.Holdout = 0.25
+	}
+	if !(operands.Holdout > 0 && operands.Holdout < 1) {
+		return fmt.Errorf("holdout %v must be between 0 and 1", operands.Holdout)
+	}
+	if operands.Confidence == 0 {
+		operands.Confidence = 0.95
+	}
+	params, err := operands.ForecastParamOperands.Params(operands.Period)
 	if err != nil {
-		return fmt.Errorf("error loading matrix from %s: %v", inputPath, err)
+		return err
 	}
-	if err := json.Unmarshal(bytes, &inputMatrix); err != nil {
+	z, err := getNormalInterval(operands.Confidence)
+	if err != nil {
 		return err
 	}
-	gridSize := inputMatrix.GridSize
 
-	// Get unique cells.
-	cells := make(map[[2]int]bool)
-	for _, obs := range inputMatrix.Observations {
-		cells[obs.Cell] = true
+	var backtestModels []string
+	if operands.Backtest {
+		backtestModels = operands.Models
+		if len(backtestModels) == 0 {
+			backtestModels = []string{"cyclic", "ewma", "seasonal_naive", "holt_winters"}
+		}
+	}
+	for _, model := range append([]string{operands.Model}, backtestModels...) {
+		if ForecastModels[model] == nil {
+			return fmt.Errorf("no such forecast model %s", model)
+		}
+		if forecastModelIsSeasonal(model) && params.Period <= 0 {
+			return fmt.Errorf("forecast model %s needs a positive Period", model)
+		}
 	}
 
-	// Map: cell -> (cycle, histsize) -> samples.
-	// Cell: matrix cell that the samples correspond to.
-	// Cycle: the cycle between 0 and Period for this sample.
-	// HistSize: history size.
-	// The samples describe the amount of change in the value between Cycle-HistSize and Cycle.
-	cyclicSamples := make(map[[2]int]map[[2]int][]float64)
-
-	// Previous sample value and the interval when that value was captured, at each cell.
-	prevSamples := make(map[[2]int][]PrevSample)
-
-	// Output observations.
-	matrixObservations := []MatrixObservation{}
-
-	stddevs := make(map[[2]int]float64)
-	var max int
-
-	endIdx := inputMatrix.Observations[len(inputMatrix.Observations)-1].Frame
-	inputObsCounter := 0
-
-	for interval := 0; interval <= endIdx/operands.Frequency; interval++ {
-		cycle := interval % operands.Period
-		nextIntervalFrame := (interval+1) * operands.Frequency
+	// Load the input matrix.
+	inputMatrix, err := LoadMatrix(args[0].DirName)
+	if err != nil {
+		return err
+	}
+	if !inputMatrix.HasChannel(operands.Channel) {
+		return fmt.Errorf("input matrix has no channel %s", operands.Channel)
+	}
+	if len(inputMatrix.Observations) == 0 {
+		return fmt.Errorf("input matrix has no observations")
+	}
 
-		// Process input observations from the current interval.
-		for ; inputObsCounter < len(inputMatrix.Observations) && inputMatrix.Observations[inputObsCounter].Frame < nextIntervalFrame; inputObsCounter++ {
-			obs := inputMatrix.Observations[inputObsCounter]
-			cell := obs.Cell
-			value := obs.Value
+	// Get the samples at each cell.
+	var cells [][2]int
+	cellSamples := make(map[[2]int][]ForecastSample)
+	numIntervals := 0
+	for _, obs := range inputMatrix.Observations {
+		if cellSamples[obs.Cell] == nil {
+			cells = append(cells, obs.Cell)
+		}
+		interval := obs.Frame / operands.Frequency
+		cellSamples[obs.Cell] = append(cellSamples[obs.Cell], ForecastSample{
+			Interval: interval,
+			Value: obs.Get(operands.Channel),
+		})
+		if interval+1 > numIntervals {
+			numIntervals = interval+1
+		}
+	}
+	// Returns the prediction interval, see the comment above.
+	var allValues Accumulator
+	for _, samples := range cellSamples {
+		for _, sample := range samples {
+			allValues.Add(sample.Value)
+		}
+	}
+	getInterval := func(pred ForecastPrediction) (float64, float64) {
+		return pred.Interval(z, allValues.Stddev())
+	}
+	getPredictionStddev := func(pred ForecastPrediction) float64 {
+		if pred.Sparse {
+			return allValues.Stddev()
+		}
+		return pred.Stddev
+	}
 
-			if cyclicSamples[cell] == nil {
-				cyclicSamples[cell] = make(map[[2]int][]float64)
-			}
-			if len(prevSamples[cell]) > 0 {
-				// Tabulate previous values for the last (period) intervals.
-				// We use linear interpolation to get values in between samples when needed.
-				var prevTable []float64
-				curSample := PrevSample{
-					interval: interval,
-					val: value,
-				}
-				prevIdx := len(prevSamples[cell]) - 1
-				for histsize := 0; histsize < operands.Period; histsize++ {
-					// Get value at (interval - histsize).
-					prevSample := prevSamples[cell][prevIdx]
-					wantInterval := interval - histsize
-					curWeight := wantInterval - prevSample.interval
-					prevWeight := curSample.interval - wantInterval
-					interp := float64(curWeight * curSample.val + prevWeight * prevSample.val) / float64(curWeight + prevWeight)
-					prevTable = append(prevTable, interp)
+	sort.Slice(cells, func(i, j int) bool {
+		return cells[i][0] < cells[j][0] || (cells[i][0] == cells[j][0] && cells[i][1] < cells[j][1])
+	})
+	for _, samples := range cellSamples {
+		sort.SliceStable(samples, func(i, j int) bool {
+			return samples[i].Interval < samples[j].Interval
+		})
+	}
 
-					// If we got sample(s) at (interval - histsize), update curSample.
-					// This way, for the next histsize, we will interpolate between a more accurate sample.
-					for prevIdx >= 0 && wantInterval == prevSamples[cell][prevIdx].interval {
-						curSample = prevSamples[cell][prevIdx]
-						prevIdx--
-					}
-					if prevIdx < 0 {
-						break
-					}
+	if operands.Backtest {
+		results := []ForecastBacktest{}
+		for _, modelName := range backtestModels {
+			result := ForecastBacktest{Model: modelName}
+			var absErrors, sqErrors float64
+			var covered int
+			for _, cell := range cells {
+				samples := cellSamples[cell]
+				numObserved := int(math.Ceil(float64(len(samples)) * (1 - operands.Holdout)))
+				if numObserved < 1 || numObserved >= len(samples) {
+					continue
 				}
-
-				// Extend the table so we don't need to worry about running past the end.
-				for len(prevTable) < 2*operands.Period {
-					prevTable = append(prevTable, prevTable[len(prevTable) - 1])
+				heldOut := make(map[int][]float64)
+				for _, sample := range samples[numObserved:] {
+					heldOut[sample.Interval] = append(heldOut[sample.Interval], sample.Value)
 				}
-
-				// Update cyclicSamples to reflect the new information.
-				// For each interval T between that of the previous sample and now, we update
-				// cyclicSamples with the estimated amount of change between T-histsize and T,
-				// for each histsize that's possible to compute given prevTable (i.e.), at
-				// most up to 2*operands.Period.
-				prevSample := prevSamples[cell][len(prevSamples[cell]) - 1]
-				for curInterval := prevSample.interval + 1; curInterval <= interval; curInterval++ {
-					age := interval - curInterval
-					for histsize := 1; histsize < len(prevTable) - age; histsize++ {
-						curCycle := curInterval % operands.Period
-						cur := prevTable[age]
-						prev := prevTable[age + histsize]
-						rate := cur - prev
-						k := [2]int{curCycle, histsize}
-						cyclicSamples[cell][k] = append(cyclicSamples[cell][k], rate)
+				model := ForecastModels[modelName](params)
+				RunForecastModel(model, samples, numObserved, numIntervals, func(interval int, pred ForecastPrediction) {
+					lower, upper := getInterval(pred)
+					for _, actual := range heldOut[interval] {
+						d := actual - pred.Value
+						absErrors += math.Abs(d)
+						sqErrors += d * d
+						if actual >= lower && actual <= upper {
+							covered++
+						}
+						result.Samples++
 					}
-				}
+				})
+				result.Cells++
 			}
-
-			prevSamples[cell] = append(prevSamples[cell], PrevSample{
-				interval: interval,
-				val: value,
-			})
-
-			if value > max {
-				max = value
+			if result.Samples > 0 {
+				result.MAE = absErrors / float64(result.Samples)
+				result.RMSE = math.Sqrt(sqErrors / float64(result.Samples))
+				result.Coverage = float64(covered) / float64(result.Samples)
 			}
+			results = append(results, result)
 		}
+		bytes, err := json.Marshal(results)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(outDir, "backtest.json"), bytes, 0644); err != nil {
+			return err
+		}
+	}
 
-		// Add predictions for all cells to the output matrix.
-		// We put the prediction in metadata and the stddev in the matrix value.
-		// (Really we should output two matrices, but that isn't supported in this version of the code.)
-		for cell := range cells {
-			prevSample := prevSamples[cell][len(prevSamples[cell]) - 1]
-
-			value, stddev := func() (float64, float64) {
-				// If we just get an observation at this cell on the current interval,
-				// then we should not observe it again immediately -- so set "variance"
-				// to zero.
-				if prevSample.interval == interval {
-					stddevs[cell] = 0
-					return float64(prevSample.val), 0
-				}
-
-				// Use the samples of rate changes between prevSample and now to determine
-				// the variance at this cell.
-				histsize := interval - prevSample.interval
-				if histsize >= operands.Period {
-					histsize = operands.Period - 1
-				}
-				k := [2]int{cycle, histsize}
-
-				// Get stddev.
-				if len(cyclicSamples[cell][k]) < 3 {
-					// If there were fewer than three samples so far, then add a large amount to stddevs.
-					// This means we really want to prioritize more observations at this cell before
-					// trusting our variance estimates.
-					stddevs[cell] += 99
-				} else {
-					stddevs[cell] = getStddev(cyclicSamples[cell][k], max)
-				}
-
-				// Get mean.
-				var value float64
-				if len(cyclicSamples[cell][k]) < 1 {
-					value = float64(prevSample.val)
-				} else {
-					change := getMean(cyclicSamples[cell][k])
-					value = float64(prevSample.val) + change
-					if value < 0 {
-						value = 0
-					}
-				}
-
-				return value, stddevs[cell]
-			}()
-
-			prediction := Prediction{
-				Val: value,
-				Stddev: stddev,
-			}
-			bytes, err := json.Marshal(prediction)
-			if err != nil {
-				panic(err)
-			}
-			matrixObservations = append(matrixObservations, MatrixObservation{
+	// Add predictions for all cells to the output matrix.
+	matrixObservations := []MatrixObservation{}
+	for _, cell := range cells {
+		samples := cellSamples[cell]
+		model := ForecastModels[operands.Model](params)
+		RunForecastModel(model, samples, len(samples), numIntervals, func(interval int, pred ForecastPrediction) {
+			obs := MatrixObservation{
 				Cell: cell,
 				Frame: interval * operands.Frequency,
-				Value: int(value),
-				Metadata: string(bytes),
-			})
-		}
+				Value: pred.Value,
+			}
+			lower, upper := getInterval(pred)
+			obs.Set("stddev", getPredictionStddev(pred))
+			obs.Set("lower", lower)
+			obs.Set("upper", upper)
+			obs.Set("model_stddev", pred.Stddev)
+			if pred.Sparse {
+				obs.Set("sparse", 1)
+			} else {
+				obs.Set("sparse", 0)
+			}
+			matrixObservations = append(matrixObservations, obs)
+		})
 	}
+	sort.SliceStable(matrixObservations, func(i, j int) bool {
+		return matrixObservations[i].Frame < matrixObservations[j].Frame
+	})
 
 	matrix := Matrix{
-		GridSize: gridSize,
+		GridSize: inputMatrix.GridSize,
+		Zones: inputMatrix.Zones,
+		Tessellation: inputMatrix.Tessellation,
 		Observations: matrixObservations,
 	}
-	bytes, err = json.Marshal(matrix)
-	if err != nil {
-		return err
-	}
-	if err := ioutil.WriteFile(filepath.Join(outDir, "matrix.json"), bytes, 0644); err != nil {
-		return err
-	}
-	return nil
+	return WriteMatrix(outDir, matrix)
 }
 
 func init() {
 	Ops["Forecast"] = ForecastOp
+	OpSignatures["Forecast"] = OpSignature{MinArgs: 2, MaxArgs: 2, JSONOperands: true}
 }
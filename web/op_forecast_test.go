@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"testing"
+)
+
+func TestForecastIntervalStddev(t *testing.T) {
+	// Cell (0, 0) has many samples and cell (1, 0) only one, so its forecasts
+	// are sparse.
+	var observations []MatrixObservation
+	for i := 0; i < 20; i++ {
+		observations = append(observations, MatrixObservation{
+			Cell: [2]int{0, 0},
+			Frame: 2*i,
+			Value: float64(i % 4),
+		})
+	}
+	observations = append(observations, MatrixObservation{Cell: [2]int{1, 0}, Frame: 0, Value: 5})
+	inputDir := t.TempDir()
+	if err := WriteMatrix(inputDir, Matrix{GridSize: 32, Observations: observations}); err != nil {
+		t.Fatal(err)
+	}
+
+	outDir := t.TempDir()
+	args := []OpArgument{
+		{Type: "node", DirName: inputDir},
+		{Type: "string", String: `{"Frequency": 2, "Model": "ewma", "Confidence": 0.9}`},
+	}
+	if err := ForecastOp(args, outDir); err != nil {
+		t.Fatal(err)
+	}
+	matrix, err := LoadMatrix(outDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	z, err := getNormalInterval(0.9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var numSparse int
+	for _, obs := range matrix.Observations {
+		stddev := obs.Get("stddev")
+		width := obs.Get("upper") - obs.Get("lower")
+		if math.Abs(width - 2*z*stddev) > 1e-9 {
+			t.Errorf("observation %+v: interval width %v does not match stddev %v", obs, width, stddev)
+		}
+		if obs.Get("sparse") == 1 {
+			numSparse++
+			if obs.Get("model_stddev") != 99 {
+				t.Errorf("expected placeholder model stddev for sparse observation %+v", obs)
+			}
+		}
+	}
+	if numSparse == 0 {
+		t.Error("expected sparse observations at cell (1, 0)")
+	}
+
+	// Exceedance uses the stored stddev, regardless of the Forecast confidence.
+	rateFunc, err := PriorityRateSpec{Rate: "exceedance", Threshold: 1}.RateFunc(matrix.HasChannel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obs := MatrixObservation{Value: 1}
+	obs.Set("stddev", 2)
+	if rate := rateFunc(obs); math.Abs(rate - 0.5) > 1e-9 {
+		t.Errorf("expected exceedance probability 0.5 at the threshold, got %v", rate)
+	}
+}
+
+func TestForecastParamOperands(t *testing.T) {
+	zero := 0.0
+	params, err := ForecastParamOperands{Beta: &zero, UnknownStddev: &zero}.Params(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ForecastParams{Period: 4, Alpha: 0.3, Beta: 0, Gamma: 0.2, UnknownStddev: 0}
+	if params != expected {
+		t.Errorf("expected %+v, got %+v", expected, params)
+	}
+	invalid := 1.5
+	if _, err := (ForecastParamOperands{Alpha: &invalid}).Params(4); err == nil {
+		t.Error("expected error for Alpha out of range")
+	}
+}
+
+func TestForecastConfidenceHoldout(t *testing.T) {
+	inputDir := t.TempDir()
+	matrix := Matrix{GridSize: 32, Observations: []MatrixObservation{{Cell: [2]int{0, 0}, Frame: 0, Value: 1}}}
+	if err := WriteMatrix(inputDir, matrix); err != nil {
+		t.Fatal(err)
+	}
+	for _, operands := range []string{
+		`{"Frequency": 1, "Confidence": 1}`,
+		`{"Frequency": 1, "Confidence": 1.5}`,
+		`{"Frequency": 1, "Confidence": -0.5}`,
+		`{"Frequency": 1, "Backtest": true, "Holdout": 1}`,
+		`{"Frequency": 1, "Backtest": true, "Holdout": -0.25}`,
+	} {
+		args := []OpArgument{
+			{Type: "node", DirName: inputDir},
+			{Type: "string", String: operands},
+		}
+		if err := ForecastOp(args, t.TempDir()); err == nil {
+			t.Errorf("expected Forecast error for operands %s", operands)
+		}
+	}
+	args := []OpArgument{
+		{Type: "node", DirName: inputDir},
+		{Type: "string", String: `{"Frequency": 1, "Confidence": 1}`},
+	}
+	if err := SimulateOp(args, t.TempDir()); err == nil {
+		t.Error("expected Simulate error for confidence 1")
+	}
+}
+
+func TestForecastBacktestMatrix(t *testing.T) {
+	var observations []MatrixObservation
+	for i := 0; i < 20; i++ {
+		observations = append(observations, MatrixObservation{Cell: [2]int{0, 0}, Frame: i, Value: float64(i % 4)})
+	}
+	inputDir := t.TempDir()
+	if err := WriteMatrix(inputDir, Matrix{GridSize: 32, Observations: observations}); err != nil {
+		t.Fatal(err)
+	}
+	outDir := t.TempDir()
+	args := []OpArgument{
+		{Type: "node", DirName: inputDir},
+		{Type: "string", String: `{"Frequency": 1, "Period": 4, "Backtest": true, "Models": ["ewma", "seasonal_naive"]}`},
+	}
+	if err := ForecastOp(args, outDir); err != nil {
+		t.Fatal(err)
+	}
+	bytes, err := ioutil.ReadFile(filepath.Join(outDir, "backtest.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var results []ForecastBacktest
+	if err := json.Unmarshal(bytes, &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].Samples == 0 {
+		t.Errorf("unexpected backtest results %+v", results)
+	}
+	matrix, err := LoadMatrix(outDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matrix.Observations) == 0 {
+		t.Error("expected forecast matrix along with the backtest")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"path/filepath"
 	"sort"
 )
@@ -11,8 +12,12 @@ import (
 /*
 Operator takes three arguments:
 - Sequences
-- Image
+- Image, or a zone table
 - Mode: either "all" or "any"
+- Channel (optional): the channel of the matrix to test (default "value").
+  Zone tables have no channels, every zone is treated as a cell with value 1.
+- Zone (optional): only test the cells of the named zone, for a zone table or
+  a matrix over zones
 Returns:
 - Filtered sequences where either all or any of the detections in the sequence intersect a cell in the image that has value > 0.
 */
@@ -29,20 +34,87 @@ func IntersectOp(args []OpArgument, outDir string) error {
 		return fmt.Errorf("error decoding sequences: %v", err)
 	}
 
-	// Load the input matrix.
+	// Set mode, channel, and zone.
+	mode := args[2].String
+	var channel string
+	if len(args) >= 4 {
+		channel = args[3].String
+	}
+	var zoneName string
+	if len(args) >= 5 {
+		zoneName = args[4].String
+	}
+
+	// Load the input matrix or zones.
 	var matrix Matrix
-	inputPath = filepath.Join(args[1].DirName, "matrix.json")
-	bytes, err = ioutil.ReadFile(inputPath)
-	if err != nil {
-		return fmt.Errorf("error loading matrix from %s: %v", inputPath, err)
+	curInputMatrix := make(map[[2]int]float64)
+	if _, err := os.Stat(filepath.Join(args[1].DirName, "zones.json")); err == nil {
+		zones, err := LoadZones(args[1].DirName)
+		if err != nil {
+			return err
+		}
+		if channel != "" {
+			return fmt.Errorf("zone table has no channel %s", channel)
+		}
+		matrix.Zones = zones
+		for i := range zones {
+			curInputMatrix[[2]int{i, 0}] = 1
+		}
+	} else {
+		matrix, err = LoadMatrix(args[1].DirName)
+		if err != nil {
+			return err
+		}
+		if !matrix.HasChannel(channel) {
+			return fmt.Errorf("input matrix has no channel %s", channel)
+		}
 	}
-	if err := json.Unmarshal(bytes, &matrix); err != nil {
+	tessellation, err := matrix.GetTessellation()
+	if err != nil {
 		return err
 	}
-	gridSize := matrix.GridSize
 
-	// Set mode.
-	mode := args[2].String
+	// Find the cells of the named zone.
+	var zoneCells map[[2]int]bool
+	if zoneName != "" {
+		if matrix.Zones == nil {
+			return fmt.Errorf("zone %s specified, but the input is not a zone table or a matrix over zones", zoneName)
+		}
+		zoneCells = make(map[[2]int]bool)
+		for i, zone := range matrix.Zones {
+			if zone.Name == zoneName {
+				zoneCells[[2]int{i, 0}] = true
+			}
+		}
+		if len(zoneCells) == 0 {
+			return fmt.Errorf("input has no zone %s", zoneName)
+		}
+	}
+
+	// Returns the cells containing the center of a detection.
+	getCells := func(detection Detection) [][2]int {
+		cells := tessellation.CellsContaining(detection.Polygon().Bounds().Center())
+		if zoneCells == nil {
+			return cells
+		}
+		var filtered [][2]int
+		for _, cell := range cells {
+			if zoneCells[cell] {
+				filtered = append(filtered, cell)
+			}
+		}
+		return filtered
+	}
+	// Returns the maximum value in the current matrix over the cells containing a detection.
+	getValue := func(detection Detection) float64 {
+		var val float64
+		for i, cell := range getCells(detection) {
+			if i == 0 || curInputMatrix[cell] > val {
+				val = curInputMatrix[cell]
+			}
+		}
+		return val
+	}
 
 	// Order input sequences by the time of their last detection.
 	getSequenceTime := func(seq *Sequence) int {
@@ -51,18 +123,20 @@ func IntersectOp(args []OpArgument, outDir string) error {
 	sort.Slice(sequences, func(i, j int) bool {
 		return getSequenceTime(sequences[i]) < getSequenceTime(sequences[j])
 	})
-	lastFrame := getSequenceTime(sequences[len(sequences)-1])
+	lastFrame := -1
+	if len(sequences) > 0 {
+		lastFrame = getSequenceTime(sequences[len(sequences)-1])
+	}
 
 	var outputSequences []*Sequence
 	var inputMatrixCounter int = 0
 	var inputSequenceCounter int = 0
-	curInputMatrix := make(map[[2]int]int)
 
-	for frameIdx := 0; frameIdx < lastFrame; frameIdx++ {
+	for frameIdx := 0; frameIdx <= lastFrame; frameIdx++ {
 		// Update input matrix state.
 		for ; inputMatrixCounter < len(matrix.Observations) && matrix.Observations[inputMatrixCounter].Frame <= frameIdx; inputMatrixCounter++ {
 			obs := matrix.Observations[inputMatrixCounter]
-			curInputMatrix[obs.Cell] = obs.Value
+			curInputMatrix[obs.Cell] = obs.Get(channel)
 		}
 
 		// Evaluate new sequences.
@@ -74,8 +148,7 @@ func IntersectOp(args []OpArgument, outDir string) error {
 			if mode == "all" {
 				okay = true
 				for _, item := range seq.Items {
-					cell := ToCell(item.Detection.Polygon().Bounds().Center(), float64(gridSize))
-					if curInputMatrix[cell] <= 0 {
+					if getValue(item.Detection) <= 0 {
 						okay = false
 						break
 					}
@@ -83,8 +156,7 @@ func IntersectOp(args []OpArgument, outDir string) error {
 			} else if mode == "any" {
 				okay = false
 				for _, item := range seq.Items {
-					cell := ToCell(item.Detection.Polygon().Bounds().Center(), float64(gridSize))
-					if curInputMatrix[cell] > 0 {
+					if getValue(item.Detection) > 0 {
 						okay = true
 						break
 					}
@@ -110,5 +182,6 @@ func IntersectOp(args []OpArgument, outDir string) error {
 }
 
 func init() {
-	Ops["Priorities"] = PrioritiesOp
+	Ops["Intersect"] = IntersectOp
+	OpSignatures["Intersect"] = OpSignature{MinArgs: 3, MaxArgs: 5}
 }
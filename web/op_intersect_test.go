@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Runs Intersect on the sequences with a zone table containing one zone
+// covering [0, 100] x [0, 100], and returns the IDs of the output sequences.
+func runIntersectTest(t *testing.T, sequences []*Sequence) []int {
+	dir := t.TempDir()
+	seqDir := filepath.Join(dir, "sequences")
+	zonesDir := filepath.Join(dir, "zones")
+	outDir := filepath.Join(dir, "out")
+	for _, d := range []string{seqDir, zonesDir, outDir} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	zones := []Zone{{
+		Name: "a",
+		Polygons: [][][][2]float64{{{{0, 0}, {100, 0}, {100, 100}, {0, 100}}}},
+	}}
+	if err := ioutil.WriteFile(filepath.Join(seqDir, "sequences.json"), JsonMarshal(sequences), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(zonesDir, "zones.json"), JsonMarshal(zones), 0644); err != nil {
+		t.Fatal(err)
+	}
+	args := []OpArgument{
+		{Type: "node", DirName: seqDir},
+		{Type: "node", DirName: zonesDir},
+		{Type: "string", String: "any"},
+	}
+	if err := IntersectOp(args, outDir); err != nil {
+		t.Fatal(err)
+	}
+	bytes, err := ioutil.ReadFile(filepath.Join(outDir, "sequences.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var outputs []*Sequence
+	if err := json.Unmarshal(bytes, &outputs); err != nil {
+		t.Fatal(err)
+	}
+	var ids []int
+	for _, seq := range outputs {
+		ids = append(ids, seq.ID)
+	}
+	return ids
+}
+
+func TestIntersectLastFrame(t *testing.T) {
+	sequences := []*Sequence{
+		makeMergeTestSequence(1, 0, [2]int{50, 50}),
+		// Ends at the last frame of the input.
+		makeMergeTestSequence(2, 4, [2]int{50, 50}),
+	}
+	if ids := runIntersectTest(t, sequences); len(ids) != 2 {
+		t.Errorf("expected both sequences, got %v", ids)
+	}
+}
+
+func TestIntersectEmpty(t *testing.T) {
+	if ids := runIntersectTest(t, nil); len(ids) != 0 {
+		t.Errorf("expected no sequences, got %v", ids)
+	}
+}
+
+func TestIntersectRegistered(t *testing.T) {
+	if Ops["Intersect"] == nil {
+		t.Error("expected Intersect operation to be registered")
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+Element-wise operators over matrices:
+- Add, Subtract, Multiply, Divide, Min, Max: two input matrices. Dividing
+  by zero yields 0, as does "/" in Combine expressions (see Expr).
+- Scale: input matrix and a constant factor, e.g. Scale(m; "0.5").
+- Threshold: input matrix and a predicate, e.g. Threshold(m; "> 5"), which
+  yields a 0/1 mask.
+- Combine: any number of input matrices followed by an expression where the
+  inputs are named a, b, c, ..., e.g. Combine(m1; m2; "max(a - b, 0)"). Other
+  channels of the inputs can be referenced like "a.stddev".
+
+Observations of the inputs are aligned by cell and time: we replay the input
+observations in frame order, carrying the latest value at each cell forward,
+and whenever some input gets a new observation at a cell, we emit an output
+observation at that cell. Cells are skipped until every input has an
+observation there.
+*/
+
+// Combines matrices element-wise. f is called with the current observation of
+// each input matrix at a cell and returns the output value.
+func CombineMatrices(inputs []Matrix, f func(cur []MatrixObservation) (float64, error)) (Matrix, error) {
+	for _, matrix := range inputs[1:] {
+		if !matrix.SameCells(inputs[0]) {
+			return Matrix{}, fmt.Errorf("input matrices have different tessellations")
+		}
+	}
+
+	// Order observations from all inputs by frame.
+	type inputObservation struct {
+		input int
+		obs MatrixObservation
+	}
+	var events []inputObservation
+	for i, matrix := range inputs {
+		for _, obs := range matrix.Observations {
+			events = append(events, inputObservation{i, obs})
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].obs.Frame < events[j].obs.Frame
+	})
+
+	matrixObservations := []MatrixObservation{}
+	curObservations := make(map[[2]int][]*MatrixObservation)
+	for i := 0; i < len(events); {
+		// Update the current observations with all input observations at this frame.
+		frameIdx := events[i].obs.Frame
+		updatedCells := make(map[[2]int]bool)
+		for ; i < len(events) && events[i].obs.Frame == frameIdx; i++ {
+			event := events[i]
+			cell := event.obs.Cell
+			if curObservations[cell] == nil {
+				curObservations[cell] = make([]*MatrixObservation, len(inputs))
+			}
+			obs := event.obs
+			curObservations[cell][event.input] = &obs
+			updatedCells[cell] = true
+		}
+
+		var cells [][2]int
+		for cell := range updatedCells {
+			cells = append(cells, cell)
+		}
+		sort.Slice(cells, func(i, j int) bool {
+			return cells[i][0] < cells[j][0] || (cells[i][0] == cells[j][0] && cells[i][1] < cells[j][1])
+		})
+		for _, cell := range cells {
+			var cur []MatrixObservation
+			for _, obs := range curObservations[cell] {
+				if obs == nil {
+					break
+				}
+				cur = append(cur, *obs)
+			}
+			if len(cur) < len(inputs) {
+				continue
+			}
+			val, err := f(cur)
+			if err != nil {
+				return Matrix{}, fmt.Errorf("error at cell %v frame %d: %v", cell, frameIdx, err)
+			}
+			matrixObservations = append(matrixObservations, MatrixObservation{
+				Cell: cell,
+				Frame: frameIdx,
+				Value: val,
+			})
+		}
+	}
+
+	return Matrix{
+		GridSize: inputs[0].GridSize,
+		Zones: inputs[0].Zones,
+		Tessellation: inputs[0].Tessellation,
+		Observations: matrixObservations,
+	}, nil
+}
+
+// Loads the matrices from node arguments.
+func loadMatrixArgs(args []OpArgument) ([]Matrix, error) {
+	var matrices []Matrix
+	for _, arg := range args {
+		if arg.Type != "node" {
+			return nil, fmt.Errorf("expected matrix argument but got string %s", arg.String)
+		}
+		matrix, err := LoadMatrix(arg.DirName)
+		if err != nil {
+			return nil, err
+		}
+		matrices = append(matrices, matrix)
+	}
+	return matrices, nil
+}
+
+var MatrixBinaryFuncs = map[string]func(a float64, b float64) float64{
+	"Add": func(a float64, b float64) float64 {
+		return a + b
+	},
+	"Subtract": func(a float64, b float64) float64 {
+		return a - b
+	},
+	"Multiply": func(a float64, b float64) float64 {
+		return a * b
+	},
+	"Divide": func(a float64, b float64) float64 {
+		if b == 0 {
+			return 0
+		}
+		return a / b
+	},
+	"Min": math.Min,
+	"Max": math.Max,
+}
+
+func makeMatrixBinaryOp(f func(a float64, b float64) float64) func(args []OpArgument, outDir string) error {
+	return func(args []OpArgument, outDir string) error {
+		if len(args) != 2 {
+			return fmt.Errorf("expected two matrix arguments")
+		}
+		inputs, err := loadMatrixArgs(args)
+		if err != nil {
+			return err
+		}
+		matrix, err := CombineMatrices(inputs, func(cur []MatrixObservation) (float64, error) {
+			return f(cur[0].Value, cur[1].Value), nil
+		})
+		if err != nil {
+			return err
+		}
+		return WriteMatrix(outDir, matrix)
+	}
+}
+
+func ScaleOp(args []OpArgument, outDir string) error {
+	if args[1].Type != "string" {
+		return fmt.Errorf("expected scale factor but got a node")
+	}
+	factor, err := strconv.ParseFloat(strings.TrimSpace(args[1].String), 64)
+	if err == nil && (math.IsInf(factor, 0) || math.IsNaN(factor)) {
+		err = fmt.Errorf("factor is not finite")
+	}
+	if err != nil {
+		return fmt.Errorf("error parsing scale factor %s: %v", args[1].String, err)
+	}
+	inputs, err := loadMatrixArgs(args[0:1])
+	if err != nil {
+		return err
+	}
+	matrix, err := CombineMatrices(inputs, func(cur []MatrixObservation) (float64, error) {
+		return cur[0].Value * factor, nil
+	})
+	if err != nil {
+		return err
+	}
+	return WriteMatrix(outDir, matrix)
+}
+
+func ThresholdOp(args []OpArgument, outDir string) error {
+	if args[1].Type != "string" {
+		return fmt.Errorf("expected threshold predicate but got a node")
+	}
+	// Parse the predicate, like "> 5", into an expression over the value.
+	predicate, err := ParseExpr("value " + args[1].String)
+	if err != nil {
+		return fmt.Errorf("error parsing threshold predicate %s: %v", args[1].String, err)
+	}
+	inputs, err := loadMatrixArgs(args[0:1])
+	if err != nil {
+		return err
+	}
+	matrix, err := CombineMatrices(inputs, func(cur []MatrixObservation) (float64, error) {
+		return predicate.Eval(func(name string) (float64, error) {
+			if name != "value" {
+				return 0, fmt.Errorf("unknown variable %s", name)
+			}
+			return cur[0].Value, nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return WriteMatrix(outDir, matrix)
+}
+
+func CombineOp(args []OpArgument, outDir string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("expected matrix arguments followed by an expression")
+	}
+	if args[len(args)-1].Type != "string" {
+		return fmt.Errorf("expected matrix arguments followed by an expression")
+	}
+	expr, err := ParseExpr(args[len(args)-1].String)
+	if err != nil {
+		return err
+	}
+	inputs, err := loadMatrixArgs(args[0:len(args)-1])
+	if err != nil {
+		return err
+	}
+	if len(inputs) > 26 {
+		return fmt.Errorf("expected at most 26 matrix arguments followed by an expression")
+	}
+
+	// Resolve variables like "a" or "b.stddev" to an input index and channel.
+	resolve := func(name string) (int, string, error) {
+		parts := strings.SplitN(name, ".", 2)
+		if len(parts[0]) != 1 || parts[0][0] < 'a' || int(parts[0][0] - 'a') >= len(inputs) {
+			return 0, "", fmt.Errorf("unknown variable %s", name)
+		}
+		channel := ValueChannel
+		if len(parts) == 2 {
+			channel = parts[1]
+		}
+		return int(parts[0][0] - 'a'), channel, nil
+	}
+	for _, name := range expr.Vars() {
+		input, channel, err := resolve(name)
+		if err != nil {
+			return err
+		}
+		if !inputs[input].HasChannel(channel) {
+			return fmt.Errorf("input matrix %s has no channel %s", name[0:1], channel)
+		}
+	}
+
+	matrix, err := CombineMatrices(inputs, func(cur []MatrixObservation) (float64, error) {
+		return expr.Eval(func(name string) (float64, error) {
+			input, channel, err := resolve(name)
+			if err != nil {
+				return 0, err
+			}
+			return cur[input].Get(channel), nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return WriteMatrix(outDir, matrix)
+}
+
+func init() {
+	for name, f := range MatrixBinaryFuncs {
+		Ops[name] = makeMatrixBinaryOp(f)
+		OpSignatures[name] = OpSignature{MinArgs: 2, MaxArgs: 2}
+	}
+	Ops["Scale"] = ScaleOp
+	OpSignatures["Scale"] = OpSignature{MinArgs: 2, MaxArgs: 2}
+	Ops["Threshold"] = ThresholdOp
+	OpSignatures["Threshold"] = OpSignature{MinArgs: 2, MaxArgs: 2}
+	Ops["Combine"] = CombineOp
+	OpSignatures["Combine"] = OpSignature{MinArgs: 2}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Writes each matrix to an input directory and returns the node arguments
+// followed by the string arguments.
+func makeMatrixArgs(t *testing.T, matrices []Matrix, strs ...string) ([]OpArgument, string) {
+	dir := t.TempDir()
+	var args []OpArgument
+	for i, matrix := range matrices {
+		inputDir := filepath.Join(dir, string(rune('a' + i)))
+		if err := os.Mkdir(inputDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := WriteMatrix(inputDir, matrix); err != nil {
+			t.Fatal(err)
+		}
+		args = append(args, OpArgument{Type: "node", DirName: inputDir})
+	}
+	for _, s := range strs {
+		args = append(args, OpArgument{Type: "string", String: s})
+	}
+	outDir := filepath.Join(dir, "out")
+	if err := os.Mkdir(outDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return args, outDir
+}
+
+func TestCombineMatricesAlignment(t *testing.T) {
+	a := Matrix{GridSize: 32, Observations: []MatrixObservation{
+		{Cell: [2]int{0, 0}, Frame: 0, Value: 1},
+		{Cell: [2]int{0, 0}, Frame: 10, Value: 3},
+		{Cell: [2]int{1, 0}, Frame: 0, Value: 5},
+	}}
+	b := Matrix{GridSize: 32, Observations: []MatrixObservation{
+		{Cell: [2]int{0, 0}, Frame: 5, Value: 10},
+	}}
+	matrix, err := CombineMatrices([]Matrix{a, b}, func(cur []MatrixObservation) (float64, error) {
+		return cur[0].Value + cur[1].Value, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Cell (1, 0) never has an observation in b, and cell (0, 0) only has
+	// outputs once b has an observation there.
+	expected := []MatrixObservation{
+		{Cell: [2]int{0, 0}, Frame: 5, Value: 11},
+		{Cell: [2]int{0, 0}, Frame: 10, Value: 13},
+	}
+	if len(matrix.Observations) != len(expected) {
+		t.Fatalf("expected %d observations, got %+v", len(expected), matrix.Observations)
+	}
+	for i, obs := range matrix.Observations {
+		if obs.Cell != expected[i].Cell || obs.Frame != expected[i].Frame || obs.Value != expected[i].Value {
+			t.Errorf("observation %d: expected %+v, got %+v", i, expected[i], obs)
+		}
+	}
+
+	if _, err := CombineMatrices([]Matrix{a, {GridSize: 64}}, nil); err == nil {
+		t.Error("expected error for different grid sizes")
+	}
+}
+
+func TestCombineOpChannels(t *testing.T) {
+	a := Matrix{GridSize: 32, Observations: []MatrixObservation{
+		{Cell: [2]int{0, 0}, Frame: 0, Value: 4, Channels: map[string]float64{"stddev": 1}},
+	}}
+	b := Matrix{GridSize: 32, Observations: []MatrixObservation{
+		{Cell: [2]int{0, 0}, Frame: 0, Value: 2},
+	}}
+	args, outDir := makeMatrixArgs(t, []Matrix{a, b}, "(a + a.stddev) / b")
+	if err := CombineOp(args, outDir); err != nil {
+		t.Fatal(err)
+	}
+	matrix, err := LoadMatrix(outDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matrix.Observations) != 1 || matrix.Observations[0].Value != 2.5 {
+		t.Errorf("expected one observation with value 2.5, got %+v", matrix.Observations)
+	}
+
+	for _, expr := range []string{"b.stddev", "c + 1", "a +"} {
+		args, outDir := makeMatrixArgs(t, []Matrix{a, b}, expr)
+		if err := CombineOp(args, outDir); err == nil {
+			t.Errorf("expected error for expression %q", expr)
+		}
+	}
+}
+
+func TestScaleThresholdArguments(t *testing.T) {
+	m := Matrix{GridSize: 32, Observations: []MatrixObservation{
+		{Cell: [2]int{0, 0}, Frame: 0, Value: 4},
+	}}
+	for _, op := range []func([]OpArgument, string) error{ScaleOp, ThresholdOp} {
+		args, outDir := makeMatrixArgs(t, []Matrix{m, m})
+		if err := op(args, outDir); err == nil {
+			t.Error("expected error for a node in place of the string argument")
+		}
+	}
+	for _, factor := range []string{"inf", "NaN", "x"} {
+		args, outDir := makeMatrixArgs(t, []Matrix{m}, factor)
+		if err := ScaleOp(args, outDir); err == nil {
+			t.Errorf("expected error for scale factor %s", factor)
+		}
+	}
+	args, outDir := makeMatrixArgs(t, []Matrix{m}, "> 3")
+	if err := ThresholdOp(args, outDir); err != nil {
+		t.Fatal(err)
+	}
+	matrix, err := LoadMatrix(outDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matrix.Observations) != 1 || matrix.Observations[0].Value != 1 {
+		t.Errorf("expected a mask value of 1, got %+v", matrix.Observations)
+	}
+}
@@ -1,36 +1,128 @@
 package main
 
 import (
+	"github.com/mitroadmaps/gomapinfer/common"
+
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
-	"os/exec"
 	"path/filepath"
-	"strconv"
-	"strings"
+	"regexp"
+	"sort"
 )
 
-// Minimum number of consecutive frames where sequence end is visible in the field of view
+// Default number of consecutive frames where sequence end is visible in the field of view
 // to qualify for a gap (sequence termination).
-const SeqMergeGapThreshold int = 10
-
-// Minimum distance from edge of frame for counting gaps.
-const SeqMergeGapPadding float64 = 50
+const DefaultMergeGapThreshold int = 10
+
+// Default minimum distance from edge of frame for counting gaps.
+const DefaultMergeGapPadding float64 = 50
+
+type MergeParams struct {
+	// One of:
+	// - "spatial" (or empty): merge based on distance between the end of the
+	//   previous sequence and the start of the next sequence. Unknown modes
+	//   also merge spatially, with a warning.
+	// - "image_similarity": like spatial, but also require the detections to
+	//   look similar.
+	// - "velocity": for moving objects, compare the start of the next sequence
+	//   to where the previous sequence would have been if it continued at the
+	//   same velocity.
+	Mode string
+
+	// Maximum distance of next seq start poly from previous seq end poly.
+	// 40 for parked cars
+	// 150 for hazards
+	DistanceThreshold float64
+
+	// Minimum number of consecutive frames where sequence end is visible in the field of view
+	// to qualify for a gap (sequence termination).
+	GapThreshold int
+
+	// Minimum distance from edge of frame for counting gaps.
+	GapPadding float64
+
+	// Compare the detection this many items after the start of the next
+	// sequence with the detection this many items before the end of the
+	// previous sequence. Detections close to the ends of a sequence tend to be
+	// noisy. The default of 3 works well for parked cars.
+	BeginOffset int
+	EndOffset int
+
+	// In image_similarity mode, minimum SSIM between the detections for
+	// merging (see GetImageSimilarity).
+	SimilarityThreshold float64
+
+	// In velocity mode, number of items at the end of the previous sequence
+	// used to estimate its velocity.
+	VelocityWindow int
+
+	// If positive, maximum number of frames between the end of the previous
+	// sequence and the start of the next sequence.
+	MaxGapFrames int
+}
 
-func MergeOp(args []OpArgument, outDir string) error {
-	var operands struct {
-		Mode string
+func DefaultMergeParams() MergeParams {
+	return MergeParams{
+		Mode: "spatial",
+		GapThreshold: DefaultMergeGapThreshold,
+		GapPadding: DefaultMergeGapPadding,
+		BeginOffset: 3,
+		EndOffset: 3,
+		SimilarityThreshold: 0.15,
+		VelocityWindow: 5,
+	}
+}
 
-		// Maximum distance of next seq start poly from previous seq end poly.
-		// 40 for parked cars
-		// 150 for hazards
-		DistanceThreshold float64
+// Returns an error if the parameters are invalid.
+func (params MergeParams) Validate() error {
+	if params.BeginOffset < 0 {
+		return fmt.Errorf("BeginOffset must be at least 0, got %d", params.BeginOffset)
 	}
+	if params.EndOffset < 0 {
+		return fmt.Errorf("EndOffset must be at least 0, got %d", params.EndOffset)
+	}
+	if params.VelocityWindow < 0 {
+		return fmt.Errorf("VelocityWindow must be at least 0, got %d", params.VelocityWindow)
+	}
+	return nil
+}
+
+// A previous sequence that was considered when merging a parent sequence, for
+// auditing merge decisions. We record candidates within twice the distance
+// threshold so that near misses are included.
+type MergeCandidate struct {
+	// ID of the input sequence being merged.
+	Parent int
+	// ID of the output sequence that the parent could have been merged into.
+	Candidate int
+	// ID of the output sequence that the parent ended up in.
+	Output int
+	// Frame of the parent detection used for the comparison.
+	Frame int
+	Distance float64
+	Similarity *float64 `json:",omitempty"`
+	Accepted bool
+	// Why the candidate was rejected: "distance", "similarity",
+	// "similarity_error" if the images could not be compared, or
+	// "closer_candidate".
+	Reason string `json:",omitempty"`
+}
+
+// Returns image similarity between a detection at one frame and a detection at another frame.
+type MergeSimilarityFunc func(frameIdx1 int, detection1 Detection, frameIdx2 int, detection2 Detection) (float64, error)
+
+func MergeOp(args []OpArgument, outDir string) error {
+	// Operands not specified by the user retain their default values.
+	operands := DefaultMergeParams()
 	err := json.Unmarshal([]byte(args[1].String), &operands)
 	if err != nil {
 		return fmt.Errorf("error decoding operands %s: %v", args[1].String, err)
 	}
+	if err := operands.Validate(); err != nil {
+		return fmt.Errorf("invalid operands %s: %v", args[1].String, err)
+	}
 
 	// Load the input sequences.
 	var sequences []*Sequence
@@ -53,7 +145,59 @@ func MergeOp(args []OpArgument, outDir string) error {
 		return fmt.Errorf("error decoding frame bounds: %v", err)
 	}
 
-	cachedImageSimilarities := make(map[[2]int]float64)
+	var similarityFunc MergeSimilarityFunc
+	if operands.Mode == "image_similarity" {
+		frameCache, err := NewFrameCache(Config.VideoDir, Config.FrameCacheSize)
+		if err != nil {
+			return err
+		}
+		similarityFunc = func(frameIdx1 int, detection1 Detection, frameIdx2 int, detection2 Detection) (float64, error) {
+			return GetImageSimilarity(frameCache, frameIdx1, detection1, frameIdx2, detection2)
+		}
+	}
+
+	outputs, candidates, err := MergeSequences(sequences, frames, operands, similarityFunc)
+	if err != nil {
+		return err
+	}
+
+	bytes, err = json.Marshal(outputs)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(outDir, "sequences.json"), bytes, 0644); err != nil {
+		return err
+	}
+	bytes, err = json.Marshal(candidates)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(outDir, "merge-candidates.json"), bytes, 0644); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Merges sequences that likely correspond to the same object, e.g. because the
+// object was occluded or went out of the field of view for some time.
+// similarityFunc is only needed in image_similarity mode.
+// Along with the merged sequences, returns the candidates considered for each merge.
+func MergeSequences(sequences []*Sequence, frames []Frame, params MergeParams, similarityFunc MergeSimilarityFunc) ([]*Sequence, []MergeCandidate, error) {
+	if err := params.Validate(); err != nil {
+		return nil, nil, err
+	}
+	if params.Mode != "spatial" && params.Mode != "image_similarity" && params.Mode != "velocity" {
+		// As before modes were configurable, anything else merges spatially.
+		if params.Mode != "" {
+			log.Printf("[merge] warning: unknown mode %s, using spatial mode", params.Mode)
+		}
+		params.Mode = "spatial"
+	}
+	if params.Mode == "image_similarity" && similarityFunc == nil {
+		return nil, nil, fmt.Errorf("image_similarity mode requires a similarity function")
+	}
+
+	cachedImageSimilarities := make(map[[2]int]*float64)
 
 	// map from parent sequence ID -> our merged sequence
 	parentSeqMap := make(map[int]*Sequence)
@@ -61,12 +205,13 @@ func MergeOp(args []OpArgument, outDir string) error {
 	// Number of frames that the last point of a sequence was contained in the field of view.
 	// Resets to 0 if goes out of the view.
 	// We use this as follows: If an active sequence was visible in the field of view for at
-	// least SeqMergeGapThreshold frames, but wasn't seen in the input sequence table, then
+	// least GapThreshold frames, but wasn't seen in the input sequence table, then
 	// we terminate the sequence (mark inactive).
 	seqVisibleFrames := make(map[int]int)
 
 	activeSequences := make(map[int]*Sequence)
 	outputs := []*Sequence{}
+	candidates := []MergeCandidate{}
 
 	// return sequences that end before the specified frame
 	// these are candidates for termination
@@ -103,7 +248,7 @@ func MergeOp(args []OpArgument, outDir string) error {
 		for _, seq := range activeSequences {
 			detection := seq.Items[len(seq.Items)-1].Detection
 			d := getDetectionDistanceToFrame(frame, detection)
-			if d == -1 || d < SeqMergeGapPadding {
+			if d == -1 || d < params.GapPadding {
 				continue
 			}
 			matchSeqs[seq.ID] = seq
@@ -123,7 +268,7 @@ func MergeOp(args []OpArgument, outDir string) error {
 			if matchSeqs[seq.ID] != nil {
 				seqVisibleFrames[seq.ID]++
 			} else {
-				if seqVisibleFrames[seq.ID] >= SeqMergeGapThreshold {
+				if seqVisibleFrames[seq.ID] >= params.GapThreshold {
 					gapSeqs = append(gapSeqs, seq)
 				}
 				delete(seqVisibleFrames, seq.ID)
@@ -133,7 +278,7 @@ func MergeOp(args []OpArgument, outDir string) error {
 		return gapSeqs
 	}
 
-	// return first or last detection at least SeqMergeGapPadding away from frame
+	// return first or last detection at least GapPadding away from frame
 	findPaddedDetection := func(seq *Sequence, first bool) SequenceItem {
 		items := seq.Items
 		if !first {
@@ -146,7 +291,7 @@ func MergeOp(args []OpArgument, outDir string) error {
 		for _, item := range items {
 			frame := frames[item.Frame]
 			d := getDetectionDistanceToFrame(frame, item.Detection)
-			if d >= SeqMergeGapPadding {
+			if d >= params.GapPadding {
 				return item
 			}
 		}
@@ -166,52 +311,85 @@ func MergeOp(args []OpArgument, outDir string) error {
 				continue
 			}
 			parentBegins := parentSeq.Items[0]
-			if len(parentSeq.Items) >= 4 {
-				parentBegins = parentSeq.Items[3]
+			if len(parentSeq.Items) > params.BeginOffset {
+				parentBegins = parentSeq.Items[params.BeginOffset]
 			}
 			parentPoint := parentBegins.Detection.Polygon().Bounds().Center()
 
 			var bestMergeSequence *Sequence
 			var bestDistance float64
+			var bestSimilarity *float64
+			var parentCandidates []MergeCandidate
 
 			for _, mySeq := range activeSequences {
-				myEnds := mySeq.Items[len(mySeq.Items)-1]
-
-				// only for parked cars!
-				if len(mySeq.Items) >= 4 {
-					myEnds = mySeq.Items[len(mySeq.Items)-4]
+				myEndIdx := len(mySeq.Items)-1
+				if len(mySeq.Items) > params.EndOffset {
+					myEndIdx -= params.EndOffset
+				}
+				myEnds := mySeq.Items[myEndIdx]
+				if parentBegins.Frame < myEnds.Frame {
+					continue
+				} else if params.MaxGapFrames > 0 && parentBegins.Frame - myEnds.Frame > params.MaxGapFrames {
+					continue
 				}
 
 				myPoint := myEnds.Detection.Polygon().Bounds().Center()
+				if params.Mode == "velocity" {
+					myPoint = extrapolateSequence(mySeq, myEndIdx, params.VelocityWindow, parentBegins.Frame)
+				}
 				d := parentPoint.Distance(myPoint)
-				if d > operands.DistanceThreshold {
+				if d > 2*params.DistanceThreshold {
 					continue
-				} else if parentBegins.Frame < myEnds.Frame {
+				}
+				candidate := MergeCandidate{
+					Parent: parentSeq.ID,
+					Candidate: mySeq.ID,
+					Frame: parentBegins.Frame,
+					Distance: d,
+				}
+				if d > params.DistanceThreshold {
+					candidate.Reason = "distance"
+					parentCandidates = append(parentCandidates, candidate)
 					continue
 				}
 
-				if operands.Mode == "image_similarity" {
-					// use external python script to verify that image similarity is close
-					// first get last/first detections that are SeqMergeGapPadding away from their frames
-					var similarity float64
+				if params.Mode == "image_similarity" {
+					// verify that image similarity is close
+					// first get last/first detections that are GapPadding away from their frames
+					// Pairs that cannot be compared, e.g. because a detection is
+					// outside its frame, are treated as not similar, and cached
+					// with a nil similarity.
 					k := [2]int{parentSeq.ID, mySeq.ID}
-					if _, ok := cachedImageSimilarities[k]; ok {
-						similarity = cachedImageSimilarities[k]
-					} else {
+					similarity, ok := cachedImageSimilarities[k]
+					if !ok {
 						item1 := findPaddedDetection(parentSeq, true)
 						item2 := findPaddedDetection(mySeq, false)
-						similarity = getImageSimilarity(item1.Frame, item1.Detection, item2.Frame, item2.Detection)
+						s, err := similarityFunc(item1.Frame, item1.Detection, item2.Frame, item2.Detection)
+						if err != nil {
+							log.Printf("[merge] warning: cannot compare sequences %d and %d, treating them as not similar: %v", parentSeq.ID, mySeq.ID, err)
+						} else {
+							similarity = &s
+							log.Printf("[merge] %d/%d %v %v\n", frameIdx, len(frames), k, s)
+						}
 						cachedImageSimilarities[k] = similarity
-						log.Printf("[merge] %d/%d %v %v\n", frameIdx, len(frames), k, similarity)
 					}
-					if similarity < 0.15 {
+					candidate.Similarity = similarity
+					if similarity == nil {
+						candidate.Reason = "similarity_error"
+						parentCandidates = append(parentCandidates, candidate)
+						continue
+					} else if *similarity < params.SimilarityThreshold {
+						candidate.Reason = "similarity"
+						parentCandidates = append(parentCandidates, candidate)
 						continue
 					}
 				}
+				parentCandidates = append(parentCandidates, candidate)
 
 				if bestMergeSequence == nil || d < bestDistance {
 					bestMergeSequence = mySeq
 					bestDistance = d
+					bestSimilarity = candidate.Similarity
 				}
 			}
 
@@ -219,10 +397,34 @@ func MergeOp(args []OpArgument, outDir string) error {
 				for _, item := range parentSeq.Items {
 					bestMergeSequence.Items = append(bestMergeSequence.Items, item)
 				}
-				//bestMergeSequence.AddMetadata(fmt.Sprintf("%d", parentSeq.ID), frame.Time)
+				bestMergeSequence.Parents = append(bestMergeSequence.Parents, parentSeq.ID)
+				bestMergeSequence.Merges = append(bestMergeSequence.Merges, MergeDecision{
+					Parent: parentSeq.ID,
+					Frame: parentBegins.Frame,
+					Distance: bestDistance,
+					Similarity: bestSimilarity,
+				})
 				parentSeqMap[parentSeq.ID] = bestMergeSequence
 				delete(seqVisibleFrames, bestMergeSequence.ID)
 			}
+
+			// Record the candidates that we considered.
+			// If the parent was not merged, it becomes a new output sequence with the same ID.
+			outputID := parentSeq.ID
+			if bestMergeSequence != nil {
+				outputID = bestMergeSequence.ID
+			}
+			for _, candidate := range parentCandidates {
+				candidate.Output = outputID
+				if candidate.Reason == "" {
+					if candidate.Candidate == outputID {
+						candidate.Accepted = true
+					} else {
+						candidate.Reason = "closer_candidate"
+					}
+				}
+				candidates = append(candidates, candidate)
+			}
 		}
 
 		// Create new sequences for parent sequences that were not merged.
@@ -234,8 +436,8 @@ func MergeOp(args []OpArgument, outDir string) error {
 			mySeq := &Sequence{
 				ID: parentSeq.ID,
 				Items: append([]SequenceItem{}, parentSeq.Items...),
+				Parents: []int{parentSeq.ID},
 			}
-			//mySeq.AddMetadata(fmt.Sprintf("%d", parentSeq.ID), parentSeq.Time)
 			parentSeqMap[parentSeq.ID] = mySeq
 			activeSequences[mySeq.ID] = mySeq
 			outputs = append(outputs, mySeq)
@@ -249,41 +451,113 @@ func MergeOp(args []OpArgument, outDir string) error {
 		}
 	}
 
-	bytes, err = json.Marshal(outputs)
-	if err != nil {
-		return err
-	}
-	if err := ioutil.WriteFile(filepath.Join(outDir, "sequences.json"), bytes, 0644); err != nil {
-		return err
+	sortMergeCandidates(candidates)
+	return outputs, candidates, nil
+}
+
+// Sorts candidates by frame, parent, and candidate sequence, so that the
+// order does not depend on map iteration.
+func sortMergeCandidates(candidates []MergeCandidate) {
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.Frame != b.Frame {
+			return a.Frame < b.Frame
+		} else if a.Parent != b.Parent {
+			return a.Parent < b.Parent
+		}
+		return a.Candidate < b.Candidate
+	})
+}
+
+type MergeAudit struct {
+	ID int
+	Parents []int
+	Merges []MergeDecision
+	// Candidates considered for merging into this sequence, or for merging
+	// parents that ended up in this sequence.
+	Candidates []MergeCandidate
+}
+
+var mergeHashRegexp = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// Returns the path of the output directory of the Merge node with the given
+// hash (see Graph.GetHashStrings), which lets merges be audited after the
+// query that ran them, e.g. after a restart.
+func GetMergeDir(hash string) (string, error) {
+	if !mergeHashRegexp.MatchString(hash) {
+		return "", fmt.Errorf("invalid node hash %s", hash)
 	}
-	return nil
+	return filepath.Join(Config.DataDir, "Merge." + hash), nil
 }
 
-func getImageSimilarity(frameIdx1 int, detection1 Detection, frameIdx2 int, detection2 Detection) float64 {
-	poly1 := PointsToPolyString(detection1.OrigPoints)
-	poly2 := PointsToPolyString(detection2.OrigPoints)
-	cmd := exec.Command(Config.Python, "web/seq-merge-imagediff.py", Config.VideoDir, strconv.Itoa(frameIdx1), strconv.Itoa(frameIdx2), poly1, poly2)
-	bytes, err := cmd.CombinedOutput()
+// Returns the merge decisions and candidates for an output sequence of a
+// Merge node whose outputs are stored in the given directory, with the
+// candidates ordered by frame.
+func GetMergeAudit(dir string, id int) (MergeAudit, error) {
+	var sequences []*Sequence
+	bytes, err := ioutil.ReadFile(filepath.Join(dir, "sequences.json"))
 	if err != nil {
-		fmt.Println(string(bytes))
-		fmt.Println("warning!! image similarity error")
-		//panic(err)
-		return 0
-	}
-	output := strings.TrimSpace(string(bytes))
-	lines := strings.Split(output, "\n")
-	lastLine := lines[len(lines)-1]
-	if strings.Contains(lastLine, "bad") {
-		return 0
-	}
-	similarity, err := strconv.ParseFloat(lastLine, 64)
+		return MergeAudit{}, fmt.Errorf("error loading sequences: %v", err)
+	}
+	if err := json.Unmarshal(bytes, &sequences); err != nil {
+		return MergeAudit{}, fmt.Errorf("error decoding sequences: %v", err)
+	}
+	var candidates []MergeCandidate
+	bytes, err = ioutil.ReadFile(filepath.Join(dir, "merge-candidates.json"))
 	if err != nil {
-		fmt.Println(output)
-		panic(err)
+		return MergeAudit{}, fmt.Errorf("error loading merge candidates (is this a Merge node?): %v", err)
+	}
+	if err := json.Unmarshal(bytes, &candidates); err != nil {
+		return MergeAudit{}, fmt.Errorf("error decoding merge candidates: %v", err)
+	}
+
+	audit := MergeAudit{
+		ID: id,
+		Candidates: []MergeCandidate{},
+	}
+	found := false
+	for _, seq := range sequences {
+		if seq.ID != id {
+			continue
+		}
+		audit.Parents = seq.Parents
+		audit.Merges = seq.Merges
+		found = true
+		break
+	}
+	if !found {
+		return MergeAudit{}, fmt.Errorf("no output sequence with ID %d", id)
+	}
+	for _, candidate := range candidates {
+		if candidate.Candidate != id && candidate.Output != id {
+			continue
+		}
+		audit.Candidates = append(audit.Candidates, candidate)
+	}
+	sortMergeCandidates(audit.Candidates)
+	return audit, nil
+}
+
+// Returns the location that the sequence would be at on the specified frame,
+// if it continued from the item at endIdx with its velocity over the window
+// of items ending at endIdx.
+func extrapolateSequence(seq *Sequence, endIdx int, window int, frameIdx int) common.Point {
+	end := seq.Items[endIdx]
+	endPoint := end.Detection.Polygon().Bounds().Center()
+	startIdx := endIdx - window
+	if startIdx < 0 {
+		startIdx = 0
+	}
+	start := seq.Items[startIdx]
+	if end.Frame <= start.Frame {
+		return endPoint
 	}
-	return similarity
+	startPoint := start.Detection.Polygon().Bounds().Center()
+	velocity := endPoint.Sub(startPoint).Scale(1 / float64(end.Frame - start.Frame))
+	return endPoint.Add(velocity.Scale(float64(frameIdx - end.Frame)))
 }
 
 func init() {
 	Ops["Merge"] = MergeOp
+	OpSignatures["Merge"] = OpSignature{MinArgs: 2, MaxArgs: 2, JSONOperands: true}
 }
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Returns numFrames frame bounds that all cover [0, 1000] x [0, 1000].
+func makeMergeTestFrames(numFrames int) []Frame {
+	frames := make([]Frame, numFrames)
+	for i := range frames {
+		frames[i] = Frame{{0, 0}, {1000, 0}, {1000, 1000}, {0, 1000}}
+	}
+	return frames
+}
+
+// Returns a 10x10 detection centered at (x, y).
+func makeMergeTestDetection(x int, y int) Detection {
+	return Detection{Points: [][2]int{{x-5, y-5}, {x+5, y-5}, {x+5, y+5}, {x-5, y+5}}}
+}
+
+// Returns a sequence with one item per frame starting at startFrame, at the
+// specified centers.
+func makeMergeTestSequence(id int, startFrame int, centers ...[2]int) *Sequence {
+	seq := &Sequence{ID: id}
+	for i, center := range centers {
+		seq.Items = append(seq.Items, SequenceItem{
+			Detection: makeMergeTestDetection(center[0], center[1]),
+			Frame: startFrame + i,
+		})
+	}
+	return seq
+}
+
+// Returns n copies of the center.
+func repeatCenter(center [2]int, n int) [][2]int {
+	centers := make([][2]int, n)
+	for i := range centers {
+		centers[i] = center
+	}
+	return centers
+}
+
+func makeMergeTestParams(mode string) MergeParams {
+	params := DefaultMergeParams()
+	params.Mode = mode
+	params.DistanceThreshold = 40
+	params.BeginOffset = 0
+	params.EndOffset = 0
+	return params
+}
+
+func getOutputByID(outputs []*Sequence, id int) *Sequence {
+	for _, seq := range outputs {
+		if seq.ID == id {
+			return seq
+		}
+	}
+	return nil
+}
+
+func TestMergeSequencesSpatial(t *testing.T) {
+	sequences := []*Sequence{
+		makeMergeTestSequence(1, 0, repeatCenter([2]int{100, 100}, 10)...),
+		// Starts 10 pixels from the end of sequence 1.
+		makeMergeTestSequence(2, 20, repeatCenter([2]int{110, 100}, 5)...),
+		// Starts 60 pixels from the end of the merged sequence, within twice
+		// the threshold, so it is a rejected candidate.
+		makeMergeTestSequence(3, 30, repeatCenter([2]int{110, 160}, 5)...),
+		// Far from everything.
+		makeMergeTestSequence(4, 20, repeatCenter([2]int{500, 500}, 5)...),
+	}
+	outputs, candidates, err := MergeSequences(sequences, makeMergeTestFrames(40), makeMergeTestParams("spatial"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outputs) != 3 {
+		t.Fatalf("expected 3 output sequences, got %d", len(outputs))
+	}
+	seq := getOutputByID(outputs, 1)
+	if seq == nil || len(seq.Items) != 15 || fmt.Sprint(seq.Parents) != "[1 2]" {
+		t.Fatalf("expected sequence 2 to be merged into sequence 1, got %+v", seq)
+	}
+	if len(seq.Merges) != 1 || seq.Merges[0].Parent != 2 || seq.Merges[0].Distance != 10 {
+		t.Errorf("unexpected merge decisions %+v", seq.Merges)
+	}
+	for _, id := range []int{3, 4} {
+		if seq := getOutputByID(outputs, id); seq == nil || len(seq.Items) != 5 {
+			t.Errorf("expected sequence %d to be kept separately, got %+v", id, seq)
+		}
+	}
+
+	byParent := make(map[int][]MergeCandidate)
+	for _, candidate := range candidates {
+		byParent[candidate.Parent] = append(byParent[candidate.Parent], candidate)
+	}
+	if c := byParent[2]; len(c) != 1 || !c[0].Accepted || c[0].Output != 1 {
+		t.Errorf("expected accepted candidate for sequence 2, got %+v", c)
+	}
+	if c := byParent[3]; len(c) != 1 || c[0].Accepted || c[0].Reason != "distance" || c[0].Output != 3 {
+		t.Errorf("expected candidate rejected by distance for sequence 3, got %+v", c)
+	}
+	if c := byParent[4]; len(c) != 0 {
+		t.Errorf("expected no candidates for sequence 4, got %+v", c)
+	}
+}
+
+func TestMergeSequencesVelocity(t *testing.T) {
+	// Moves 10 pixels per frame along x, then is not detected for 10 frames.
+	var centers [][2]int
+	for i := 0; i < 10; i++ {
+		centers = append(centers, [2]int{100 + 10*i, 100})
+	}
+	sequences := []*Sequence{
+		makeMergeTestSequence(1, 0, centers...),
+		// Where sequence 1 would be at frame 20.
+		makeMergeTestSequence(2, 20, [2]int{300, 100}, [2]int{310, 100}),
+	}
+
+	outputs, _, err := MergeSequences(sequences, makeMergeTestFrames(30), makeMergeTestParams("spatial"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outputs) != 2 {
+		t.Fatalf("expected spatial mode not to merge, got %d output sequences", len(outputs))
+	}
+
+	outputs, _, err = MergeSequences(sequences, makeMergeTestFrames(30), makeMergeTestParams("velocity"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outputs) != 1 || len(outputs[0].Items) != 12 {
+		t.Fatalf("expected velocity mode to merge, got %d output sequences", len(outputs))
+	}
+	if d := outputs[0].Merges[0].Distance; d != 0 {
+		t.Errorf("expected distance 0 from extrapolated location, got %v", d)
+	}
+}
+
+func TestMergeSequencesImageSimilarity(t *testing.T) {
+	sequences := []*Sequence{
+		// Previous sequences ending at frames 4 and 5.
+		makeMergeTestSequence(1, 0, repeatCenter([2]int{100, 100}, 5)...),
+		makeMergeTestSequence(2, 0, repeatCenter([2]int{100, 120}, 6)...),
+		// Closer to sequence 1, but only looks like sequence 2.
+		makeMergeTestSequence(3, 10, repeatCenter([2]int{100, 105}, 5)...),
+		// Cannot be compared with anything.
+		makeMergeTestSequence(4, 20, repeatCenter([2]int{100, 110}, 5)...),
+	}
+	// Similarities keyed by the frame of the parent detection and the frame
+	// of the previous detection.
+	similarities := map[[2]int]float64{
+		{10, 4}: 0.05,
+		{10, 5}: 0.9,
+	}
+	similarityFunc := func(frameIdx1 int, detection1 Detection, frameIdx2 int, detection2 Detection) (float64, error) {
+		if s, ok := similarities[[2]int{frameIdx1, frameIdx2}]; ok {
+			return s, nil
+		}
+		return 0, fmt.Errorf("detection at frame %d is outside the frame bounds", frameIdx1)
+	}
+
+	if _, _, err := MergeSequences(sequences, makeMergeTestFrames(30), makeMergeTestParams("image_similarity"), nil); err == nil {
+		t.Error("expected error without a similarity function")
+	}
+
+	outputs, candidates, err := MergeSequences(sequences, makeMergeTestFrames(30), makeMergeTestParams("image_similarity"), similarityFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq := getOutputByID(outputs, 2); seq == nil || fmt.Sprint(seq.Parents) != "[2 3]" {
+		t.Fatalf("expected sequence 3 to be merged into sequence 2, got %+v", seq)
+	}
+	if seq := getOutputByID(outputs, 4); seq == nil || len(seq.Items) != 5 {
+		t.Errorf("expected sequence 4 to be kept separately, got %+v", seq)
+	}
+
+	reasons := make(map[[2]int]string)
+	for _, candidate := range candidates {
+		reasons[[2]int{candidate.Parent, candidate.Candidate}] = candidate.Reason
+	}
+	expected := map[[2]int]string{
+		{3, 1}: "similarity",
+		{3, 2}: "",
+		{4, 1}: "similarity_error",
+		{4, 2}: "similarity_error",
+	}
+	for k, reason := range expected {
+		if got, ok := reasons[k]; !ok || got != reason {
+			t.Errorf("expected reason %q for parent %d and candidate %d, got %q", reason, k[0], k[1], got)
+		}
+	}
+}
+
+func TestMergeSequencesInvalidOffsets(t *testing.T) {
+	sequences := []*Sequence{makeMergeTestSequence(1, 0, repeatCenter([2]int{100, 100}, 5)...)}
+	for _, params := range []MergeParams{
+		{BeginOffset: -1},
+		{EndOffset: -1},
+	} {
+		if _, _, err := MergeSequences(sequences, makeMergeTestFrames(10), params, nil); err == nil {
+			t.Errorf("expected error for params %+v", params)
+		}
+	}
+}
+
+func TestGetMergeAudit(t *testing.T) {
+	sequences := []*Sequence{
+		makeMergeTestSequence(1, 0, repeatCenter([2]int{100, 100}, 10)...),
+		makeMergeTestSequence(2, 20, repeatCenter([2]int{110, 100}, 5)...),
+		makeMergeTestSequence(3, 30, repeatCenter([2]int{110, 160}, 5)...),
+	}
+	outputs, candidates, err := MergeSequences(sequences, makeMergeTestFrames(40), makeMergeTestParams("spatial"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Config.DataDir = t.TempDir()
+	hash := strings.Repeat("ab", 32)
+	dir, err := GetMergeDir(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir != filepath.Join(Config.DataDir, "Merge." + hash) {
+		t.Errorf("unexpected Merge directory %s", dir)
+	}
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "sequences.json"), JsonMarshal(outputs), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "merge-candidates.json"), JsonMarshal(candidates), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	audit, err := GetMergeAudit(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(audit.Parents) != "[1 2]" || len(audit.Merges) != 1 {
+		t.Errorf("unexpected audit %+v", audit)
+	}
+	if len(audit.Candidates) != 2 {
+		t.Fatalf("expected 2 candidates, got %+v", audit.Candidates)
+	}
+	if !sort.SliceIsSorted(audit.Candidates, func(i, j int) bool {
+		return audit.Candidates[i].Frame < audit.Candidates[j].Frame
+	}) {
+		t.Errorf("expected candidates ordered by frame, got %+v", audit.Candidates)
+	}
+
+	for _, hash := range []string{"", "../x", strings.Repeat("AB", 32)} {
+		if _, err := GetMergeDir(hash); err == nil {
+			t.Errorf("expected error for hash %q", hash)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+)
+
+/*
+ODMatrix assigns each sequence an origin (entry) zone and a destination (exit)
+zone, and counts the sequences for each origin-destination pair, e.g. for
+turning movements at an intersection. Arguments:
+- Sequences
+- Zone table, e.g. one zone per intersection approach
+- Mode (optional):
+  - "visited" (default): the first and last zones that the sequence passes through
+  - "endpoints": the zones containing the first and last detections of the sequence
+Sequences without both an origin and a destination are skipped.
+
+Outputs od.json with the counts for each pair and the trip of each sequence.
+*/
+
+type ODTrip struct {
+	Sequence int
+	Origin string
+	Destination string
+	StartFrame int
+	EndFrame int
+}
+
+type ODCount struct {
+	Origin string
+	Destination string
+	Count int
+}
+
+type ODMatrix struct {
+	Zones []string
+	Counts []ODCount
+	Trips []ODTrip
+}
+
+func ODMatrixOp(args []OpArgument, outDir string) error {
+	mode := "visited"
+	if len(args) >= 3 && args[2].String != "" {
+		mode = args[2].String
+	}
+	if mode != "visited" && mode != "endpoints" {
+		return fmt.Errorf("unknown OD mode %s", mode)
+	}
+
+	// Load the input sequences.
+	var sequences []*Sequence
+	inputPath := filepath.Join(args[0].DirName, "sequences.json")
+	bytes, err := ioutil.ReadFile(inputPath)
+	if err != nil {
+		return fmt.Errorf("error loading sequences from %s: %v", inputPath, err)
+	}
+	if err := json.Unmarshal(bytes, &sequences); err != nil {
+		return fmt.Errorf("error decoding sequences: %v", err)
+	}
+
+	zones, err := LoadZones(args[1].DirName)
+	if err != nil {
+		return err
+	}
+
+	// Returns the index of the first zone containing the item, or -1 if none.
+	getZone := func(item SequenceItem) int {
+		p := item.Detection.Polygon().Bounds().Center()
+		for i, zone := range zones {
+			if zone.Contains(p) {
+				return i
+			}
+		}
+		return -1
+	}
+
+	od := ODMatrix{
+		Counts: []ODCount{},
+		Trips: []ODTrip{},
+	}
+	for _, zone := range zones {
+		od.Zones = append(od.Zones, zone.Name)
+	}
+	counts := make([][]int, len(zones))
+	for i := range counts {
+		counts[i] = make([]int, len(zones))
+	}
+
+	for _, seq := range sequences {
+		if len(seq.Items) == 0 {
+			continue
+		}
+		origin, destination := -1, -1
+		var startFrame, endFrame int
+		if mode == "endpoints" {
+			first := seq.Items[0]
+			last := seq.Items[len(seq.Items)-1]
+			origin, destination = getZone(first), getZone(last)
+			startFrame, endFrame = first.Frame, last.Frame
+		} else {
+			for _, item := range seq.Items {
+				zone := getZone(item)
+				if zone == -1 {
+					continue
+				}
+				if origin == -1 {
+					origin = zone
+					startFrame = item.Frame
+				}
+				destination = zone
+				endFrame = item.Frame
+			}
+		}
+		if origin == -1 || destination == -1 {
+			continue
+		}
+		counts[origin][destination]++
+		od.Trips = append(od.Trips, ODTrip{
+			Sequence: seq.ID,
+			Origin: zones[origin].Name,
+			Destination: zones[destination].Name,
+			StartFrame: startFrame,
+			EndFrame: endFrame,
+		})
+	}
+
+	for i := range zones {
+		for j := range zones {
+			od.Counts = append(od.Counts, ODCount{
+				Origin: zones[i].Name,
+				Destination: zones[j].Name,
+				Count: counts[i][j],
+			})
+		}
+	}
+
+	bytes, err = json.Marshal(od)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(outDir, "od.json"), bytes, 0644); err != nil {
+		return err
+	}
+	return nil
+}
+
+func init() {
+	Ops["ODMatrix"] = ODMatrixOp
+	OpSignatures["ODMatrix"] = OpSignature{MinArgs: 2, MaxArgs: 3}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Runs ODMatrix on the sequences with zones "west" covering [0, 100] x
+// [0, 100] and "east" covering [200, 300] x [0, 100].
+func runODMatrixTest(t *testing.T, sequences []*Sequence, mode string) ODMatrix {
+	dir := t.TempDir()
+	seqDir := filepath.Join(dir, "sequences")
+	zonesDir := filepath.Join(dir, "zones")
+	outDir := filepath.Join(dir, "out")
+	for _, d := range []string{seqDir, zonesDir, outDir} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	zones := []Zone{
+		{Name: "west", Polygons: [][][][2]float64{{{{0, 0}, {100, 0}, {100, 100}, {0, 100}}}}},
+		{Name: "east", Polygons: [][][][2]float64{{{{200, 0}, {300, 0}, {300, 100}, {200, 100}}}}},
+	}
+	if err := ioutil.WriteFile(filepath.Join(seqDir, "sequences.json"), JsonMarshal(sequences), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(zonesDir, "zones.json"), JsonMarshal(zones), 0644); err != nil {
+		t.Fatal(err)
+	}
+	args := []OpArgument{
+		{Type: "node", DirName: seqDir},
+		{Type: "node", DirName: zonesDir},
+		{Type: "string", String: mode},
+	}
+	if err := ODMatrixOp(args, outDir); err != nil {
+		t.Fatal(err)
+	}
+	bytes, err := ioutil.ReadFile(filepath.Join(outDir, "od.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var od ODMatrix
+	if err := json.Unmarshal(bytes, &od); err != nil {
+		t.Fatal(err)
+	}
+	return od
+}
+
+func TestODMatrixModes(t *testing.T) {
+	sequences := []*Sequence{
+		// West to east, starting and ending outside the zones.
+		makeMergeTestSequence(1, 0, [2]int{50, 150}, [2]int{50, 50}, [2]int{150, 50}, [2]int{250, 50}, [2]int{250, 150}),
+		// East to west, starting and ending in the zones.
+		makeMergeTestSequence(2, 0, [2]int{250, 50}, [2]int{150, 50}, [2]int{50, 50}),
+		{ID: 3},
+	}
+	for mode, expected := range map[string]map[string]int{
+		"visited": {"west-east": 1, "east-west": 1},
+		"endpoints": {"east-west": 1},
+	} {
+		od := runODMatrixTest(t, sequences, mode)
+		if len(od.Counts) != 4 {
+			t.Fatalf("%s: expected 4 counts, got %+v", mode, od.Counts)
+		}
+		for _, count := range od.Counts {
+			if count.Count != expected[count.Origin + "-" + count.Destination] {
+				t.Errorf("%s: unexpected count %+v", mode, count)
+			}
+		}
+		if len(od.Trips) != len(expected) {
+			t.Errorf("%s: expected %d trips, got %+v", mode, len(expected), od.Trips)
+		}
+	}
+}
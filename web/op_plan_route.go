@@ -0,0 +1,349 @@
+package main
+
+import (
+	"github.com/mitroadmaps/gomapinfer/common"
+
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+/*
+PlanRoute plans a drone flight that collects the most priority from a
+priorities matrix within a time budget. Example operands:
+	{"Speed": 20, "Budget": "10m", "Hover": 5}
+
+Operands:
+- Speed: drone speed in ortho-image pixels per second
+- Budget: flight time, as a duration or frame count (see Window)
+- Start: drone position in pixels (default: center of the last frame)
+- Return: whether the drone must return to Start within the budget (default true)
+- Hover: seconds spent at each waypoint (default 0)
+- Footprint: camera footprint [width, height] in pixels (default: median
+  bounding box size of the frames in align-out.json)
+- Frame: the time of the priorities to use (default: the last observation)
+- Altitude: altitude in meters for the KML export (default 50)
+
+A cell is collected when a waypoint's footprint, centered on the waypoint,
+contains the whole cell. We plan greedily: candidate waypoints are the
+centers of cells with positive priority, and we repeatedly fly to the
+candidate with the highest newly collected priority per second of travel and
+hover time, among those that leave enough time to return.
+
+Outputs route.json with the waypoints, and route.kml if the ortho-image has a
+geo transform (see LoadGeoTransform). A geotransform.json that cannot be read
+or decoded is an error.
+*/
+
+type RouteWaypoint struct {
+	Point [2]float64
+	// Seconds since the start of the flight when the drone arrives.
+	Arrival float64
+	// Priority collected at this waypoint, and the cells collected.
+	Priority float64
+	Cells [][2]int
+}
+
+type RoutePlan struct {
+	Start [2]float64
+	Footprint [2]float64
+	Waypoints []RouteWaypoint
+	// Total priority collected, and flight time in seconds.
+	Priority float64
+	Duration float64
+}
+
+// Returns the center of the bounding box of the cell.
+func getCellCenter(t Tessellation, cell [2]int) common.Point {
+	var poly common.Polygon
+	for _, p := range t.CellPolygons(cell) {
+		poly = append(poly, p...)
+	}
+	return poly.Bounds().Center()
+}
+
+// Returns the median width and height of the frame bounding boxes.
+func getMedianFrameSize(frames []Frame) [2]float64 {
+	var widths, heights []float64
+	for _, frame := range frames {
+		if len(frame) == 0 {
+			continue
+		}
+		rect := frame.Polygon().Bounds()
+		widths = append(widths, rect.Max.X - rect.Min.X)
+		heights = append(heights, rect.Max.Y - rect.Min.Y)
+	}
+	if len(widths) == 0 {
+		return [2]float64{}
+	}
+	sort.Float64s(widths)
+	sort.Float64s(heights)
+	return [2]float64{widths[len(widths)/2], heights[len(heights)/2]}
+}
+
+func PlanRouteOp(args []OpArgument, outDir string) error {
+	// Parse arguments.
+	var operands struct {
+		Speed float64
+		Budget string
+		Start *[2]float64
+		Return *bool
+		Hover float64
+		Footprint *[2]float64
+		Frame string
+		Altitude float64
+	}
+	err := json.Unmarshal([]byte(args[1].String), &operands)
+	if err != nil {
+		return fmt.Errorf("error decoding operands %s: %v", args[1].String, err)
+	}
+	if operands.Speed <= 0 {
+		return fmt.Errorf("drone speed must be positive")
+	}
+	budgetFrames, err := ParseFrameSpec(operands.Budget, "")
+	if err != nil {
+		return err
+	}
+	budget := float64(budgetFrames) / FramesPerSecond
+	returnToStart := operands.Return == nil || *operands.Return
+	if operands.Altitude == 0 {
+		operands.Altitude = 50
+	}
+
+	// Load the priorities matrix.
+	matrix, err := LoadMatrix(args[0].DirName)
+	if err != nil {
+		return err
+	}
+	tessellation, err := matrix.GetTessellation()
+	if err != nil {
+		return err
+	}
+
+	// Load frame bounds, which give the default start and footprint.
+	var frames []Frame
+	bytes, err := ioutil.ReadFile(filepath.Join(Config.DataDir, "align-out.json"))
+	if err != nil {
+		return fmt.Errorf("error loading frame bounds: %v", err)
+	}
+	if err := json.Unmarshal(bytes, &frames); err != nil {
+		return fmt.Errorf("error decoding frame bounds: %v", err)
+	}
+	var start common.Point
+	if operands.Start != nil {
+		start = common.Point{operands.Start[0], operands.Start[1]}
+	} else if len(frames) > 0 {
+		start = frames[len(frames)-1].Polygon().Bounds().Center()
+	}
+	footprint := getMedianFrameSize(frames)
+	if operands.Footprint != nil {
+		footprint = *operands.Footprint
+	}
+	if footprint[0] <= 0 || footprint[1] <= 0 {
+		return fmt.Errorf("camera footprint must be positive")
+	}
+
+	// Get the current priority at each cell.
+	targetFrame := -1
+	if operands.Frame != "" {
+		targetFrame, err = ParseFrameSpec(operands.Frame, "")
+		if err != nil {
+			return err
+		}
+	}
+	priorities := make(map[[2]int]float64)
+	for _, obs := range matrix.Observations {
+		if targetFrame != -1 && obs.Frame > targetFrame {
+			continue
+		}
+		priorities[obs.Cell] = obs.Value
+	}
+
+	// Candidate waypoints and the cells that each one would collect.
+	type candidate struct {
+		point common.Point
+		cells [][2]int
+	}
+	var cells [][2]int
+	for cell, priority := range priorities {
+		if priority > 0 {
+			cells = append(cells, cell)
+		}
+	}
+	sort.Slice(cells, func(i, j int) bool {
+		return cells[i][0] < cells[j][0] || (cells[i][0] == cells[j][0] && cells[i][1] < cells[j][1])
+	})
+	var candidates []candidate
+	for _, cell := range cells {
+		center := getCellCenter(tessellation, cell)
+		footprintRect := common.Rectangle{
+			common.Point{center.X - footprint[0]/2, center.Y - footprint[1]/2},
+			common.Point{center.X + footprint[0]/2, center.Y + footprint[1]/2},
+		}
+		c := candidate{point: center}
+		for _, other := range cells {
+			inside := true
+			for _, poly := range tessellation.CellPolygons(other) {
+				for _, p := range poly {
+					if !footprintRect.Contains(p) {
+						inside = false
+					}
+				}
+			}
+			if inside {
+				c.cells = append(c.cells, other)
+			}
+		}
+		candidates = append(candidates, c)
+	}
+
+	plan := RoutePlan{
+		Start: [2]float64{start.X, start.Y},
+		Footprint: footprint,
+		Waypoints: []RouteWaypoint{},
+	}
+	collected := make(map[[2]int]bool)
+	cur := start
+	var elapsed float64
+	for {
+		bestIdx := -1
+		var bestScore, bestGain float64
+		for i, c := range candidates {
+			var gain float64
+			for _, cell := range c.cells {
+				if !collected[cell] {
+					gain += priorities[cell]
+				}
+			}
+			if gain <= 0 {
+				continue
+			}
+			t := cur.Distance(c.point) / operands.Speed + operands.Hover
+			finish := elapsed + t
+			if returnToStart {
+				finish += c.point.Distance(start) / operands.Speed
+			}
+			if finish > budget {
+				continue
+			}
+			score := gain / math.Max(t, 1e-6)
+			if bestIdx == -1 || score > bestScore {
+				bestIdx = i
+				bestScore = score
+				bestGain = gain
+			}
+		}
+		if bestIdx == -1 {
+			break
+		}
+
+		c := candidates[bestIdx]
+		elapsed += cur.Distance(c.point) / operands.Speed
+		waypoint := RouteWaypoint{
+			Point: [2]float64{c.point.X, c.point.Y},
+			Arrival: elapsed,
+			Priority: bestGain,
+		}
+		for _, cell := range c.cells {
+			if !collected[cell] {
+				collected[cell] = true
+				waypoint.Cells = append(waypoint.Cells, cell)
+			}
+		}
+		elapsed += operands.Hover
+		plan.Waypoints = append(plan.Waypoints, waypoint)
+		plan.Priority += bestGain
+		cur = c.point
+	}
+	if returnToStart {
+		elapsed += cur.Distance(start) / operands.Speed
+	}
+	plan.Duration = elapsed
+
+	bytes, err = json.Marshal(plan)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(outDir, "route.json"), bytes, 0644); err != nil {
+		return err
+	}
+
+	// Skip the KML export only if there is no geo transform, so that a
+	// broken geotransform.json is reported.
+	if _, err := os.Stat(GetGeoTransformPath()); err == nil {
+		geoTransform, err := LoadGeoTransform()
+		if err != nil {
+			return err
+		}
+		bytes, err := RouteToKML(plan, geoTransform, operands.Altitude, returnToStart)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(outDir, "route.kml"), bytes, 0644); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("error loading geo transform: %v", err)
+	}
+	return nil
+}
+
+// Exports the route as KML, with a placemark for each waypoint and a line
+// string for the flight path.
+func RouteToKML(plan RoutePlan, g GeoTransform, altitude float64, returnToStart bool) ([]byte, error) {
+	type kmlPoint struct {
+		Coordinates string `xml:"coordinates"`
+	}
+	type kmlLineString struct {
+		AltitudeMode string `xml:"altitudeMode"`
+		Coordinates string `xml:"coordinates"`
+	}
+	type kmlPlacemark struct {
+		Name string `xml:"name"`
+		Description string `xml:"description,omitempty"`
+		Point *kmlPoint `xml:"Point,omitempty"`
+		LineString *kmlLineString `xml:"LineString,omitempty"`
+	}
+	type kml struct {
+		XMLName xml.Name `xml:"http://www.opengis.net/kml/2.2 kml"`
+		Name string `xml:"Document>name"`
+		Placemarks []kmlPlacemark `xml:"Document>Placemark"`
+	}
+
+	toCoordinates := func(p [2]float64) string {
+		lon, lat := g.ToLonLat(common.Point{p[0], p[1]})
+		return fmt.Sprintf("%.7f,%.7f,%.1f", lon, lat, altitude)
+	}
+	doc := kml{Name: "route"}
+	path := toCoordinates(plan.Start)
+	for i, waypoint := range plan.Waypoints {
+		doc.Placemarks = append(doc.Placemarks, kmlPlacemark{
+			Name: fmt.Sprintf("waypoint %d", i+1),
+			Description: fmt.Sprintf("arrival %.0fs, priority %.2f", waypoint.Arrival, waypoint.Priority),
+			Point: &kmlPoint{toCoordinates(waypoint.Point)},
+		})
+		path += " " + toCoordinates(waypoint.Point)
+	}
+	if returnToStart {
+		path += " " + toCoordinates(plan.Start)
+	}
+	doc.Placemarks = append(doc.Placemarks, kmlPlacemark{
+		Name: "path",
+		LineString: &kmlLineString{"relativeToGround", path},
+	})
+	bytes, err := xml.MarshalIndent(doc, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), bytes...), nil
+}
+
+func init() {
+	Ops["PlanRoute"] = PlanRouteOp
+	OpSignatures["PlanRoute"] = OpSignature{MinArgs: 2, MaxArgs: 2, JSONOperands: true}
+}
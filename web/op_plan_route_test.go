@@ -0,0 +1,170 @@
+package main
+
+import (
+	"github.com/mitroadmaps/gomapinfer/common"
+
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Runs PlanRoute over a priorities matrix with 10x10 cells: priority 1 at
+// the start, 5 at 100 pixels to the right, and 2 at 100 pixels down. If
+// geoTransform is set, it is written to geotransform.json.
+func runPlanRouteTest(t *testing.T, operands string, geoTransform string) (RoutePlan, string, error) {
+	Config.DataDir = t.TempDir()
+	if geoTransform != "" {
+		if err := ioutil.WriteFile(GetGeoTransformPath(), []byte(geoTransform), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	frames := []Frame{{{0, 0}, {200, 0}, {200, 200}, {0, 200}}}
+	if err := ioutil.WriteFile(filepath.Join(Config.DataDir, "align-out.json"), JsonMarshal(frames), 0644); err != nil {
+		t.Fatal(err)
+	}
+	matrix := Matrix{GridSize: 10, Observations: []MatrixObservation{
+		{Cell: [2]int{0, 0}, Frame: 0, Value: 1},
+		{Cell: [2]int{10, 0}, Frame: 0, Value: 5},
+		{Cell: [2]int{0, 10}, Frame: 0, Value: 2},
+		{Cell: [2]int{10, 10}, Frame: 0, Value: 0},
+	}}
+	args, outDir := makeMatrixArgs(t, []Matrix{matrix}, operands)
+	var plan RoutePlan
+	if err := PlanRouteOp(args, outDir); err != nil {
+		return plan, outDir, err
+	}
+	bytes, err := ioutil.ReadFile(filepath.Join(outDir, "route.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(bytes, &plan); err != nil {
+		t.Fatal(err)
+	}
+	return plan, outDir, nil
+}
+
+func getRouteCells(plan RoutePlan) [][2]int {
+	var cells [][2]int
+	for _, waypoint := range plan.Waypoints {
+		cells = append(cells, waypoint.Cells...)
+	}
+	return cells
+}
+
+func TestPlanRouteReturn(t *testing.T) {
+	// 10 pixels per second and a 25 second budget. With the return flight, we
+	// can only visit the start cell and the cell to the right (20 seconds).
+	plan, _, err := runPlanRouteTest(t, `{"Speed": 10, "Budget": "25s", "Start": [5, 5], "Footprint": [12, 12]}`, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cells := getRouteCells(plan)
+	if len(cells) != 2 || cells[0] != [2]int{0, 0} || cells[1] != [2]int{10, 0} {
+		t.Errorf("expected cells (0, 0) and (10, 0), got %v", cells)
+	}
+	if plan.Priority != 6 || plan.Duration != 20 {
+		t.Errorf("expected priority 6 in 20 seconds, got %v in %v", plan.Priority, plan.Duration)
+	}
+	if plan.Waypoints[1].Arrival != 10 {
+		t.Errorf("expected arrival after 10 seconds, got %v", plan.Waypoints[1].Arrival)
+	}
+}
+
+func TestPlanRouteNoReturn(t *testing.T) {
+	// Without returning, the third cell is reached after 10 + 14.1 seconds.
+	plan, _, err := runPlanRouteTest(t, `{"Speed": 10, "Budget": "25s", "Start": [5, 5], "Footprint": [12, 12], "Return": false}`, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cells := getRouteCells(plan); len(cells) != 3 || plan.Priority != 8 {
+		t.Errorf("expected all three cells with priority 8, got %v with %v", cells, plan.Priority)
+	}
+	if plan.Duration > 25 {
+		t.Errorf("route takes %v seconds, over the budget", plan.Duration)
+	}
+
+	// Hovering 5 seconds makes the cell to the right the best first waypoint
+	// (5 priority in 15 seconds), and then neither other cell fits.
+	plan, _, err = runPlanRouteTest(t, `{"Speed": 10, "Budget": "25s", "Start": [5, 5], "Footprint": [12, 12], "Return": false, "Hover": 5}`, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cells := getRouteCells(plan); len(cells) != 1 || cells[0] != [2]int{10, 0} || plan.Duration != 15 {
+		t.Errorf("expected cell (10, 0) in 15 seconds, got %v in %v", cells, plan.Duration)
+	}
+}
+
+func TestPlanRouteKML(t *testing.T) {
+	plan := RoutePlan{
+		Start: [2]float64{0, 0},
+		Waypoints: []RouteWaypoint{
+			{Point: [2]float64{100, 0}, Arrival: 10, Priority: 5},
+			{Point: [2]float64{100, 200}, Arrival: 30, Priority: 2.5},
+		},
+	}
+	g := GeoTransform{10, 0.001, 0, 50, 0, -0.001}
+	bytes, err := RouteToKML(plan, g, 40, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kml := string(bytes)
+	for _, s := range []string{
+		`<kml xmlns="http://www.opengis.net/kml/2.2">`,
+		"<name>waypoint 2</name>",
+		"<description>arrival 30s, priority 2.50</description>",
+		"<coordinates>10.1000000,49.8000000,40.0</coordinates>",
+		"<coordinates>10.0000000,50.0000000,40.0 10.1000000,50.0000000,40.0 10.1000000,49.8000000,40.0 10.0000000,50.0000000,40.0</coordinates>",
+	} {
+		if !strings.Contains(kml, s) {
+			t.Errorf("expected %s in KML:\n%s", s, kml)
+		}
+	}
+	bytes, err = RouteToKML(plan, g, 40, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(bytes), "10.1000000,49.8000000,40.0</coordinates>\n\t\t\t</LineString>") {
+		t.Errorf("expected the path to end at the last waypoint without returning:\n%s", bytes)
+	}
+}
+
+func TestPlanRouteGeoTransform(t *testing.T) {
+	operands := `{"Speed": 10, "Budget": "25s", "Start": [5, 5], "Footprint": [12, 12]}`
+	_, outDir, err := runPlanRouteTest(t, operands, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(outDir, "route.kml")); !os.IsNotExist(err) {
+		t.Error("expected no KML without a geo transform")
+	}
+	_, outDir, err = runPlanRouteTest(t, operands, "[10, 0.001, 0, 50, 0, -0.001]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(outDir, "route.kml")); err != nil {
+		t.Errorf("expected KML with a geo transform: %v", err)
+	}
+	if _, _, err := runPlanRouteTest(t, operands, "[10, 0.001"); err == nil {
+		t.Error("expected error for a broken geo transform")
+	}
+}
+
+func TestGeoTransformInverse(t *testing.T) {
+	g := GeoTransform{10, 0.001, 0.0002, 50, 0.0001, -0.001}
+	inverse, err := g.Inverse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lon, lat := g.ToLonLat(common.Point{30, 40})
+	x, y := inverse.ToLonLat(common.Point{lon, lat})
+	if math.Abs(x - 30) > 1e-6 || math.Abs(y - 40) > 1e-6 {
+		t.Errorf("expected (30, 40) after the round trip, got (%v, %v)", x, y)
+	}
+	if _, err := (GeoTransform{10, 0, 0, 50, 0, 0}).Inverse(); err == nil {
+		t.Error("expected error for a singular geo transform")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"path/filepath"
 )
 
@@ -13,23 +14,84 @@ import (
 // value at each cell. This operator computes priorities from that rate, i.e.,
 // it increments the priority at each cell by the rate specified in the input
 // matrix, but resets the priority to zero if the cell is visible in the frame.
+// An optional second argument selects the rate source:
+// - {"Channel": "stddev"}: a channel of the input matrix (default "value")
+// - {"Rate": "width"}: the width of the prediction interval from Forecast
+// - {"Rate": "exceedance", "Threshold": 10}: the probability that the value
+//   exceeds Threshold, under the normal distribution with the standard
+//   deviation that Forecast used for its prediction interval
+
+// Selects the rate at which priority increases (see above).
+type PriorityRateSpec struct {
+	// The channel of the input matrix containing the rates (default "value").
+	Channel string
+	// "channel" (default), "width", or "exceedance".
+	Rate string
+	Threshold float64
+}
+
+// Returns a function computing the rate from an observation of the rates
+// matrix. hasChannel checks whether the matrix has a channel.
+func (spec PriorityRateSpec) RateFunc(hasChannel func(channel string) bool) (func(obs MatrixObservation) float64, error) {
+	if spec.Rate == "" || spec.Rate == "channel" {
+		if !hasChannel(spec.Channel) {
+			return nil, fmt.Errorf("input matrix has no channel %s", spec.Channel)
+		}
+		return func(obs MatrixObservation) float64 {
+			return obs.Get(spec.Channel)
+		}, nil
+	} else if spec.Rate == "width" {
+		if !hasChannel("lower") || !hasChannel("upper") {
+			return nil, fmt.Errorf("rate %s needs a matrix with prediction intervals", spec.Rate)
+		}
+		return func(obs MatrixObservation) float64 {
+			return obs.Get("upper") - obs.Get("lower")
+		}, nil
+	} else if spec.Rate == "exceedance" {
+		if !hasChannel("stddev") {
+			return nil, fmt.Errorf("rate %s needs a matrix with a stddev channel", spec.Rate)
+		}
+		return func(obs MatrixObservation) float64 {
+			stddev := obs.Get("stddev")
+			if stddev == 0 {
+				if obs.Value > spec.Threshold {
+					return 1
+				}
+				return 0
+			}
+			return 0.5 * math.Erfc((spec.Threshold - obs.Value) / (stddev * math.Sqrt2))
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown rate source %s", spec.Rate)
+}
 
 func PrioritiesOp(args []OpArgument, outDir string) error {
+	// Parse arguments.
+	var operands PriorityRateSpec
+	if len(args) >= 2 {
+		err := json.Unmarshal([]byte(args[1].String), &operands)
+		if err != nil {
+			return fmt.Errorf("error decoding operands %s: %v", args[1].String, err)
+		}
+	}
+
 	// Load the input matrix.
-	var ratesMatrix Matrix
-	inputPath := filepath.Join(args[0].DirName, "matrix.json")
-	bytes, err := ioutil.ReadFile(inputPath)
+	ratesMatrix, err := LoadMatrix(args[0].DirName)
+	if err != nil {
+		return err
+	}
+	getRate, err := operands.RateFunc(ratesMatrix.HasChannel)
 	if err != nil {
-		return fmt.Errorf("error loading matrix from %s: %v", inputPath, err)
+		return err
 	}
-	if err := json.Unmarshal(bytes, &ratesMatrix); err != nil {
+	tessellation, err := ratesMatrix.GetTessellation()
+	if err != nil {
 		return err
 	}
-	gridSize := ratesMatrix.GridSize
 
 	// Load frame bounds.
 	var frames []Frame
-	bytes, err = ioutil.ReadFile(filepath.Join(Config.DataDir, "align-out.json"))
+	bytes, err := ioutil.ReadFile(filepath.Join(Config.DataDir, "align-out.json"))
 	if err != nil {
 		return fmt.Errorf("error loading frame bounds: %v", err)
 	}
@@ -42,7 +104,7 @@ func PrioritiesOp(args []OpArgument, outDir string) error {
 	inputObsCounter := 0
 
 	for frameIdx, frame := range frames {
-		for cell := range GetCellsInFrame(frame, float64(gridSize)) {
+		for cell := range GetCellsInFrame(tessellation, frame) {
 			if curObservations[cell] == nil || curObservations[cell].Value == 0 {
 				continue
 			}
@@ -59,14 +121,14 @@ func PrioritiesOp(args []OpArgument, outDir string) error {
 		for ; inputObsCounter < len(ratesMatrix.Observations) && ratesMatrix.Observations[inputObsCounter].Frame == frameIdx; inputObsCounter++ {
 			ratesObs := ratesMatrix.Observations[inputObsCounter]
 
-			// Increment priority by ratesObs.Value, but set to zero if the frame is visible.
+			// Increment priority by the rate, but set to zero if the frame is visible.
 			prevObs := curObservations[ratesObs.Cell]
-			var priority int = 0
+			var priority float64 = 0
 			if prevObs != nil {
 				priority = prevObs.Value
 			}
-			priority += ratesObs.Value
-			if IsCellInFrame(ratesObs.Cell, frame, float64(gridSize)) {
+			priority += getRate(ratesObs)
+			if IsCellInFrame(tessellation, ratesObs.Cell, frame) {
 				priority = 0
 			}
 			obs := MatrixObservation{
@@ -81,19 +143,15 @@ func PrioritiesOp(args []OpArgument, outDir string) error {
 	}
 
 	matrix := Matrix{
-		GridSize: gridSize,
+		GridSize: ratesMatrix.GridSize,
+		Zones: ratesMatrix.Zones,
+		Tessellation: ratesMatrix.Tessellation,
 		Observations: matrixObservations,
 	}
-	bytes, err = json.Marshal(matrix)
-	if err != nil {
-		return err
-	}
-	if err := ioutil.WriteFile(filepath.Join(outDir, "matrix.json"), bytes, 0644); err != nil {
-		return err
-	}
-	return nil
+	return WriteMatrix(outDir, matrix)
 }
 
 func init() {
 	Ops["Priorities"] = PrioritiesOp
+	OpSignatures["Priorities"] = OpSignature{MinArgs: 1, MaxArgs: 2, JSONOperands: true}
 }
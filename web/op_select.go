@@ -22,8 +22,12 @@ var SelectFuncs = map[string]SelectFunc{
 	"duration": func(seq *Sequence) float64 {
 		start := seq.Items[0].Frame
 		end := seq.Items[len(seq.Items)-1].Frame
-		// 5 fps
-		return float64(end-start)/5
+		return float64(end-start)/FramesPerSecond
+	},
+	// Displacement per second (see Sequence.Speed), or 0 for a single frame.
+	"speed": func(seq *Sequence) float64 {
+		speed, _ := seq.Speed()
+		return speed
 	},
 }
 
@@ -84,4 +88,5 @@ func SelectOp(args []OpArgument, outDir string) error {
 
 func init() {
 	Ops["Select"] = SelectOp
+	OpSignatures["Select"] = OpSignature{MinArgs: 2, MaxArgs: 2}
 }
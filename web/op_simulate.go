@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"sort"
+)
+
+/*
+Simulate evaluates an observation policy and forecast model offline. It
+replays a ground-truth matrix, e.g. the output of ToMatrix over a video with
+full coverage, and at each interval lets the policy choose which cells the
+virtual drone observes. Only those observations are fed to the forecast
+model, and we score the reconstruction (the observed value at observed cells,
+and the forecast elsewhere) against the ground truth. Example operands:
+	{"Frequency": 4500, "Period": 96, "Model": "holt_winters", "Policy": "priorities", "CellsPerInterval": 5, "Priorities": {"Rate": "width"}}
+
+Operands:
+- Frequency, Period, Model, Channel, Alpha, Beta, Gamma, UnknownStddev, and
+  Confidence: as in Forecast
+- Policy:
+  - "priorities" (default): observe the cells with the highest priority,
+    computed as in Priorities with the rate source in Priorities (default
+    {"Channel": "stddev"})
+  - "round_robin": observe the cells that were observed least recently
+  - "random": observe random cells (with Seed)
+- CellsPerInterval: the number of cells observed at each interval (default 1)
+
+Cells that have never been observed are predicted as zero, with sparse
+uncertainty. The fallback stddev for sparse prediction intervals is the
+stddev of the values observed so far.
+
+Outputs:
+- simulation.json: the cells observed and the reconstruction error at each
+  interval, and the overall error
+- matrix.json: the reconstruction, with the ground truth in the "truth"
+  channel, the priority in the "priority" channel, and "observed" set to 1 at
+  observed cells
+*/
+
+type SimulationStep struct {
+	Interval int
+	Frame int
+	Observed [][2]int
+	MAE float64
+	RMSE float64
+}
+
+type SimulationResult struct {
+	Policy string
+	Model string
+	Steps []SimulationStep
+	// Error over all cells and intervals.
+	MAE float64
+	RMSE float64
+}
+
+func SimulateOp(args []OpArgument, outDir string) error {
+	// Parse arguments.
+	var operands struct {
+		Frequency int
+		Period int
+		Channel string
+		Model string
+		ForecastParamOperands
+		Confidence float64
+
+		Policy string
+		CellsPerInterval int
+		Seed int64
+		Priorities PriorityRateSpec
+	}
+	err := json.Unmarshal([]byte(args[1].String), &operands)
+	if err != nil {
+		return fmt.Errorf("error decoding operands %s: %v", args[1].String, err)
+	}
+	if operands.Frequency <= 0 {
+		return fmt.Errorf("simulation frequency must be positive")
+	}
+	if operands.Model == "" {
+		operands.Model = "cyclic"
+	}
+	if ForecastModels[operands.Model] == nil {
+		return fmt.Errorf("no such forecast model %s", operands.Model)
+	}
+	if forecastModelIsSeasonal(operands.Model) && operands.Period <= 0 {
+		return fmt.Errorf("forecast model %s needs a positive Period", operands.Model)
+	}
+	if operands.Confidence == 0 {
+		operands.Confidence = 0.95
+	}
+	if operands.Policy == "" {
+		operands.Policy = "priorities"
+	}
+	if operands.Policy != "priorities" && operands.Policy != "round_robin" && operands.Policy != "random" {
+		return fmt.Errorf("unknown simulation policy %s", operands.Policy)
+	}
+	if operands.CellsPerInterval <= 0 {
+		operands.CellsPerInterval = 1
+	}
+	params, err := operands.ForecastParamOperands.Params(operands.Period)
+	if err != nil {
+		return err
+	}
+	z, err := getNormalInterval(operands.Confidence)
+	if err != nil {
+		return err
+	}
+
+	if operands.Priorities.Rate == "" && operands.Priorities.Channel == "" {
+		operands.Priorities.Channel = "stddev"
+	}
+	// The predictions have every channel that Priorities may use.
+	getRate, err := operands.Priorities.RateFunc(func(channel string) bool {
+		return channel == "" || channel == ValueChannel || channel == "stddev" || channel == "lower" || channel == "upper"
+	})
+	if err != nil {
+		return err
+	}
+
+	// Load the ground truth.
+	truthMatrix, err := LoadMatrix(args[0].DirName)
+	if err != nil {
+		return err
+	}
+	if !truthMatrix.HasChannel(operands.Channel) {
+		return fmt.Errorf("input matrix has no channel %s", operands.Channel)
+	}
+	if len(truthMatrix.Observations) == 0 {
+		return fmt.Errorf("input matrix has no observations")
+	}
+	observations := append([]MatrixObservation{}, truthMatrix.Observations...)
+	sort.SliceStable(observations, func(i, j int) bool {
+		return observations[i].Frame < observations[j].Frame
+	})
+	numIntervals := observations[len(observations)-1].Frame / operands.Frequency + 1
+
+	// State of each cell.
+	type cellState struct {
+		truth float64
+		model ForecastModel
+		observed bool
+		lastObserved int
+		priority float64
+	}
+	states := make(map[[2]int]*cellState)
+	var cells [][2]int
+	var observedValues Accumulator
+	rng := rand.New(rand.NewSource(operands.Seed))
+
+	result := SimulationResult{
+		Policy: operands.Policy,
+		Model: operands.Model,
+		Steps: []SimulationStep{},
+	}
+	var totalAbsError, totalSqError float64
+	var totalCount int
+	matrixObservations := []MatrixObservation{}
+	obsIdx := 0
+
+	for interval := 0; interval < numIntervals; interval++ {
+		frame := interval * operands.Frequency
+
+		// Update the ground truth, carrying values forward.
+		for ; obsIdx < len(observations) && observations[obsIdx].Frame < frame + operands.Frequency; obsIdx++ {
+			obs := observations[obsIdx]
+			if states[obs.Cell] == nil {
+				states[obs.Cell] = &cellState{
+					model: ForecastModels[operands.Model](params),
+					lastObserved: -1,
+				}
+				cells = append(cells, obs.Cell)
+			}
+			states[obs.Cell].truth = obs.Get(operands.Channel)
+		}
+		sort.Slice(cells, func(i, j int) bool {
+			return cells[i][0] < cells[j][0] || (cells[i][0] == cells[j][0] && cells[i][1] < cells[j][1])
+		})
+
+		// Predict every cell and update priorities.
+		predictions := make(map[[2]int]ForecastPrediction)
+		for _, cell := range cells {
+			state := states[cell]
+			var pred ForecastPrediction
+			if state.observed {
+				pred = state.model.Predict(interval)
+			} else {
+				pred = ForecastPrediction{
+					Stddev: params.UnknownStddev,
+					Sparse: true,
+				}
+			}
+			predictions[cell] = pred
+			lower, upper := pred.Interval(z, observedValues.Stddev())
+			rateObs := MatrixObservation{Value: pred.Value}
+			rateObs.Set("stddev", pred.Stddev)
+			rateObs.Set("lower", lower)
+			rateObs.Set("upper", upper)
+			state.priority += getRate(rateObs)
+		}
+
+		// Choose the cells to observe.
+		candidates := append([][2]int{}, cells...)
+		if operands.Policy == "priorities" {
+			sort.SliceStable(candidates, func(i, j int) bool {
+				return states[candidates[i]].priority > states[candidates[j]].priority
+			})
+		} else if operands.Policy == "round_robin" {
+			sort.SliceStable(candidates, func(i, j int) bool {
+				return states[candidates[i]].lastObserved < states[candidates[j]].lastObserved
+			})
+		} else if operands.Policy == "random" {
+			rng.Shuffle(len(candidates), func(i, j int) {
+				candidates[i], candidates[j] = candidates[j], candidates[i]
+			})
+		}
+		if len(candidates) > operands.CellsPerInterval {
+			candidates = candidates[:operands.CellsPerInterval]
+		}
+		observedNow := make(map[[2]int]bool)
+		for _, cell := range candidates {
+			state := states[cell]
+			state.model.Observe(interval, state.truth)
+			state.observed = true
+			state.lastObserved = interval
+			state.priority = 0
+			observedNow[cell] = true
+			observedValues.Add(state.truth)
+		}
+
+		// Score the reconstruction.
+		step := SimulationStep{
+			Interval: interval,
+			Frame: frame,
+			Observed: candidates,
+		}
+		var absError, sqError float64
+		for _, cell := range cells {
+			state := states[cell]
+			estimate := predictions[cell].Value
+			if observedNow[cell] {
+				estimate = state.truth
+			}
+			d := estimate - state.truth
+			absError += math.Abs(d)
+			sqError += d * d
+
+			obs := MatrixObservation{
+				Cell: cell,
+				Frame: frame,
+				Value: estimate,
+			}
+			obs.Set("truth", state.truth)
+			obs.Set("priority", state.priority)
+			if observedNow[cell] {
+				obs.Set("observed", 1)
+			}
+			matrixObservations = append(matrixObservations, obs)
+		}
+		if len(cells) > 0 {
+			step.MAE = absError / float64(len(cells))
+			step.RMSE = math.Sqrt(sqError / float64(len(cells)))
+		}
+		totalAbsError += absError
+		totalSqError += sqError
+		totalCount += len(cells)
+		result.Steps = append(result.Steps, step)
+	}
+	if totalCount > 0 {
+		result.MAE = totalAbsError / float64(totalCount)
+		result.RMSE = math.Sqrt(totalSqError / float64(totalCount))
+	}
+
+	bytes, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(outDir, "simulation.json"), bytes, 0644); err != nil {
+		return err
+	}
+	matrix := Matrix{
+		GridSize: truthMatrix.GridSize,
+		Zones: truthMatrix.Zones,
+		Tessellation: truthMatrix.Tessellation,
+		Observations: matrixObservations,
+	}
+	return WriteMatrix(outDir, matrix)
+}
+
+func init() {
+	Ops["Simulate"] = SimulateOp
+	OpSignatures["Simulate"] = OpSignature{MinArgs: 2, MaxArgs: 2, JSONOperands: true}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Three cells with constant values 1, 2, and 3 over three intervals.
+func makeSimulateTestMatrix() Matrix {
+	var observations []MatrixObservation
+	for frame := 0; frame < 3; frame++ {
+		for i := 0; i < 3; i++ {
+			observations = append(observations, MatrixObservation{
+				Cell: [2]int{i, 0},
+				Frame: frame,
+				Value: float64(i+1),
+			})
+		}
+	}
+	return Matrix{GridSize: 32, Observations: observations}
+}
+
+func runSimulateTest(t *testing.T, operands string) (SimulationResult, Matrix) {
+	args, outDir := makeMatrixArgs(t, []Matrix{makeSimulateTestMatrix()}, operands)
+	if err := SimulateOp(args, outDir); err != nil {
+		t.Fatal(err)
+	}
+	bytes, err := ioutil.ReadFile(filepath.Join(outDir, "simulation.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result SimulationResult
+	if err := json.Unmarshal(bytes, &result); err != nil {
+		t.Fatal(err)
+	}
+	matrix, err := LoadMatrix(outDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result, matrix
+}
+
+func getSimulationObserved(result SimulationResult) [][][2]int {
+	var observed [][][2]int
+	for _, step := range result.Steps {
+		observed = append(observed, step.Observed)
+	}
+	return observed
+}
+
+func TestSimulateRoundRobin(t *testing.T) {
+	result, matrix := runSimulateTest(t, `{"Frequency": 1, "Model": "ewma", "Policy": "round_robin"}`)
+	expected := [][][2]int{{{0, 0}}, {{1, 0}}, {{2, 0}}}
+	if observed := getSimulationObserved(result); !reflect.DeepEqual(observed, expected) {
+		t.Fatalf("expected round robin to observe %v, got %v", expected, observed)
+	}
+
+	// Unobserved cells are predicted as zero, and observed cells as their
+	// last value, so the absolute errors are 2+3 at interval 0, 3 at interval
+	// 1, and none at interval 2.
+	expectedMAE := []float64{5.0/3, 1, 0}
+	expectedRMSE := []float64{math.Sqrt(13.0/3), math.Sqrt(3), 0}
+	for i, step := range result.Steps {
+		if math.Abs(step.MAE - expectedMAE[i]) > 1e-9 || math.Abs(step.RMSE - expectedRMSE[i]) > 1e-9 {
+			t.Errorf("interval %d: expected MAE %v and RMSE %v, got %v and %v", i, expectedMAE[i], expectedRMSE[i], step.MAE, step.RMSE)
+		}
+	}
+	if math.Abs(result.MAE - 8.0/9) > 1e-9 || math.Abs(result.RMSE - math.Sqrt(22.0/9)) > 1e-9 {
+		t.Errorf("expected overall MAE 8/9 and RMSE sqrt(22/9), got %v and %v", result.MAE, result.RMSE)
+	}
+
+	// Observed cells are reconstructed exactly.
+	for _, obs := range matrix.Observations {
+		if obs.Get("observed") != 1 {
+			continue
+		}
+		if obs.Value != obs.Get("truth") {
+			t.Errorf("observed cell %+v does not match the ground truth", obs)
+		}
+		if obs.Cell[0] != obs.Frame {
+			t.Errorf("unexpected observation of cell %v at frame %d", obs.Cell, obs.Frame)
+		}
+	}
+}
+
+func TestSimulatePriorities(t *testing.T) {
+	// With the predicted value as the rate, unobserved cells (predicted as
+	// zero) never gain priority, so the first cell is observed every time.
+	result, _ := runSimulateTest(t, `{"Frequency": 1, "Model": "ewma", "Priorities": {"Channel": "value"}}`)
+	expected := [][][2]int{{{0, 0}}, {{0, 0}}, {{0, 0}}}
+	if observed := getSimulationObserved(result); !reflect.DeepEqual(observed, expected) {
+		t.Fatalf("expected priorities to observe %v, got %v", expected, observed)
+	}
+	if math.Abs(result.MAE - 15.0/9) > 1e-9 {
+		t.Errorf("expected overall MAE 15/9, got %v", result.MAE)
+	}
+}
+
+func TestSimulateRandom(t *testing.T) {
+	operands := `{"Frequency": 1, "Model": "ewma", "Policy": "random", "CellsPerInterval": 2, "Seed": 7}`
+	result, _ := runSimulateTest(t, operands)
+	for _, step := range result.Steps {
+		if len(step.Observed) != 2 || step.Observed[0] == step.Observed[1] {
+			t.Errorf("interval %d: expected two distinct cells, got %v", step.Interval, step.Observed)
+		}
+	}
+	again, _ := runSimulateTest(t, operands)
+	if !reflect.DeepEqual(getSimulationObserved(result), getSimulationObserved(again)) {
+		t.Errorf("expected the same observations with the same seed")
+	}
+}
+
+func TestSimulateOperands(t *testing.T) {
+	for _, operands := range []string{
+		`{"Frequency": 0, "Model": "ewma"}`,
+		`{"Frequency": 1, "Model": "ewma", "Policy": "unknown"}`,
+		`{"Frequency": 1, "Model": "ewma", "Confidence": 1.5}`,
+		`{"Frequency": 1, "Model": "cyclic"}`,
+	} {
+		args, outDir := makeMatrixArgs(t, []Matrix{makeSimulateTestMatrix()}, operands)
+		if err := SimulateOp(args, outDir); err == nil {
+			t.Errorf("expected error for operands %s", operands)
+		}
+	}
+}
@@ -8,8 +8,7 @@ import (
 	"io/ioutil"
 	"math"
 	"path/filepath"
-	"strconv"
-	"strings"
+	"sort"
 )
 
 type Frame [][2]float64
@@ -22,23 +21,11 @@ func (f Frame) Polygon() common.Polygon {
 	return poly
 }
 
-type MatrixObservation struct {
-	Cell [2]int
-	Frame int
-	Value int
-	Metadata string
-}
-
-type Matrix struct {
-	GridSize int
-	Observations []MatrixObservation
-}
-
 /*
 ToMatrix strategy:
 - This operator takes an aggregation function of the form:
-	func(cell, frame, sequences)
-  The function should return a value given the cell, frame, and sequences intersecting the cell.
+	func(ctx, prev, sequences)
+  The function should return a value given the cell (in ctx), the previous observation at the cell, and sequences intersecting the cell.
 - ToMatrix chooses which frame to use intelligently:
   * For each cell, we maintain a struct cellStatus{bestFrame, sequences, distance}.
   * We choose bestFrame based on maximizing the minimum distance from cell boundaries to the frame boundaries.
@@ -47,141 +34,321 @@ ToMatrix strategy:
   * The timestamp of the entry is the time when the cell leaves the field of view.
 */
 
-type ToMatrixAggFunc func(cell [2]int, prev int, metadata string, frame Frame, seqs []*Sequence) (int, string)
+type ToMatrixAggContext struct {
+	Cell [2]int
+	// The best frame of the cell, where the sequences were collected.
+	Frame Frame
+	// Frame index of the new observation.
+	FrameIdx int
+	// Number of frames that the cell was visible, and visible with some
+	// sequence in it, since the previous observation.
+	VisibleFrames int
+	OccupiedFrames int
+	// Returns the number of frames that the sequence spent in the cell over
+	// its entire lifetime.
+	TimeInCell func(seq *Sequence) int
+	// State of the cell that is kept across its observations.
+	State *ToMatrixCellState
+}
+
+// State that aggregation functions keep at a cell across observations, rather
+// than in the observations themselves. Fields are nil until set.
+type ToMatrixCellState struct {
+	// IDs of the sequences at the previous observation.
+	PrevIDs map[int]bool
+	// Values reduced so far, and the sequences that they came from, for
+	// ToMatrixAggSpec with Over "session".
+	Acc *Accumulator
+	Seen map[int]bool
+}
+
+// Aggregation functions return the new observation at a cell given the
+// previous observation there (zero-valued if there is none). Only the value
+// and channels of the returned observation are used.
+type ToMatrixAggFunc func(ctx ToMatrixAggContext, prev MatrixObservation, seqs []*Sequence) (MatrixObservation, error)
 var ToMatrixAggFuncs = map[string]ToMatrixAggFunc{
-	"count": func(cell [2]int, prev int, metadata string, frame Frame, seqs []*Sequence) (int, string) {
-		return len(seqs), ""
+	"count": func(ctx ToMatrixAggContext, prev MatrixObservation, seqs []*Sequence) (MatrixObservation, error) {
+		return MatrixObservation{Value: float64(len(seqs))}, nil
 	},
-	"count_sum": func(cell [2]int, prev int, metadata string, frame Frame, seqs []*Sequence) (int, string) {
-		return prev + len(seqs), ""
+	"count_sum": func(ctx ToMatrixAggContext, prev MatrixObservation, seqs []*Sequence) (MatrixObservation, error) {
+		return MatrixObservation{Value: prev.Value + float64(len(seqs))}, nil
 	},
-	"count_old_sum": func(cell [2]int, prev int, metadata string, frame Frame, seqs []*Sequence) (int, string) {
-		var prevIDs []int
-		JsonUnmarshal([]byte(metadata), &prevIDs)
-		prevIDSet := make(map[int]bool)
-		for _, id := range prevIDs {
-			prevIDSet[id] = true
-		}
-		var curIDs []int
-		curIDSet := make(map[int]bool)
-		var countNew int
+	"count_old_sum": func(ctx ToMatrixAggContext, prev MatrixObservation, seqs []*Sequence) (MatrixObservation, error) {
+		return MatrixObservation{Value: prev.Value + float64(countDepartures(ctx.State, seqs))}, nil
+	},
+	// The speed aggregators use pixels per frame (see getSequenceFrameSpeed).
+	// For pixels per second, use {"Agg": "mean", "Of": "speed"}.
+	"avg_speed": func(ctx ToMatrixAggContext, prev MatrixObservation, seqs []*Sequence) (MatrixObservation, error) {
+		sum := prev.Get("sum")
+		count := prev.Get("count")
 		for _, seq := range seqs {
-			curIDs = append(curIDs, seq.ID)
-			curIDSet[seq.ID] = true
-			if !prevIDSet[seq.ID] {
-				countNew++
+			speed, ok := getSequenceFrameSpeed(seq)
+			if !ok {
+				continue
 			}
+			sum += speed
+			count++
 		}
-		var countOld int
-		for _, id := range prevIDs {
-			if !curIDSet[id] {
-				countOld++
-			}
+		obs := MatrixObservation{}
+		if count > 0 {
+			obs.Value = sum / count
 		}
-		return prev + countOld, string(JsonMarshal(curIDs))
+		obs.Set("sum", sum)
+		obs.Set("count", count)
+		return obs, nil
 	},
-	"avg_speed": func(cell [2]int, prev int, metadata string, frame Frame, seqs []*Sequence) (int, string) {
-		metaParts := strings.Split(metadata, ",")
-		var sum, count float64
-		if len(metaParts) == 2 {
-			sum, _ = strconv.ParseFloat(metaParts[0], 64)
-			count, _ = strconv.ParseFloat(metaParts[1], 64)
-		}
+	// Maximum speed of any sequence seen in the cell so far.
+	"max_speed": func(ctx ToMatrixAggContext, prev MatrixObservation, seqs []*Sequence) (MatrixObservation, error) {
+		obs := MatrixObservation{Value: prev.Value}
 		for _, seq := range seqs {
-			first := seq.Items[0]
-			last := seq.Items[len(seq.Items)-1]
-			if last.Frame-first.Frame <= 0 {
-				continue
+			speed, ok := getSequenceFrameSpeed(seq)
+			if ok && speed > obs.Value {
+				obs.Value = speed
 			}
-			d := first.Detection.Polygon().Bounds().Center().Distance(last.Detection.Polygon().Bounds().Center())
-			t := float64(last.Frame-first.Frame)
-			speed := d / t
-			sum += speed
-			count++
 		}
-		if count == 0 {
-			return 0, ""
-		} else {
-			return int(sum / count), fmt.Sprintf("%v,%v", sum, count)
+		return obs, nil
+	},
+	"median_speed": percentileSpeedFunc(50),
+	"p85_speed": percentileSpeedFunc(85),
+	// Mean time in seconds that the sequences in the cell spend in the cell,
+	// with the longest time in the "max" channel.
+	"dwell_time": func(ctx ToMatrixAggContext, prev MatrixObservation, seqs []*Sequence) (MatrixObservation, error) {
+		var obs MatrixObservation
+		var sum, max float64
+		for _, seq := range seqs {
+			t := float64(ctx.TimeInCell(seq)) / FramesPerSecond
+			sum += t
+			max = math.Max(max, t)
+		}
+		if len(seqs) > 0 {
+			obs.Value = sum / float64(len(seqs))
+		}
+		obs.Set("max", max)
+		obs.Set("count", float64(len(seqs)))
+		return obs, nil
+	},
+	// Fraction of the time that the cell was visible during which it was
+	// occupied, with the total times in seconds in the "observed" and
+	// "occupied" channels.
+	"occupancy": func(ctx ToMatrixAggContext, prev MatrixObservation, seqs []*Sequence) (MatrixObservation, error) {
+		observed := prev.Get("observed") + float64(ctx.VisibleFrames) / FramesPerSecond
+		occupied := prev.Get("occupied") + float64(ctx.OccupiedFrames) / FramesPerSecond
+		var obs MatrixObservation
+		if observed > 0 {
+			obs.Value = occupied / observed
 		}
+		obs.Set("observed", observed)
+		obs.Set("occupied", occupied)
+		return obs, nil
+	},
+	// Departures per hour since the first observation of the cell, where a
+	// sequence departs if it was in the cell at the previous observation but
+	// not this one. The total is in the "departures" channel, and the frame of
+	// the first observation in the "start" channel.
+	"turnover": func(ctx ToMatrixAggContext, prev MatrixObservation, seqs []*Sequence) (MatrixObservation, error) {
+		countOld := countDepartures(ctx.State, seqs)
+		start := float64(ctx.FrameIdx)
+		if prev.Channels != nil {
+			start = prev.Get("start")
+		}
+		departures := prev.Get("departures") + float64(countOld)
+		obs := MatrixObservation{}
+		hours := (float64(ctx.FrameIdx) - start) / FramesPerSecond / 3600
+		if hours > 0 {
+			obs.Value = departures / hours
+		}
+		obs.Set("departures", departures)
+		obs.Set("start", start)
+		return obs, nil
 	},
 }
 
-func ToCell(p common.Point, gridSize float64) [2]int {
-	return [2]int{
-		int(math.Floor(p.X / gridSize)),
-		int(math.Floor(p.Y / gridSize)),
+// Returns the number of sequences at the previous observation of the cell that
+// are not in seqs, and records seqs in the cell state for the next observation.
+func countDepartures(state *ToMatrixCellState, seqs []*Sequence) int {
+	curIDs := make(map[int]bool)
+	for _, seq := range seqs {
+		curIDs[seq.ID] = true
+	}
+	var countOld int
+	for id := range state.PrevIDs {
+		if !curIDs[id] {
+			countOld++
+		}
 	}
+	state.PrevIDs = curIDs
+	return countOld
 }
 
-func GetCellRect(cell [2]int, gridSize float64) common.Rectangle {
-	cellPoint := common.Point{float64(cell[0]), float64(cell[1])}
-	return common.Rectangle{
-		cellPoint.Scale(gridSize),
-		cellPoint.Add(common.Point{1, 1}).Scale(gridSize),
+// Returns the average speed of the sequence in pixels per frame, from its
+// first detection to its last, or false if it spans only one frame. avg_speed
+// has always used pixels per frame, unlike Sequence.Speed.
+func getSequenceFrameSpeed(seq *Sequence) (float64, bool) {
+	first := seq.Items[0]
+	last := seq.Items[len(seq.Items)-1]
+	if last.Frame-first.Frame <= 0 {
+		return 0, false
 	}
+	d := first.Detection.Polygon().Bounds().Center().Distance(last.Detection.Polygon().Bounds().Center())
+	return d / float64(last.Frame-first.Frame), true
 }
 
-func IsCellInFrame(cell [2]int, frame Frame, gridSize float64) bool {
-	cellRect := GetCellRect(cell, gridSize)
-	for _, p := range cellRect.ToPolygon() {
-		if !frame.Polygon().Contains(p) {
-			return false
+// Returns an aggregation function that computes the given percentile of the
+// speeds of the sequences in the cell at each observation.
+func percentileSpeedFunc(percentile float64) ToMatrixAggFunc {
+	return func(ctx ToMatrixAggContext, prev MatrixObservation, seqs []*Sequence) (MatrixObservation, error) {
+		acc := Accumulator{KeepValues: true}
+		for _, seq := range seqs {
+			speed, ok := getSequenceFrameSpeed(seq)
+			if ok {
+				acc.Add(speed)
+			}
 		}
+		obs := MatrixObservation{Value: acc.Percentile(percentile)}
+		obs.Set("count", float64(acc.Count))
+		return obs, nil
 	}
-	return true
 }
 
-// Returns map from cells visible in current frame to the distances from
-// those cells to the frame boundaries
-func GetCellsInFrame(frame Frame, gridSize float64) map[[2]int]float64 {
-	frameRect := frame.Polygon().Bounds()
-	startCell := ToCell(frameRect.Min, gridSize)
-	endCell := ToCell(frameRect.Max, gridSize)
-	frameCells := make(map[[2]int]float64)
-	processCell := func(cell [2]int) {
-		if !IsCellInFrame(cell, frame, gridSize) {
-			return
+// Declarative aggregation, e.g.
+//	{"Agg": "mean", "Of": "speed", "Where": "duration > 10", "Over": "session"}
+// Of and Where are expressions (see ParseExpr) over the sequence metrics in
+// SelectFuncs, and time_in_cell, the seconds that the sequence spends in the
+// cell. Of defaults to 1, so e.g. {"Agg": "count", "Where": ...} counts the
+// matching sequences.
+//
+// Agg is a reducer (see GetReducer) over the values of Of for sequences in the
+// cell that satisfy Where. With Over "observation" (default), only sequences
+// at the current observation are used; with Over "session", we reduce over
+// every sequence seen in the cell so far, counting each sequence once.
+type ToMatrixAggSpec struct {
+	Agg string
+	Of string
+	Where string
+	Over string
+}
+
+// Returns an aggregation function that implements the spec. The number of
+// values reduced is stored in the "count" channel.
+func (spec ToMatrixAggSpec) AggFunc() (ToMatrixAggFunc, error) {
+	reducer, err := GetReducer(spec.Agg)
+	if err != nil {
+		return nil, err
+	}
+	if spec.Of == "" {
+		spec.Of = "1"
+	}
+	of, err := ParseExpr(spec.Of)
+	if err != nil {
+		return nil, err
+	}
+	var where Expr
+	if spec.Where != "" {
+		where, err = ParseExpr(spec.Where)
+		if err != nil {
+			return nil, err
 		}
-		cellRect := GetCellRect(cell, gridSize)
-		var worstDistance float64 = -1
-		for _, cellSegment := range cellRect.ToPolygon().Segments() {
-			for _, frameSegment := range frame.Polygon().Segments() {
-				d := cellSegment.DistanceToSegment(frameSegment)
-				if worstDistance == -1 || d < worstDistance {
-					worstDistance = d
-				}
+	}
+	if spec.Over == "" {
+		spec.Over = "observation"
+	}
+	if spec.Over != "observation" && spec.Over != "session" {
+		return nil, fmt.Errorf("unknown aggregation range %s", spec.Over)
+	}
+
+	// Check the variables up front so that errors don't surface at the first
+	// non-empty cell.
+	exprs := []Expr{of}
+	if where != nil {
+		exprs = append(exprs, where)
+	}
+	for _, expr := range exprs {
+		for _, name := range expr.Vars() {
+			if name != "time_in_cell" && SelectFuncs[name] == nil {
+				return nil, fmt.Errorf("no such sequence metric %s", name)
 			}
 		}
-		frameCells[cell] = worstDistance
 	}
-	for i := startCell[0]; i <= endCell[0]; i++ {
-		for j := startCell[1]; j <= endCell[1]; j++ {
-			processCell([2]int{i, j})
+
+	return func(ctx ToMatrixAggContext, prev MatrixObservation, seqs []*Sequence) (MatrixObservation, error) {
+		state := ctx.State
+		if state.Acc == nil || spec.Over == "observation" {
+			state.Acc = &Accumulator{KeepValues: reducer.NeedsValues}
+			state.Seen = make(map[int]bool)
 		}
-	}
-	return frameCells
+		for _, seq := range seqs {
+			if state.Seen[seq.ID] {
+				continue
+			}
+			state.Seen[seq.ID] = true
+			vars := func(name string) (float64, error) {
+				if name == "time_in_cell" {
+					return float64(ctx.TimeInCell(seq)) / FramesPerSecond, nil
+				}
+				return SelectFuncs[name](seq), nil
+			}
+			if where != nil {
+				ok, err := where.Eval(vars)
+				if err != nil {
+					return MatrixObservation{}, fmt.Errorf("error evaluating %s for sequence %d: %v", spec.Where, seq.ID, err)
+				} else if ok == 0 {
+					continue
+				}
+			}
+			v, err := of.Eval(vars)
+			if err != nil {
+				return MatrixObservation{}, fmt.Errorf("error evaluating %s for sequence %d: %v", spec.Of, seq.ID, err)
+			}
+			state.Acc.Add(v)
+		}
+		obs := MatrixObservation{}
+		if state.Acc.Count > 0 {
+			obs.Value = reducer.Reduce(state.Acc)
+		}
+		obs.Set("count", float64(state.Acc.Count))
+		return obs, nil
+	}, nil
 }
 
 func ToMatrixOp(args []OpArgument, outDir string) error {
 	// Parse arguments.
 	var operands struct {
 		Func string
+		ToMatrixAggSpec
 		GridSize int
+		// Defaults to a square grid with GridSize.
+		Tessellation TessellationSpec
 		IgnoreZero bool
 		UnionSeqs bool
 	}
-	err := json.Unmarshal([]byte(args[1].String), &operands)
+	// With three arguments, the second argument is a zone table, and we
+	// aggregate per zone instead of per grid cell.
+	operandsArg := args[len(args)-1].String
+	err := json.Unmarshal([]byte(operandsArg), &operands)
 	if err != nil {
-		return fmt.Errorf("error decoding operands %s: %v", args[1].String, err)
-	}
-	if operands.Func == "" {
-		operands.Func = "count"
+		return fmt.Errorf("error decoding operands %s: %v", operandsArg, err)
 	}
 	if operands.GridSize == 0 {
 		operands.GridSize = 32
 	}
-	aggFunc := ToMatrixAggFuncs[operands.Func]
+	var aggFunc ToMatrixAggFunc
+	if operands.Agg != "" {
+		if operands.Func != "" {
+			return fmt.Errorf("only one of Func and Agg can be set")
+		}
+		aggFunc, err = operands.ToMatrixAggSpec.AggFunc()
+		if err != nil {
+			return err
+		}
+	} else {
+		if operands.Func == "" {
+			operands.Func = "count"
+		}
+		aggFunc = ToMatrixAggFuncs[operands.Func]
+		if aggFunc == nil {
+			return fmt.Errorf("no such aggregation func %s", operands.Func)
+		}
+	}
 
 	// Load the input sequences.
 	var sequences []*Sequence
@@ -204,6 +371,53 @@ func ToMatrixOp(args []OpArgument, outDir string) error {
 		return fmt.Errorf("error decoding frame bounds: %v", err)
 	}
 
+	// Set up the tessellation. Cells are either in the tessellation from the
+	// operands, or zones where the cell is [zone index, 0].
+	var zones []Zone
+	var tessellationSpec *TessellationSpec
+	var tessellation Tessellation
+	if len(args) == 3 {
+		zones, err = LoadZones(args[1].DirName)
+		if err != nil {
+			return err
+		}
+		tessellation = ZoneTessellation(zones)
+	} else {
+		spec := operands.Tessellation
+		if spec.Size == 0 {
+			spec.Size = operands.GridSize
+		}
+		if spec.Type == "quadtree" && spec.Leaves == nil {
+			if spec.Depth == 0 {
+				var maxCoordinate float64
+				for _, frame := range frames {
+					for _, p := range frame {
+						maxCoordinate = math.Max(maxCoordinate, math.Max(p[0], p[1]))
+					}
+				}
+				for spec.Depth <= MaxQuadtreeDepth && float64(spec.Size) * math.Pow(2, float64(spec.Depth)) <= maxCoordinate {
+					spec.Depth++
+				}
+			}
+			if err := spec.Validate(); err != nil {
+				return err
+			}
+			var points []common.Point
+			for _, seq := range sequences {
+				for _, item := range seq.Items {
+					points = append(points, item.Detection.Polygon().Bounds().Center())
+				}
+			}
+			spec = BuildQuadtree(spec, points)
+		}
+		tessellation, err = spec.Tessellation()
+		if err != nil {
+			return err
+		}
+		tessellationSpec = &spec
+		operands.GridSize = spec.Size
+	}
+
 	// Status is used to select the best frame for each cell, where the cell
 	// is closest to the center.
 	type cellStatus struct {
@@ -213,60 +427,109 @@ func ToMatrixOp(args []OpArgument, outDir string) error {
 	}
 	cellStatuses := make(map[[2]int]*cellStatus)
 
+	// Number of frames that each cell was visible, and visible and occupied,
+	// since its previous observation.
+	visibleFrames := make(map[[2]int]int)
+	occupiedFrames := make(map[[2]int]int)
+	// State kept by the aggregation function at each cell.
+	cellStates := make(map[[2]int]*ToMatrixCellState)
+
+	// Returns the number of frames that a sequence spends in a cell. We compute
+	// the time in every cell when a sequence is first needed.
+	timesInCells := make(map[int]map[[2]int]int)
+	timeInCell := func(seq *Sequence, cell [2]int) int {
+		if timesInCells[seq.ID] == nil {
+			times := make(map[[2]int]int)
+			for frameIdx := seq.Items[0].Frame; frameIdx <= seq.Items[len(seq.Items)-1].Frame; frameIdx++ {
+				location := seq.LocationAt(frameIdx)
+				if location == nil {
+					continue
+				}
+				for _, cell := range tessellation.CellsContaining(*location) {
+					times[cell]++
+				}
+			}
+			timesInCells[seq.ID] = times
+		}
+		return timesInCells[seq.ID][cell]
+	}
+
 	// Gets sequences that are inside a given cell.
-	// seqLocations contains the point of each sequence at the current timestep.
-	getRelevantSequences := func(seqs []*Sequence, cell [2]int, seqLocations map[int]*common.Point) map[int]*Sequence {
-		cellRect := GetCellRect(cell, float64(operands.GridSize))
+	// seqIndex maps from cells to the sequences located in that cell at the current timestep.
+	getRelevantSequences := func(cell [2]int, seqIndex map[[2]int][]*Sequence) map[int]*Sequence {
 		relevantSeqs := make(map[int]*Sequence)
-		for _, seq := range seqs {
-			location := seqLocations[seq.ID]
-			if location == nil {
-				continue
-			}
-			if !cellRect.Contains(*location) {
-				continue
-			}
+		for _, seq := range seqIndex[cell] {
 			relevantSeqs[seq.ID] = seq
 		}
 		return relevantSeqs
 	}
 
-	frameSequences := make([][]*Sequence, len(frames))
-	for _, seq := range sequences {
-		for frameIdx := seq.Items[0].Frame; frameIdx <= seq.Items[len(seq.Items)-1].Frame; frameIdx++ {
-			frameSequences[frameIdx] = append(frameSequences[frameIdx], seq)
-		}
-	}
+	// Order sequences by their first frame so that we can sweep over the
+	// frames and maintain the set of sequences active at each frame. We sort a
+	// copy so that the loaded order is kept for anything else that uses it.
+	sequences = append([]*Sequence{}, sequences...)
+	sort.Slice(sequences, func(i, j int) bool {
+		return sequences[i].Items[0].Frame < sequences[j].Items[0].Frame
+	})
+	var seqs []*Sequence
+	inputSeqCounter := 0
+
 	matrixObservations := []MatrixObservation{}
 	curObservations := make(map[[2]int]*MatrixObservation)
 
 	// Build matrix.
 	for frameIdx, frame := range frames {
-		seqs := frameSequences[frameIdx]
-		frameCells := GetCellsInFrame(frame, float64(operands.GridSize))
+		// update the active sequences for this frame
+		activeSeqs := seqs[:0]
+		for _, seq := range seqs {
+			if seq.Items[len(seq.Items)-1].Frame < frameIdx {
+				continue
+			}
+			activeSeqs = append(activeSeqs, seq)
+		}
+		seqs = activeSeqs
+		for ; inputSeqCounter < len(sequences) && sequences[inputSeqCounter].Items[0].Frame <= frameIdx; inputSeqCounter++ {
+			seq := sequences[inputSeqCounter]
+			if seq.Items[len(seq.Items)-1].Frame < frameIdx {
+				continue
+			}
+			seqs = append(seqs, seq)
+		}
+
+		frameCells := GetCellsInFrame(tessellation, frame)
 
-		// get location of sequences at this frame
-		seqLocations := make(map[int]*common.Point)
+		// index the location of sequences at this frame by cell
+		seqIndex := make(map[[2]int][]*Sequence)
 		for _, seq := range seqs {
-			seqLocations[seq.ID] = seq.LocationAt(frameIdx)
+			location := seq.LocationAt(frameIdx)
+			if location == nil {
+				continue
+			}
+			for _, cell := range tessellation.CellsContaining(*location) {
+				seqIndex[cell] = append(seqIndex[cell], seq)
+			}
 		}
 
-		fmt.Printf("[to_matrix] got %d cells in frame with %d seq locations, %d seqs\n", len(frameCells), len(seqLocations), len(seqs))
+		fmt.Printf("[to_matrix] got %d cells in frame with %d occupied cells, %d seqs\n", len(frameCells), len(seqIndex), len(seqs))
 
 		// update cell status based on frameCells
 		for cell, distance := range frameCells {
+			visibleFrames[cell]++
+			if len(seqIndex[cell]) > 0 {
+				occupiedFrames[cell]++
+			}
 			status := cellStatuses[cell]
 			// If existing cellStatus has higher distance to frame bounds, then retain it.
 			if status != nil && status.distance > distance {
 				if operands.UnionSeqs {
-					relevantSeqs := getRelevantSequences(seqs, cell, seqLocations)
+					relevantSeqs := getRelevantSequences(cell, seqIndex)
 					for _, seq := range relevantSeqs {
 						cellStatuses[cell].sequences[seq.ID] = seq
 					}
 				}
 				continue
 			}
-			relevantSeqs := getRelevantSequences(seqs, cell, seqLocations)
+			relevantSeqs := getRelevantSequences(cell, seqIndex)
 			if operands.IgnoreZero && len(relevantSeqs) == 0 {
 				continue
 			}
@@ -288,45 +551,62 @@ func ToMatrixOp(args []OpArgument, outDir string) error {
 				continue
 			}
 			fmt.Printf("[to_matrix] frame %d: adding observation at cell %v\n", frameIdx, cell)
-			prevObs := curObservations[cell]
-			var prev int = 0
-			var metadata string
-			if prevObs != nil {
-				prev = prevObs.Value
-				metadata = prevObs.Metadata
+			var prev MatrixObservation
+			if curObservations[cell] != nil {
+				prev = *curObservations[cell]
 			}
 			var sequences []*Sequence
 			for _, seq := range status.sequences {
 				sequences = append(sequences, seq)
 			}
-			val, metadata := aggFunc(cell, prev, metadata, status.bestFrame, sequences)
-			obs := MatrixObservation{
+			ctx := ToMatrixAggContext{
 				Cell: cell,
-				Frame: frameIdx,
-				Value: val,
-				Metadata: metadata,
+				Frame: status.bestFrame,
+				FrameIdx: frameIdx,
+				VisibleFrames: visibleFrames[cell],
+				OccupiedFrames: occupiedFrames[cell],
+				TimeInCell: func(seq *Sequence) int {
+					return timeInCell(seq, cell)
+				},
+				State: cellStates[cell],
 			}
+			if ctx.State == nil {
+				ctx.State = &ToMatrixCellState{}
+				cellStates[cell] = ctx.State
+			}
+			obs, err := aggFunc(ctx, prev, sequences)
+			if err != nil {
+				return fmt.Errorf("at cell %v: %v", cell, err)
+			}
+			obs.Cell = cell
+			obs.Frame = frameIdx
 			curObservations[cell] = &obs
 			matrixObservations = append(matrixObservations, obs)
 			delete(cellStatuses, cell)
 		}
+
+		// reset visibility counts of cells that left, including those skipped
+		// by IgnoreZero
+		for cell := range visibleFrames {
+			if _, ok := frameCells[cell]; ok {
+				continue
+			}
+			delete(visibleFrames, cell)
+			delete(occupiedFrames, cell)
+		}
 	}
 
 	matrix := Matrix{
 		GridSize: operands.GridSize,
+		Zones: zones,
+		Tessellation: tessellationSpec,
 		Observations: matrixObservations,
 	}
-	bytes, err = json.Marshal(matrix)
-	if err != nil {
-		return err
-	}
-	if err := ioutil.WriteFile(filepath.Join(outDir, "matrix.json"), bytes, 0644); err != nil {
-		return err
-	}
-	return nil
+	return WriteMatrix(outDir, matrix)
 }
 
 
 func init() {
 	Ops["ToMatrix"] = ToMatrixOp
+	OpSignatures["ToMatrix"] = OpSignature{MinArgs: 2, MaxArgs: 3, JSONOperands: true}
 }
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"github.com/mitroadmaps/gomapinfer/common"
+
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A synthetic long video: the camera pans right two pixels per frame over
+// a 640x480 field of view, and objects appear at random times and drift
+// slowly.
+func makeLongVideo(numFrames int, numSequences int) ([]Frame, []*Sequence) {
+	frames := make([]Frame, numFrames)
+	for i := range frames {
+		x := float64(2*i)
+		frames[i] = Frame{{x, 0}, {x+640, 0}, {x+640, 480}, {x, 480}}
+	}
+	r := rand.New(rand.NewSource(1))
+	sequences := make([]*Sequence, numSequences)
+	for id := range sequences {
+		start := r.Intn(numFrames)
+		length := 100 + r.Intn(400)
+		x := 2*start + r.Intn(640)
+		y := r.Intn(480)
+		dx, dy := r.Intn(3)-1, r.Intn(3)-1
+		seq := &Sequence{ID: id}
+		for frame := start; frame < start+length && frame < numFrames; frame++ {
+			seq.Items = append(seq.Items, SequenceItem{
+				Detection: Detection{Points: [][2]int{{x, y}, {x+10, y}, {x+10, y+10}, {x, y+10}}},
+				Frame: frame,
+			})
+			x += dx
+			y += dy
+		}
+		sequences[id] = seq
+	}
+	return frames, sequences
+}
+
+// Returns the cells visible in each frame, which both ways of finding the
+// sequences in cells need.
+func getFrameCells(tessellation Tessellation, frames []Frame) []map[[2]int]float64 {
+	frameCells := make([]map[[2]int]float64, len(frames))
+	for i, frame := range frames {
+		frameCells[i] = GetCellsInFrame(tessellation, frame)
+	}
+	return frameCells
+}
+
+// Returns the active sequences at each frame.
+func getActiveSequences(frames []Frame, sequences []*Sequence) [][]*Sequence {
+	active := make([][]*Sequence, len(frames))
+	for _, seq := range sequences {
+		for frame := seq.Items[0].Frame; frame <= seq.Items[len(seq.Items)-1].Frame; frame++ {
+			active[frame] = append(active[frame], seq)
+		}
+	}
+	return active
+}
+
+// Benchmarks finding the sequences in each visible cell with the per-frame
+// cell index that ToMatrix builds.
+func BenchmarkToMatrixCellIndex(b *testing.B) {
+	frames, sequences := makeLongVideo(2000, 500)
+	active := getActiveSequences(frames, sequences)
+	tessellation := SquareTessellation{Size: 32}
+	frameCells := getFrameCells(tessellation, frames)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for frameIdx := range frames {
+			seqIndex := make(map[[2]int][]*Sequence)
+			for _, seq := range active[frameIdx] {
+				location := seq.LocationAt(frameIdx)
+				if location == nil {
+					continue
+				}
+				for _, cell := range tessellation.CellsContaining(*location) {
+					seqIndex[cell] = append(seqIndex[cell], seq)
+				}
+			}
+			for cell := range frameCells[frameIdx] {
+				_ = seqIndex[cell]
+			}
+		}
+	}
+}
+
+// Benchmarks finding the sequences in each visible cell by scanning all active
+// sequences for each cell, as ToMatrix did before the cell index.
+func BenchmarkToMatrixCellScan(b *testing.B) {
+	frames, sequences := makeLongVideo(2000, 500)
+	active := getActiveSequences(frames, sequences)
+	tessellation := SquareTessellation{Size: 32}
+	frameCells := getFrameCells(tessellation, frames)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for frameIdx := range frames {
+			locations := make(map[int]*common.Point)
+			for _, seq := range active[frameIdx] {
+				locations[seq.ID] = seq.LocationAt(frameIdx)
+			}
+			for cell := range frameCells[frameIdx] {
+				rect := GetCellRect(cell, tessellation.Size)
+				var relevant []*Sequence
+				for _, seq := range active[frameIdx] {
+					if location := locations[seq.ID]; location != nil && rect.Contains(*location) {
+						relevant = append(relevant, seq)
+					}
+				}
+			}
+		}
+	}
+}
+
+// Benchmarks the whole ToMatrix operation on a long video.
+func BenchmarkToMatrixOp(b *testing.B) {
+	frames, sequences := makeLongVideo(2000, 500)
+	dataDir := b.TempDir()
+	inputDir := filepath.Join(dataDir, "input")
+	if err := os.Mkdir(inputDir, 0755); err != nil {
+		b.Fatal(err)
+	}
+	writeJSON := func(fname string, x interface{}) {
+		bytes, err := json.Marshal(x)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fname, bytes, 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+	writeJSON(filepath.Join(dataDir, "align-out.json"), frames)
+	writeJSON(filepath.Join(inputDir, "sequences.json"), sequences)
+	Config.DataDir = dataDir
+	args := []OpArgument{
+		{Type: "node", DirName: inputDir},
+		{Type: "string", String: `{"Func": "count", "GridSize": 32}`},
+	}
+
+	// ToMatrix logs every frame, so discard stdout while it runs.
+	stdout := os.Stdout
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	os.Stdout = devNull
+	defer func() {
+		os.Stdout = stdout
+		devNull.Close()
+	}()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		outDir := filepath.Join(dataDir, "out")
+		os.RemoveAll(outDir)
+		if err := os.Mkdir(outDir, 0755); err != nil {
+			b.Fatal(err)
+		}
+		if err := ToMatrixOp(args, outDir); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestCountOldSum(t *testing.T) {
+	aggFunc := ToMatrixAggFuncs["count_old_sum"]
+	state := &ToMatrixCellState{}
+	var prev MatrixObservation
+	// Sequences 1 and 2 are in the cell, then 2 and 3, then none.
+	for i, ids := range [][]int{{1, 2}, {2, 3}, {}} {
+		var seqs []*Sequence
+		for _, id := range ids {
+			seqs = append(seqs, &Sequence{ID: id})
+		}
+		obs, err := aggFunc(ToMatrixAggContext{State: state}, prev, seqs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []float64{0, 1, 3}[i]
+		if obs.Value != expected || obs.Metadata != "" {
+			t.Errorf("observation %d: expected %v departures, got %v (metadata %q)", i, expected, obs.Value, obs.Metadata)
+		}
+		prev = obs
+	}
+}
+
+func TestAggSpecEvalError(t *testing.T) {
+	aggFunc, err := ToMatrixAggSpec{Agg: "sum", Of: "min()"}.AggFunc()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq := &Sequence{ID: 1, Items: []SequenceItem{{Frame: 0}}}
+	if _, err := aggFunc(ToMatrixAggContext{State: &ToMatrixCellState{}}, MatrixObservation{}, []*Sequence{seq}); err == nil {
+		t.Error("expected evaluation error")
+	}
+}
+
+func TestSpeedUnits(t *testing.T) {
+	// Moves 30 pixels over 10 frames.
+	seq := &Sequence{ID: 1, Items: []SequenceItem{
+		{Detection: Detection{Points: [][2]int{{0, 0}, {10, 10}}}, Frame: 0},
+		{Detection: Detection{Points: [][2]int{{30, 0}, {40, 10}}}, Frame: 10},
+	}}
+	for _, name := range []string{"avg_speed", "max_speed", "median_speed"} {
+		obs, err := ToMatrixAggFuncs[name](ToMatrixAggContext{State: &ToMatrixCellState{}}, MatrixObservation{}, []*Sequence{seq})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if obs.Value != 3 {
+			t.Errorf("%s: expected 3 pixels per frame, got %v", name, obs.Value)
+		}
+	}
+	if speed := SelectFuncs["speed"](seq); speed != 3*FramesPerSecond {
+		t.Errorf("expected %v pixels per second, got %v", 3*FramesPerSecond, speed)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"path/filepath"
+	"sort"
 )
 
 type SequenceItem struct {
@@ -18,6 +19,21 @@ type SequenceItem struct {
 type Sequence struct {
 	ID int
 	Items []SequenceItem
+
+	// IDs of the input sequences that were merged into this sequence (if it is
+	// the output of Merge), and the corresponding merge decisions.
+	Parents []int `json:",omitempty"`
+	Merges []MergeDecision `json:",omitempty"`
+}
+
+// Records why Merge appended a parent sequence to an existing sequence.
+type MergeDecision struct {
+	Parent int
+	// Frame of the parent detection used for the comparison.
+	Frame int
+	Distance float64
+	// Only set in image_similarity mode.
+	Similarity *float64 `json:",omitempty"`
 }
 
 // Returns location of this sequence at specified time,
@@ -32,15 +48,13 @@ func (seq Sequence) LocationAt(t int) *common.Point {
 		p := seq.Items[0].Detection.Polygon().Bounds().Center()
 		return &p
 	}
-	var item1, item2 SequenceItem
-	for i := 0; i < len(seq.Items) - 1; i++ {
-		if seq.Items[i+1].Frame < t {
-			continue
-		}
-		item1 = seq.Items[i]
-		item2 = seq.Items[i+1]
-		break
-	}
+	// Binary search for the first pair of consecutive items whose second
+	// item is at or after the time.
+	i := sort.Search(len(seq.Items) - 1, func(i int) bool {
+		return seq.Items[i+1].Frame >= t
+	})
+	item1 := seq.Items[i]
+	item2 := seq.Items[i+1]
 	p1 := item1.Detection.Polygon().Bounds().Center()
 	p2 := item2.Detection.Polygon().Bounds().Center()
 	t1 := t - item1.Frame
@@ -55,6 +69,19 @@ func (seq Sequence) LocationAt(t int) *common.Point {
 	return &location
 }
 
+// Returns the average speed of the sequence in pixels per second, from its
+// first detection to its last, or false if it spans only one frame. This is
+// the speed used by Select, ToMatrix aggregation specs, and GetFeatures.
+func (seq Sequence) Speed() (float64, bool) {
+	first := seq.Items[0]
+	last := seq.Items[len(seq.Items)-1]
+	if last.Frame-first.Frame <= 0 {
+		return 0, false
+	}
+	d := first.Detection.Polygon().Bounds().Center().Distance(last.Detection.Polygon().Bounds().Center())
+	return d / (float64(last.Frame-first.Frame) / FramesPerSecond), true
+}
+
 func TrackOp(args []OpArgument, outDir string) error {
 	// Load the input detections.
 	var detections [][]Detection
@@ -179,4 +206,5 @@ func hungarianMatcher(sequences map[int]*Sequence, detections map[int]*Detection
 
 func init() {
 	Ops["Track"] = TrackOp
+	OpSignatures["Track"] = OpSignature{MinArgs: 1, MaxArgs: 1}
 }
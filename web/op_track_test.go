@@ -0,0 +1,97 @@
+package main
+
+import (
+	"github.com/mitroadmaps/gomapinfer/common"
+
+	"testing"
+)
+
+// Returns a sequence of a long video with numItems detections, one every
+// other frame, moving diagonally.
+func makeLongSequence(numItems int) Sequence {
+	seq := Sequence{ID: 1}
+	for i := 0; i < numItems; i++ {
+		x := i % 1000
+		seq.Items = append(seq.Items, SequenceItem{
+			Detection: Detection{Points: [][2]int{{x, x}, {x+10, x}, {x+10, x+10}, {x, x+10}}},
+			Frame: 2*i,
+		})
+	}
+	return seq
+}
+
+// The linear scan that LocationAt used before it was changed to a binary
+// search, as a reference for tests and benchmarks.
+func locationAtLinear(seq Sequence, t int) *common.Point {
+	if t < seq.Items[0].Frame || t > seq.Items[len(seq.Items)-1].Frame {
+		return nil
+	} else if len(seq.Items) == 1 {
+		p := seq.Items[0].Detection.Polygon().Bounds().Center()
+		return &p
+	}
+	var item1, item2 SequenceItem
+	for i := 0; i < len(seq.Items) - 1; i++ {
+		if seq.Items[i+1].Frame < t {
+			continue
+		}
+		item1 = seq.Items[i]
+		item2 = seq.Items[i+1]
+		break
+	}
+	p1 := item1.Detection.Polygon().Bounds().Center()
+	p2 := item2.Detection.Polygon().Bounds().Center()
+	t1 := t - item1.Frame
+	t2 := item2.Frame - t
+	if t1 == 0 {
+		return &p1
+	} else if t2 == 0 {
+		return &p2
+	}
+	v := p2.Sub(p1)
+	location := p1.Add(v.Scale(float64(t1) / float64(t1 + t2)))
+	return &location
+}
+
+func TestLocationAt(t *testing.T) {
+	seq := makeLongSequence(100)
+	for frame := -1; frame <= 200; frame++ {
+		got := seq.LocationAt(frame)
+		expected := locationAtLinear(seq, frame)
+		if (got == nil) != (expected == nil) || (got != nil && *got != *expected) {
+			t.Fatalf("at frame %d: expected %v, got %v", frame, expected, got)
+		}
+	}
+	single := makeLongSequence(1)
+	if p := single.LocationAt(0); p == nil || *p != (common.Point{5, 5}) {
+		t.Errorf("expected location of single detection, got %v", p)
+	}
+}
+
+// Benchmarks querying every frame of a sequence over a long video, as
+// ToMatrix does.
+func benchmarkLocationAt(b *testing.B, numItems int, f func(seq Sequence, t int) *common.Point) {
+	seq := makeLongSequence(numItems)
+	lastFrame := seq.Items[len(seq.Items)-1].Frame
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for frame := 0; frame <= lastFrame; frame++ {
+			f(seq, frame)
+		}
+	}
+}
+
+func BenchmarkLocationAt1000(b *testing.B) {
+	benchmarkLocationAt(b, 1000, Sequence.LocationAt)
+}
+
+func BenchmarkLocationAt10000(b *testing.B) {
+	benchmarkLocationAt(b, 10000, Sequence.LocationAt)
+}
+
+func BenchmarkLocationAtLinear1000(b *testing.B) {
+	benchmarkLocationAt(b, 1000, locationAtLinear)
+}
+
+func BenchmarkLocationAtLinear10000(b *testing.B) {
+	benchmarkLocationAt(b, 10000, locationAtLinear)
+}
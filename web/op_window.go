@@ -0,0 +1,381 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Window restricts a table to a time range, and optionally aggregates matrix
+observations into fixed time buckets. Example operands:
+	{"From": "07:00", "To": "09:00", "StartClock": "06:45"}
+	{"Last": "30m"}
+	{"Size": "15m", "Agg": "mean"}
+	{"Size": "1h", "Step": "15m", "Agg": "max"}
+
+Times can be specified as:
+- a frame index, e.g. "4500"
+- a duration since the start of the video, e.g. "15m" or "1h30m"
+- a clock time, e.g. "07:30", if StartClock is the clock time at frame 0
+
+For sequence tables, Mode selects which sequences are kept:
+- "overlap" (default): sequences whose span from the first to the last
+  detection overlaps the range, even if no detection is in the range
+- "within": sequences entirely in the range
+- "clip": sequences with some detection in the range, trimmed to the range
+Detection tables keep only the detections in the range.
+
+Matrix observations set the value of a cell until the next observation of
+the cell, so for each cell with an observation before the range, the latest
+one is carried forward to the first frame of the range.
+
+For matrices, if Size is set, we output for each cell and window the
+aggregate (Agg: mean, max, min, last, sum, or count) of that cell's
+observations in the window, at the last frame of the window. Only
+observations in the range are aggregated: nothing is carried forward, so
+that the first window's count and sum are not inflated. Windows are
+tumbling unless Step is set to a smaller value than Size. Only full windows
+are output, so observations after the last full window are dropped. Every
+channel is aggregated, and the number of observations is stored in the
+"samples" channel.
+*/
+
+// Converts a time specification into a frame index (see the Window comment).
+func ParseFrameSpec(s string, startClock string) (int, error) {
+	s = strings.TrimSpace(s)
+	if frameIdx, err := strconv.Atoi(s); err == nil {
+		return frameIdx, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return int(d.Seconds() * FramesPerSecond), nil
+	}
+	if strings.Contains(s, ":") {
+		if startClock == "" {
+			return 0, fmt.Errorf("clock time %s requires StartClock", s)
+		}
+		t, err := parseClock(s)
+		if err != nil {
+			return 0, err
+		}
+		start, err := parseClock(startClock)
+		if err != nil {
+			return 0, err
+		}
+		// Assume that clock times before the start are on the next day.
+		if t < start {
+			t += 24 * time.Hour
+		}
+		return int((t - start).Seconds() * FramesPerSecond), nil
+	}
+	return 0, fmt.Errorf("invalid time %s", s)
+}
+
+// Returns the time since midnight of a clock time like 07:30 or 07:30:15.
+func parseClock(s string) (time.Duration, error) {
+	for _, layout := range []string{"15:04:05", "15:04"} {
+		t, err := time.Parse(layout, s)
+		if err != nil {
+			continue
+		}
+		return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second, nil
+	}
+	return 0, fmt.Errorf("invalid clock time %s", s)
+}
+
+var WindowAggFuncs = map[string]func(values []float64) float64{
+	"mean": getMean,
+	"max": func(values []float64) float64 {
+		max := math.Inf(-1)
+		for _, v := range values {
+			max = math.Max(max, v)
+		}
+		return max
+	},
+	"min": func(values []float64) float64 {
+		min := math.Inf(1)
+		for _, v := range values {
+			min = math.Min(min, v)
+		}
+		return min
+	},
+	"last": func(values []float64) float64 {
+		return values[len(values)-1]
+	},
+	"sum": func(values []float64) float64 {
+		var sum float64
+		for _, v := range values {
+			sum += v
+		}
+		return sum
+	},
+	"count": func(values []float64) float64 {
+		return float64(len(values))
+	},
+}
+
+// Aggregates matrix observations in windows [start, start+size) for start in
+// from, from+step, ... while the window ends by to. Observations must already
+// be limited to the range and ordered by frame.
+func WindowMatrix(matrix Matrix, from int, to int, size int, step int, aggFunc func([]float64) float64) Matrix {
+	matrixObservations := []MatrixObservation{}
+	for start := from; start+size <= to; start += step {
+		end := start + size
+
+		// Collect the observations of each cell in this window.
+		cellObservations := make(map[[2]int][]MatrixObservation)
+		var cells [][2]int
+		i := sort.Search(len(matrix.Observations), func(i int) bool {
+			return matrix.Observations[i].Frame >= start
+		})
+		for ; i < len(matrix.Observations) && matrix.Observations[i].Frame < end; i++ {
+			obs := matrix.Observations[i]
+			if cellObservations[obs.Cell] == nil {
+				cells = append(cells, obs.Cell)
+			}
+			cellObservations[obs.Cell] = append(cellObservations[obs.Cell], obs)
+		}
+
+		for _, cell := range cells {
+			observations := cellObservations[cell]
+			channels := make(map[string]bool)
+			for _, obs := range observations {
+				for channel := range obs.Channels {
+					channels[channel] = true
+				}
+			}
+			aggregate := func(channel string) float64 {
+				var values []float64
+				for _, obs := range observations {
+					values = append(values, obs.Get(channel))
+				}
+				return aggFunc(values)
+			}
+			out := MatrixObservation{
+				Cell: cell,
+				Frame: end - 1,
+				Value: aggregate(ValueChannel),
+			}
+			for channel := range channels {
+				out.Set(channel, aggregate(channel))
+			}
+			out.Set("samples", float64(len(observations)))
+			matrixObservations = append(matrixObservations, out)
+		}
+	}
+	return Matrix{
+		GridSize: matrix.GridSize,
+		Zones: matrix.Zones,
+		Tessellation: matrix.Tessellation,
+		Observations: matrixObservations,
+	}
+}
+
+func WindowOp(args []OpArgument, outDir string) error {
+	// Parse arguments.
+	var operands struct {
+		From string
+		To string
+		// Restrict to this much time before the end of the video, e.g. "30m".
+		Last string
+		StartClock string
+
+		// Sequence filtering mode.
+		Mode string
+
+		// Matrix window size, step, and aggregation function.
+		Size string
+		Step string
+		Agg string
+	}
+	err := json.Unmarshal([]byte(args[1].String), &operands)
+	if err != nil {
+		return fmt.Errorf("error decoding operands %s: %v", args[1].String, err)
+	}
+	if operands.Mode == "" {
+		operands.Mode = "overlap"
+	}
+	if operands.Mode != "overlap" && operands.Mode != "within" && operands.Mode != "clip" {
+		return fmt.Errorf("unknown window mode %s", operands.Mode)
+	}
+	if operands.Agg == "" {
+		operands.Agg = "mean"
+	}
+
+	// Determine the frame range [from, to).
+	from := 0
+	to := math.MaxInt32
+	if operands.From != "" {
+		from, err = ParseFrameSpec(operands.From, operands.StartClock)
+		if err != nil {
+			return err
+		}
+	}
+	if operands.To != "" {
+		to, err = ParseFrameSpec(operands.To, operands.StartClock)
+		if err != nil {
+			return err
+		}
+	}
+	if operands.Last != "" {
+		var frames []Frame
+		bytes, err := ioutil.ReadFile(filepath.Join(Config.DataDir, "align-out.json"))
+		if err != nil {
+			return fmt.Errorf("error loading frame bounds: %v", err)
+		}
+		if err := json.Unmarshal(bytes, &frames); err != nil {
+			return fmt.Errorf("error decoding frame bounds: %v", err)
+		}
+		last, err := ParseFrameSpec(operands.Last, operands.StartClock)
+		if err != nil {
+			return err
+		}
+		if len(frames) - last > from {
+			from = len(frames) - last
+		}
+		if len(frames) < to {
+			to = len(frames)
+		}
+	}
+	inRange := func(frameIdx int) bool {
+		return frameIdx >= from && frameIdx < to
+	}
+
+	if _, err := os.Stat(filepath.Join(args[0].DirName, "matrix.json")); err == nil {
+		matrix, err := LoadMatrix(args[0].DirName)
+		if err != nil {
+			return err
+		}
+		sort.SliceStable(matrix.Observations, func(i, j int) bool {
+			return matrix.Observations[i].Frame < matrix.Observations[j].Frame
+		})
+		// Carry the latest state of each cell before the range forward to
+		// the start of the range, unless we aggregate windows.
+		observations := []MatrixObservation{}
+		carried := make(map[[2]int]int)
+		for _, obs := range matrix.Observations {
+			if obs.Frame >= from || from >= to || operands.Size != "" {
+				break
+			}
+			if idx, ok := carried[obs.Cell]; ok {
+				observations[idx] = obs
+			} else {
+				carried[obs.Cell] = len(observations)
+				observations = append(observations, obs)
+			}
+		}
+		for i := range observations {
+			observations[i].Frame = from
+		}
+		for _, obs := range matrix.Observations {
+			if !inRange(obs.Frame) {
+				continue
+			}
+			observations = append(observations, obs)
+		}
+		matrix.Observations = observations
+		if operands.Size != "" {
+			size, err := ParseFrameSpec(operands.Size, "")
+			if err != nil {
+				return err
+			}
+			step := size
+			if operands.Step != "" {
+				step, err = ParseFrameSpec(operands.Step, "")
+				if err != nil {
+					return err
+				}
+			}
+			if size <= 0 || step <= 0 {
+				return fmt.Errorf("window size and step must be positive")
+			}
+			aggFunc := WindowAggFuncs[operands.Agg]
+			if aggFunc == nil {
+				return fmt.Errorf("no such window aggregation func %s", operands.Agg)
+			}
+			// Don't output windows past the last observation when the range is open.
+			if to == math.MaxInt32 {
+				if len(observations) == 0 {
+					to = from
+				} else {
+					to = observations[len(observations)-1].Frame+1
+				}
+			}
+			matrix = WindowMatrix(matrix, from, to, size, step, aggFunc)
+		}
+		return WriteMatrix(outDir, matrix)
+	} else if _, err := os.Stat(filepath.Join(args[0].DirName, "sequences.json")); err == nil {
+		var sequences []*Sequence
+		inputPath := filepath.Join(args[0].DirName, "sequences.json")
+		bytes, err := ioutil.ReadFile(inputPath)
+		if err != nil {
+			return fmt.Errorf("error loading sequences from %s: %v", inputPath, err)
+		}
+		if err := json.Unmarshal(bytes, &sequences); err != nil {
+			return fmt.Errorf("error decoding sequences: %v", err)
+		}
+
+		outputs := []*Sequence{}
+		for _, seq := range sequences {
+			var items []SequenceItem
+			for _, item := range seq.Items {
+				if inRange(item.Frame) {
+					items = append(items, item)
+				}
+			}
+			if operands.Mode == "overlap" {
+				// Test the span of the sequence, since it may have no
+				// detections in a short range.
+				if len(seq.Items) == 0 || seq.Items[0].Frame >= to || seq.Items[len(seq.Items)-1].Frame < from {
+					continue
+				}
+			} else if len(items) == 0 {
+				continue
+			} else if operands.Mode == "within" && len(items) < len(seq.Items) {
+				continue
+			} else if operands.Mode == "clip" {
+				seq.Items = items
+			}
+			outputs = append(outputs, seq)
+		}
+
+		bytes, err = json.Marshal(outputs)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(filepath.Join(outDir, "sequences.json"), bytes, 0644)
+	} else if _, err := os.Stat(filepath.Join(args[0].DirName, "detect.json")); err == nil {
+		var detections [][]Detection
+		detectionPath := filepath.Join(args[0].DirName, "detect.json")
+		bytes, err := ioutil.ReadFile(detectionPath)
+		if err != nil {
+			return fmt.Errorf("error loading detections from %s: %v", detectionPath, err)
+		}
+		if err := json.Unmarshal(bytes, &detections); err != nil {
+			return err
+		}
+		for frameIdx := range detections {
+			if !inRange(frameIdx) {
+				detections[frameIdx] = []Detection{}
+			}
+		}
+		bytes, err = json.Marshal(detections)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(filepath.Join(outDir, "detect.json"), bytes, 0644)
+	}
+	return fmt.Errorf("input table %s has no matrix, sequences, or detections", args[0].DirName)
+}
+
+func init() {
+	Ops["Window"] = WindowOp
+	OpSignatures["Window"] = OpSignature{MinArgs: 2, MaxArgs: 2, JSONOperands: true}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Writes the file to a new input directory, runs Window with the operands,
+// and returns the output directory.
+func runWindowTest(t *testing.T, fname string, x interface{}, operands string) string {
+	dir := t.TempDir()
+	inputDir := filepath.Join(dir, "input")
+	outDir := filepath.Join(dir, "out")
+	for _, d := range []string{inputDir, outDir} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(inputDir, fname), JsonMarshal(x), 0644); err != nil {
+		t.Fatal(err)
+	}
+	args := []OpArgument{
+		{Type: "node", DirName: inputDir},
+		{Type: "string", String: operands},
+	}
+	if err := WindowOp(args, outDir); err != nil {
+		t.Fatal(err)
+	}
+	return outDir
+}
+
+func TestWindowMatrixFullWindows(t *testing.T) {
+	var observations []MatrixObservation
+	for frame := 0; frame < 10; frame++ {
+		observations = append(observations, MatrixObservation{Cell: [2]int{0, 0}, Frame: frame, Value: float64(frame)})
+	}
+	matrix := WindowMatrix(Matrix{Observations: observations}, 0, 10, 4, 2, WindowAggFuncs["max"])
+	// Windows [0, 4), [2, 6), [4, 8), and [6, 10).
+	var frames []int
+	for _, obs := range matrix.Observations {
+		frames = append(frames, obs.Frame)
+		if obs.Value != float64(obs.Frame) || obs.Get("samples") != 4 {
+			t.Errorf("unexpected observation %+v", obs)
+		}
+	}
+	if len(frames) != 4 || frames[0] != 3 || frames[3] != 9 {
+		t.Errorf("expected windows ending at frames 3, 5, 7, 9, got %v", frames)
+	}
+}
+
+func TestWindowMatrixCarryForward(t *testing.T) {
+	matrix := Matrix{GridSize: 32, Observations: []MatrixObservation{
+		{Cell: [2]int{0, 0}, Frame: 2, Value: 1},
+		{Cell: [2]int{0, 0}, Frame: 5, Value: 2},
+		{Cell: [2]int{1, 0}, Frame: 3, Value: 7},
+		{Cell: [2]int{1, 0}, Frame: 12, Value: 8},
+	}}
+	outDir := runWindowTest(t, "matrix.json", matrix, `{"From": "10", "To": "20"}`)
+	output, err := LoadMatrix(outDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []MatrixObservation{
+		{Cell: [2]int{0, 0}, Frame: 10, Value: 2},
+		{Cell: [2]int{1, 0}, Frame: 10, Value: 7},
+		{Cell: [2]int{1, 0}, Frame: 12, Value: 8},
+	}
+	if len(output.Observations) != len(expected) {
+		t.Fatalf("expected %d observations, got %+v", len(expected), output.Observations)
+	}
+	for i, obs := range output.Observations {
+		if obs.Cell != expected[i].Cell || obs.Frame != expected[i].Frame || obs.Value != expected[i].Value {
+			t.Errorf("observation %d: expected %+v, got %+v", i, expected[i], obs)
+		}
+	}
+}
+
+func TestWindowMatrixBucketsNotCarried(t *testing.T) {
+	matrix := Matrix{GridSize: 32, Observations: []MatrixObservation{
+		{Cell: [2]int{0, 0}, Frame: 2, Value: 1},
+		{Cell: [2]int{0, 0}, Frame: 12, Value: 2},
+		{Cell: [2]int{1, 0}, Frame: 5, Value: 7},
+	}}
+	outDir := runWindowTest(t, "matrix.json", matrix, `{"From": "10", "To": "20", "Size": "10", "Agg": "count"}`)
+	output, err := LoadMatrix(outDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the observation at frame 12 is in the bucket.
+	if len(output.Observations) != 1 || output.Observations[0].Cell != [2]int{0, 0} || output.Observations[0].Value != 1 {
+		t.Errorf("expected one observation with count 1, got %+v", output.Observations)
+	}
+}
+
+func TestWindowSequencesOverlap(t *testing.T) {
+	// Detected before and after the range, but not in it.
+	seq := makeMergeTestSequence(1, 0, [2]int{0, 0})
+	seq.Items = append(seq.Items, makeMergeTestSequence(1, 100, [2]int{0, 0}).Items...)
+	sequences := []*Sequence{seq, makeMergeTestSequence(2, 200, [2]int{0, 0})}
+
+	for mode, expected := range map[string]int{"overlap": 1, "within": 0, "clip": 0} {
+		outDir := runWindowTest(t, "sequences.json", sequences, `{"From": "40", "To": "60", "Mode": "` + mode + `"}`)
+		bytes, err := ioutil.ReadFile(filepath.Join(outDir, "sequences.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var outputs []*Sequence
+		if err := json.Unmarshal(bytes, &outputs); err != nil {
+			t.Fatal(err)
+		}
+		if outputs == nil {
+			t.Errorf("mode %s: expected an empty list instead of null", mode)
+		} else if len(outputs) != expected {
+			t.Errorf("mode %s: expected %d sequences, got %d", mode, expected, len(outputs))
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+/*
+Optimize rewrites a graph into a canonical form, so that equivalent queries
+share cached outputs, without changing the output of any named node:
+
+1. The last node of each filter chain is computed by a chain in a canonical
+   order. A filter keeps or drops each item of its input independently of
+   the other items, without modifying it: Select, and Window with only a time
+   range in overlap or within mode on detections or sequences. Window is not
+   a filter on matrices, since it carries the last value of each cell before
+   the range into the range. So a chain of filters gives the same output in
+   any order, and we order Windows first and then the filters by their
+   arguments. The reordered chain uses new anonymous nodes named like
+   LAST~1, and the named intermediate nodes keep their original inputs, so
+   that their outputs are unchanged. This order is only canonical: it does
+   not make the query cheaper, and may run a few extra filters, but chains
+   written in different orders now share the cached output of their last
+   node.
+
+2. Nodes with identical hashes, i.e. the same operation on the same inputs,
+   share one node. The duplicate names remain in the graph as aliases of the
+   first node by name. RunIfNeeded already skips a node whose output
+   directory exists, so this does not make the query faster either; it makes
+   the sharing explicit in the graph and in EXPLAIN.
+
+Neither rewrite makes a query faster by itself. Predicate pushdown, i.e.
+moving a filter below a more expensive operation so that it runs on fewer
+items, is not implemented, since it is not safe for any current operation:
+Select after Merge is not pushed below the Merge, since merging sequences
+changes their duration and displacement, and a Window below Track or Merge
+would cut the sequences at the range boundaries. The rewrites, and such
+decisions, are returned so that EXPLAIN can show them.
+*/
+
+type Rewrite struct {
+	// "reorder", "dedup", or "note" for a rewrite that we decided against.
+	Kind string
+	Nodes []string
+	Description string
+}
+
+// Returns a copy of the graph with copies of the nodes.
+func (graph Graph) Copy() Graph {
+	copies := make(map[*Node]*Node)
+	var copyNode func(node *Node) *Node
+	copyNode = func(node *Node) *Node {
+		if c := copies[node]; c != nil {
+			return c
+		}
+		c := &Node{
+			Name: node.Name,
+			Operation: node.Operation,
+		}
+		for _, arg := range node.Arguments {
+			if arg.Type == "node" {
+				arg.Node = copyNode(arg.Node)
+			}
+			c.Arguments = append(c.Arguments, arg)
+		}
+		copies[node] = c
+		return c
+	}
+	out := Graph{}
+	for name, node := range graph {
+		out[name] = copyNode(node)
+	}
+	return out
+}
+
+// Returns whether the node keeps or drops each item of its first input
+// independently, without modifying it (see Optimize).
+func isFilter(node *Node) bool {
+	if len(node.Arguments) != 2 || node.Arguments[0].Type != "node" || node.Arguments[1].Type != "string" {
+		return false
+	}
+	if node.Operation == "Select" {
+		return true
+	} else if node.Operation == "Window" {
+		var operands struct {
+			Mode string
+			Size string
+		}
+		if err := json.Unmarshal([]byte(node.Arguments[1].String), &operands); err != nil {
+			return false
+		}
+		if operands.Size != "" || (operands.Mode != "" && operands.Mode != "overlap" && operands.Mode != "within") {
+			return false
+		}
+		return outputsItems(node.Arguments[0].Node)
+	}
+	return false
+}
+
+// Returns whether the node is known to output detections or sequences rather
+// than a matrix, following Select and Window to the operation that produced
+// their input.
+func outputsItems(node *Node) bool {
+	for node.Operation == "Select" || node.Operation == "Window" {
+		if len(node.Arguments) == 0 || node.Arguments[0].Type != "node" {
+			return false
+		}
+		node = node.Arguments[0].Node
+	}
+	return node.Operation == "Detect" || node.Operation == "Track" || node.Operation == "Merge" || node.Operation == "Intersect"
+}
+
+func describeFilter(node *Node) string {
+	return fmt.Sprintf("%s(%s)", node.Operation, node.Arguments[1].String)
+}
+
+func Optimize(graph Graph) (Graph, []Rewrite) {
+	graph = graph.Copy()
+	var rewrites []Rewrite
+
+	// Count the consumers of each node. The "out" table is also consumed by
+	// the UI.
+	consumers := make(map[*Node]int)
+	for _, node := range graph {
+		for _, parent := range node.Parents() {
+			consumers[parent]++
+		}
+	}
+	if graph["out"] != nil {
+		consumers[graph["out"]]++
+	}
+
+	// Filters whose only consumer is another filter, and so are not the last
+	// filter of their chain.
+	chained := make(map[*Node]bool)
+	for _, node := range graph {
+		if !isFilter(node) {
+			continue
+		}
+		if parent := node.Arguments[0].Node; isFilter(parent) && consumers[parent] == 1 {
+			chained[parent] = true
+		}
+	}
+
+	// Reorder filter chains, walking up from the last filter of each chain.
+	for _, top := range graph.TopologicalOrder() {
+		if !isFilter(top) || chained[top] {
+			continue
+		}
+		chain := []*Node{top}
+		for {
+			next := chain[len(chain)-1].Arguments[0].Node
+			if !isFilter(next) || consumers[next] != 1 {
+				break
+			}
+			chain = append(chain, next)
+		}
+		if len(chain) < 2 {
+			continue
+		}
+
+		// The chain from the bottom, and the filters in canonical order.
+		type filter struct {
+			Operation string
+			Operands string
+		}
+		var filters []filter
+		var before []string
+		for i := len(chain) - 1; i >= 0; i-- {
+			filters = append(filters, filter{chain[i].Operation, chain[i].Arguments[1].String})
+			before = append(before, describeFilter(chain[i]))
+		}
+		sort.SliceStable(filters, func(i, j int) bool {
+			if (filters[i].Operation == "Window") != (filters[j].Operation == "Window") {
+				return filters[i].Operation == "Window"
+			}
+			if filters[i].Operation != filters[j].Operation {
+				return filters[i].Operation < filters[j].Operation
+			}
+			return filters[i].Operands < filters[j].Operands
+		})
+		var after []string
+		for _, f := range filters {
+			after = append(after, fmt.Sprintf("%s(%s)", f.Operation, f.Operands))
+		}
+		if strings.Join(before, " ") == strings.Join(after, " ") {
+			continue
+		}
+
+		// Build the reordered chain from anonymous nodes on the input of the
+		// chain, ending at the last node of the chain.
+		prev := chain[len(chain)-1].Arguments[0].Node
+		var names []string
+		for i, f := range filters[:len(filters)-1] {
+			name := fmt.Sprintf("%s~%d", top.Name, i+1)
+			for graph[name] != nil {
+				name += "~"
+			}
+			node := &Node{
+				Name: name,
+				Operation: f.Operation,
+				Arguments: []Argument{
+					{Type: "node", Node: prev},
+					{Type: "string", String: f.Operands},
+				},
+			}
+			graph[name] = node
+			names = append(names, name)
+			prev = node
+		}
+		last := filters[len(filters)-1]
+		top.Operation = last.Operation
+		top.Arguments = []Argument{
+			{Type: "node", Node: prev},
+			{Type: "string", String: last.Operands},
+		}
+		names = append(names, top.Name)
+		rewrites = append(rewrites, Rewrite{
+			Kind: "reorder",
+			Nodes: names,
+			Description: fmt.Sprintf("computed %s with filters %s in canonical order %s, so that it shares cached outputs with equivalent chains", top.Name, strings.Join(before, " -> "), strings.Join(after, " -> ")),
+		})
+	}
+
+	// Explain why filters after Merge stay there.
+	for _, node := range graph.TopologicalOrder() {
+		if node.Operation == "Select" && len(node.Arguments) > 0 && node.Arguments[0].Type == "node" && node.Arguments[0].Node.Operation == "Merge" {
+			rewrites = append(rewrites, Rewrite{
+				Kind: "note",
+				Nodes: []string{node.Name},
+				Description: fmt.Sprintf("did not push %s below Merge %s, since merging changes sequence metrics", describeFilter(node), node.Arguments[0].Node.Name),
+			})
+		}
+	}
+
+	// Deduplicate nodes with identical hashes, keeping the first by name,
+	// preferring names from the query over anonymous nodes.
+	hashes := graph.GetHashStrings()
+	var names []string
+	for name := range graph {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		anonI := strings.Contains(names[i], "~")
+		anonJ := strings.Contains(names[j], "~")
+		if anonI != anonJ {
+			return anonJ
+		}
+		return names[i] < names[j]
+	})
+	canonical := make(map[string]*Node)
+	duplicates := make(map[string][]string)
+	for _, name := range names {
+		if graph[name].Name != name {
+			// Already an alias.
+			continue
+		}
+		hash := hashes[name]
+		if canonical[hash] == nil {
+			canonical[hash] = graph[name]
+			continue
+		}
+		duplicates[hash] = append(duplicates[hash], name)
+		graph[name] = canonical[hash]
+	}
+	for _, node := range graph {
+		for i, arg := range node.Arguments {
+			if arg.Type == "node" {
+				node.Arguments[i].Node = canonical[hashes[arg.Node.Name]]
+			}
+		}
+	}
+	for _, name := range names {
+		hash := hashes[name]
+		if len(duplicates[hash]) == 0 || canonical[hash].Name != name {
+			continue
+		}
+		rewrites = append(rewrites, Rewrite{
+			Kind: "dedup",
+			Nodes: append([]string{name}, duplicates[hash]...),
+			Description: fmt.Sprintf("%s is identical to %s and shares its output directory", strings.Join(duplicates[hash], ", "), name),
+		})
+	}
+
+	return graph, rewrites
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func optimizeQuery(t *testing.T, query string) (Graph, Graph, []Rewrite) {
+	graph, err := ParseQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	optimized, rewrites := Optimize(graph)
+	return graph, optimized, rewrites
+}
+
+func getRewrites(rewrites []Rewrite, kind string) []Rewrite {
+	var matches []Rewrite
+	for _, rewrite := range rewrites {
+		if rewrite.Kind == kind {
+			matches = append(matches, rewrite)
+		}
+	}
+	return matches
+}
+
+func TestOptimizeReorder(t *testing.T) {
+	original, graph, rewrites := optimizeQuery(t, `d = Detect("video")
+tracks = Track(d)
+fast = Select(tracks; "speed > 2")
+out = Window(fast; "{"From": "0", "To": "10"}")`)
+	reorders := getRewrites(rewrites, "reorder")
+	if len(reorders) != 1 || !reflect.DeepEqual(reorders[0].Nodes, []string{"out~1", "out"}) {
+		t.Fatalf("expected out to be reordered, got %+v", rewrites)
+	}
+
+	// The Window runs first, on an anonymous node.
+	out := graph["out"]
+	if out.Operation != "Select" || out.Arguments[0].Node != graph["out~1"] {
+		t.Errorf("expected out to select from out~1, got %+v", out)
+	}
+	if w := graph["out~1"]; w.Operation != "Window" || w.Arguments[0].Node != graph["tracks"] {
+		t.Errorf("expected out~1 to window tracks, got %+v", w)
+	}
+	// The named intermediate node keeps its original input, and the original
+	// graph is not modified.
+	if fast := graph["fast"]; fast.Operation != "Select" || fast.Arguments[0].Node != graph["tracks"] {
+		t.Errorf("expected fast to keep its input, got %+v", fast)
+	}
+	if original["out"].Operation != "Window" || original["out~1"] != nil {
+		t.Errorf("expected the original graph to be unchanged")
+	}
+
+	// The same chain written in the canonical order shares the output.
+	_, canonical, rewrites := optimizeQuery(t, `d = Detect("video")
+tracks = Track(d)
+w = Window(tracks; "{"From": "0", "To": "10"}")
+out = Select(w; "speed > 2")`)
+	if len(getRewrites(rewrites, "reorder")) != 0 {
+		t.Errorf("expected no reordering of a canonical chain, got %+v", rewrites)
+	}
+	if graph.GetHashStrings()["out"] != canonical.GetHashStrings()["out"] {
+		t.Error("expected equivalent chains to have the same hash")
+	}
+}
+
+func TestOptimizeNoReorder(t *testing.T) {
+	for _, query := range []string{
+		// Window on a matrix carries values into the range, so the order
+		// matters.
+		`d = Detect("video")
+m = ToMatrix(d; "{"Func": "count"}")
+b = Window(m; "{"From": "20", "To": "30"}")
+out = Window(b; "{"From": "0", "To": "10"}")`,
+		// Clipping modifies the sequences.
+		`d = Detect("video")
+tracks = Track(d)
+a = Window(tracks; "{"From": "20", "To": "30", "Mode": "clip"}")
+out = Select(a; "duration > 1")`,
+		// The intermediate node has another consumer.
+		`d = Detect("video")
+tracks = Track(d)
+fast = Select(tracks; "speed > 2")
+out = Window(fast; "{"From": "0", "To": "10"}")
+m = ToMatrix(fast; "{"Func": "count"}")`,
+	} {
+		original, graph, rewrites := optimizeQuery(t, query)
+		if len(getRewrites(rewrites, "reorder")) != 0 {
+			t.Errorf("expected no reordering for query:\n%s\ngot %+v", query, rewrites)
+		}
+		if original.GetHashStrings()["out"] != graph.GetHashStrings()["out"] {
+			t.Errorf("expected out to be unchanged for query:\n%s", query)
+		}
+	}
+}
+
+func TestOptimizeMergeNote(t *testing.T) {
+	_, graph, rewrites := optimizeQuery(t, `d = Detect("video")
+tracks = Track(d)
+merged = Merge(tracks; "{"DistanceThreshold": 40}")
+out = Select(merged; "displacement < 75")`)
+	notes := getRewrites(rewrites, "note")
+	if len(notes) != 1 || !reflect.DeepEqual(notes[0].Nodes, []string{"out"}) || !strings.Contains(notes[0].Description, "merged") {
+		t.Fatalf("expected a note about out after merged, got %+v", rewrites)
+	}
+	if graph["out"].Arguments[0].Node != graph["merged"] {
+		t.Error("expected out to stay after the Merge")
+	}
+}
+
+func TestOptimizeDedup(t *testing.T) {
+	Config.DataDir = t.TempDir()
+	// A test operation recording the input directories of each run.
+	var runs [][]string
+	Ops["OptimizeTest"] = func(args []OpArgument, outDir string) error {
+		var dirs []string
+		for _, arg := range args {
+			if arg.Type == "node" {
+				dirs = append(dirs, arg.DirName)
+			}
+		}
+		runs = append(runs, dirs)
+		return ioutil.WriteFile(filepath.Join(outDir, "out.txt"), []byte("x"), 0644)
+	}
+	defer delete(Ops, "OptimizeTest")
+
+	_, graph, rewrites := optimizeQuery(t, `a = OptimizeTest("x")
+b = OptimizeTest("x")
+c = OptimizeTest(b; "y")`)
+	dedups := getRewrites(rewrites, "dedup")
+	if len(dedups) != 1 || !reflect.DeepEqual(dedups[0].Nodes, []string{"a", "b"}) {
+		t.Fatalf("expected b to be deduplicated with a, got %+v", rewrites)
+	}
+	if graph["b"] != graph["a"] || graph["b"].Name != "a" || graph["c"].Arguments[0].Node != graph["a"] {
+		t.Errorf("expected b and the input of c to be aliases of a")
+	}
+
+	// Aliases share the output directory of their node.
+	outDirs, err := graph.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outDirs["b"] != outDirs["a"] {
+		t.Errorf("expected b to share the output directory %s, got %s", outDirs["a"], outDirs["b"])
+	}
+	expected := [][]string{nil, {outDirs["a"]}}
+	if !reflect.DeepEqual(runs, expected) {
+		t.Errorf("expected runs %v, got %v", expected, runs)
+	}
+}
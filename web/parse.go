@@ -7,25 +7,46 @@ import (
 )
 
 func ParseQuery(query string) (Graph, error) {
-	lines := strings.Split(query, "\n")
+	macros, query, err := ParseMacros(query)
+	if err != nil {
+		return nil, err
+	}
 	graph := Graph{}
+	if err := parseNodes(strings.Split(query, "\n"), graph, map[string]*Node{}, "", macros, nil); err != nil {
+		return nil, err
+	}
+	return graph, nil
+}
+
+// Parses lines like table = Op(args) into nodes of the graph. References are
+// resolved in scope, which is updated with the new nodes, and the nodes are
+// added to the graph with the prefix on their names. Lines that call macros
+// are expanded (see Macro), where stack holds the macros being expanded.
+func parseNodes(lines []string, graph Graph, scope map[string]*Node, prefix string, macros map[string]*Macro, stack []string) error {
 	for i, line := range lines {
 		line = strings.TrimSpace(line)
-		log.Println(query, line, lines)
 		if line == "" {
 			continue
 		}
 
 		// line like newtable = Op(node_arg, "string_arg", ...)
-		eqParts := strings.Split(line, "=")
+		// String arguments may contain "=" and parentheses, so we split on the
+		// first "=" and take the arguments up to the last ")".
+		eqParts := strings.SplitN(line, "=", 2)
+		if len(eqParts) != 2 || !strings.Contains(eqParts[1], "(") || !strings.HasSuffix(eqParts[1], ")") {
+			return fmt.Errorf("line %d: expected line like table = Op(args)", i+1)
+		}
 		nodeName := strings.TrimSpace(eqParts[0])
 		rhs := strings.TrimSpace(eqParts[1])
-		opName := strings.Split(rhs, "(")[0]
-		argStr := strings.Split(strings.Split(rhs, "(")[1], ")")[0]
+		opName := strings.TrimSpace(rhs[:strings.Index(rhs, "(")])
+		argStr := rhs[strings.Index(rhs, "(")+1:len(rhs)-1]
 		argParts := strings.Split(argStr, ";")
 		var arguments []Argument
 		for _, argPart := range argParts {
 			argPart = strings.TrimSpace(argPart)
+			if argPart == "" {
+				return fmt.Errorf("line %d: empty argument", i+1)
+			}
 			if argPart[0] == '"' {
 				// string argument
 				arguments = append(arguments, Argument{
@@ -35,22 +56,36 @@ func ParseQuery(query string) (Graph, error) {
 			} else {
 				// node argument
 				refName := argPart
-				if graph[refName] == nil {
-					return nil, fmt.Errorf("line %d: referenced variable %s not defined yet", i+1, refName)
+				if scope[refName] == nil {
+					return fmt.Errorf("line %d: referenced variable %s not defined yet", i+1, refName)
 				}
 				arguments = append(arguments, Argument{
 					Type: "node",
-					Node: graph[refName],
+					Node: scope[refName],
 				})
 			}
 		}
+
+		if macro := macros[opName]; macro != nil {
+			node, err := macro.Expand(prefix + nodeName, arguments, graph, macros, stack)
+			if err != nil {
+				return fmt.Errorf("line %d: %v", i+1, err)
+			}
+			scope[nodeName] = node
+			continue
+		}
+
+		if Ops[opName] == nil {
+			return fmt.Errorf("line %d: unknown operation or macro %s", i+1, opName)
+		}
 		node := &Node{
-			Name: nodeName,
+			Name: prefix + nodeName,
 			Operation: opName,
 			Arguments: arguments,
 		}
 		log.Printf("[parse] [%s] => add node name %s op %s with %d arguments", line, node.Name, node.Operation, len(node.Arguments))
-		graph[nodeName] = node
+		graph[node.Name] = node
+		scope[nodeName] = node
 	}
-	return graph, nil
+	return nil
 }
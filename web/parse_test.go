@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseQueryStringArguments(t *testing.T) {
+	query := `seqs = Detect("video")
+m = ToMatrix(seqs; "{"Func": "count", "Where": "speed() >= 2"}")`
+	graph, err := ParseQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := graph["m"]
+	if node == nil || node.Operation != "ToMatrix" || len(node.Arguments) != 2 {
+		t.Fatalf("unexpected node %+v", node)
+	}
+	expected := `{"Func": "count", "Where": "speed() >= 2"}`
+	if s := node.Arguments[1].String; s != expected {
+		t.Errorf("expected string argument %s, got %s", expected, s)
+	}
+}
+
+func TestParseQueryInvalidLine(t *testing.T) {
+	for _, query := range []string{"seqs", "seqs = Detect", `seqs = Detect("video"`} {
+		if _, err := ParseQuery(query); err == nil {
+			t.Errorf("expected error for %q", query)
+		}
+	}
+}
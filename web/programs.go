@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Programs are queries saved by name in Config.ProgramsDir, as NAME.txt.
+Saving a program that already exists keeps the previous text as a version in
+.history/NAME/VERSION.txt, where versions are numbered from 1.
+
+Programs may declare parameters with default values, and refer to them as
+${name} in the rest of the program:
+	param grid = 32
+	out = ToMatrix(parked; "{"Func": "count", "GridSize": ${grid}}")
+
+The parameters are substituted at submit time (see ParseProgram). Values are
+substituted as raw text, often into JSON strings, so they may not contain
+the characters in paramForbiddenChars: quotes and backslashes would change
+the JSON, semicolons would split arguments, and newlines would split lines.
+*/
+
+type ProgramParam struct {
+	Name string
+	Default string
+}
+
+type Program struct {
+	Name string
+	Text string
+	Params []ProgramParam
+	// The number of previous versions, or the version number if this is a
+	// previous version.
+	Version int
+	Modified time.Time
+}
+
+var programNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+var paramLineRegexp = regexp.MustCompile(`^param\s+([A-Za-z_][A-Za-z0-9_]*)\s*=\s*(.*)$`)
+var paramRefRegexp = regexp.MustCompile(`\$\{([^}]*)\}`)
+
+const paramForbiddenChars = "\"\\;\n"
+
+// Returns the parameters declared in the program, and the program without the
+// declarations. Parameters of macro definitions are skipped (see Macro).
+func GetProgramParams(text string) ([]ProgramParam, string, error) {
+	var params []ProgramParam
+	var lines []string
+	seen := make(map[string]bool)
+	inMacro := false
+	for i, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "def ") {
+			inMacro = true
+		} else if inMacro && trimmed == "}" {
+			inMacro = false
+		}
+		match := paramLineRegexp.FindStringSubmatch(trimmed)
+		if inMacro || match == nil {
+			lines = append(lines, line)
+			continue
+		}
+		if seen[match[1]] {
+			return nil, "", fmt.Errorf("line %d: parameter %s declared twice", i+1, match[1])
+		}
+		seen[match[1]] = true
+		params = append(params, ProgramParam{
+			Name: match[1],
+			Default: strings.TrimSpace(match[2]),
+		})
+		// Keep line numbers the same in the program.
+		lines = append(lines, "")
+	}
+	return params, strings.Join(lines, "\n"), nil
+}
+
+// Substitutes parameter values into the program, using the declared defaults
+// for parameters that are not in values.
+func SubstituteParams(text string, values map[string]string) (string, error) {
+	params, text, err := GetProgramParams(text)
+	if err != nil {
+		return "", err
+	}
+	declared := make(map[string]string)
+	for _, param := range params {
+		declared[param.Name] = param.Default
+	}
+	for name, value := range values {
+		if _, ok := declared[name]; !ok {
+			return "", fmt.Errorf("program has no parameter %s", name)
+		}
+		declared[name] = value
+	}
+	for name, value := range declared {
+		if strings.ContainsAny(value, paramForbiddenChars) {
+			return "", fmt.Errorf("value of parameter %s may not contain quotes, backslashes, semicolons, or newlines", name)
+		}
+	}
+	var missing []string
+	text = replaceParamRefs(text, func(ref string) string {
+		name := ref[2:len(ref)-1]
+		value, ok := declared[name]
+		if !ok {
+			missing = append(missing, name)
+		}
+		return value
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("undeclared parameters: %s", strings.Join(missing, ", "))
+	}
+	return text, nil
+}
+
+// Replaces the parameter references outside of macro definitions.
+func replaceParamRefs(text string, f func(ref string) string) string {
+	lines := strings.Split(text, "\n")
+	inMacro := false
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "def ") {
+			inMacro = true
+		} else if inMacro && trimmed == "}" {
+			inMacro = false
+		} else if !inMacro {
+			lines[i] = paramRefRegexp.ReplaceAllStringFunc(line, f)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Parses a program after substituting its parameters.
+func ParseProgram(text string, values map[string]string) (Graph, error) {
+	query, err := SubstituteParams(text, values)
+	if err != nil {
+		return nil, err
+	}
+	return ParseQuery(query)
+}
+
+func getProgramPath(name string) (string, error) {
+	if !programNameRegexp.MatchString(name) {
+		return "", fmt.Errorf("invalid program name %s", name)
+	}
+	return filepath.Join(Config.ProgramsDir, name + ".txt"), nil
+}
+
+func getProgramHistoryDir(name string) string {
+	return filepath.Join(Config.ProgramsDir, ".history", name)
+}
+
+// Returns the version numbers of previous versions of the program, in
+// increasing order.
+func getProgramVersions(name string) ([]int, error) {
+	files, err := ioutil.ReadDir(getProgramHistoryDir(name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var versions []int
+	for _, fi := range files {
+		version, err := strconv.Atoi(strings.TrimSuffix(fi.Name(), ".txt"))
+		if err != nil {
+			continue
+		}
+		versions = append(versions, version)
+	}
+	sort.Ints(versions)
+	return versions, nil
+}
+
+// Lists the saved programs, without their text.
+func ListPrograms() ([]Program, error) {
+	files, err := ioutil.ReadDir(Config.ProgramsDir)
+	if err != nil {
+		return nil, err
+	}
+	programs := []Program{}
+	for _, fi := range files {
+		name := strings.TrimSuffix(fi.Name(), ".txt")
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), ".txt") || !programNameRegexp.MatchString(name) {
+			continue
+		}
+		program, err := LoadProgram(name, 0)
+		if err != nil {
+			return nil, err
+		}
+		program.Text = ""
+		programs = append(programs, program)
+	}
+	return programs, nil
+}
+
+// Loads the program, or a previous version of it if version is positive.
+func LoadProgram(name string, version int) (Program, error) {
+	fname, err := getProgramPath(name)
+	if err != nil {
+		return Program{}, err
+	}
+	versions, err := getProgramVersions(name)
+	if err != nil {
+		return Program{}, err
+	}
+	program := Program{
+		Name: name,
+		Version: len(versions),
+	}
+	if version > 0 {
+		fname = filepath.Join(getProgramHistoryDir(name), fmt.Sprintf("%d.txt", version))
+		program.Version = version
+	}
+	fi, err := os.Stat(fname)
+	if err != nil {
+		return Program{}, fmt.Errorf("no such program %s", name)
+	}
+	bytes, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return Program{}, err
+	}
+	program.Text = string(bytes)
+	program.Modified = fi.ModTime()
+	program.Params, _, err = GetProgramParams(program.Text)
+	if err != nil {
+		return Program{}, fmt.Errorf("error in program %s: %v", name, err)
+	}
+	return program, nil
+}
+
+// Saves the program, keeping the previous text as a version.
+func SaveProgram(name string, text string) (Program, error) {
+	fname, err := getProgramPath(name)
+	if err != nil {
+		return Program{}, err
+	}
+	if _, _, err := GetProgramParams(text); err != nil {
+		return Program{}, err
+	}
+	if prev, err := ioutil.ReadFile(fname); err == nil {
+		if string(prev) == text {
+			return LoadProgram(name, 0)
+		}
+		versions, err := getProgramVersions(name)
+		if err != nil {
+			return Program{}, err
+		}
+		version := 1
+		if len(versions) > 0 {
+			version = versions[len(versions)-1] + 1
+		}
+		if err := os.MkdirAll(getProgramHistoryDir(name), 0755); err != nil {
+			return Program{}, err
+		}
+		if err := ioutil.WriteFile(filepath.Join(getProgramHistoryDir(name), fmt.Sprintf("%d.txt", version)), prev, 0644); err != nil {
+			return Program{}, err
+		}
+	}
+	if err := ioutil.WriteFile(fname, []byte(text), 0644); err != nil {
+		return Program{}, err
+	}
+	return LoadProgram(name, 0)
+}
+
+// Deletes the program along with its previous versions.
+func DeleteProgram(name string) error {
+	fname, err := getProgramPath(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(fname); err != nil {
+		return fmt.Errorf("no such program %s", name)
+	}
+	return os.RemoveAll(getProgramHistoryDir(name))
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSubstituteParams(t *testing.T) {
+	text := `param grid = 32
+out = ToMatrix(parked; "{"Func": "count", "GridSize": ${grid}}")`
+	query, err := SubstituteParams(text, map[string]string{"grid": "64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `
+out = ToMatrix(parked; "{"Func": "count", "GridSize": 64}")`
+	if query != expected {
+		t.Errorf("expected %q, got %q", expected, query)
+	}
+
+	for _, value := range []string{`64, "Func": "sum"`, `64\`, "64; x", "64\nx = Detect()"} {
+		if _, err := SubstituteParams(text, map[string]string{"grid": value}); err == nil {
+			t.Errorf("expected error for value %q", value)
+		}
+	}
+}
@@ -2,20 +2,228 @@ var app = new Vue({
 	el: '#app',
 	data: {
 		query: '',
+		programs: [],
+		programName: '',
+		programVersion: 0,
+		params: [],
+		paramValues: {},
+		plan: null,
+		optimize: true,
+		visOptions: '',
 		state: null,
+		visVersion: 0,
+		animVersion: 0,
+		animOptions: '',
+		animation: null,
+		animFrame: 0,
+		view: 'image',
+		map: null,
+		overlayLayer: null,
+		featureLayer: null,
+		selectedFrame: null,
+		frameGrid: false,
+		auditHash: '',
+		auditID: '',
+		audit: null,
 	},
 	created: function() {
 		setInterval(this.fetchState, 1000);
+		this.fetchPrograms();
 	},
 	methods: {
 		fetchState: function() {
 			$.get('/state', (state) => {
+				var finished = this.state && this.state.Running && !state.Running;
 				this.state = state;
+				if (finished) {
+					this.updateOverlay();
+				}
 			});
 		},
 		submitQuery: function() {
 			this.state = null;
-			$.post('/exec', {'query': this.query});
+			$.post('/exec', {
+				'query': this.query,
+				'params': JSON.stringify(this.paramValues),
+				'vis': this.visOptions,
+				'optimize': this.optimize ? '1' : '0',
+			}).fail((xhr) => {
+				alert(xhr.responseText);
+			});
+		},
+		explainQuery: function() {
+			$.post('/explain', {
+				'query': this.query,
+				'params': JSON.stringify(this.paramValues),
+				'optimize': this.optimize ? '1' : '0',
+			}, (plan) => {
+				this.plan = plan;
+			}).fail((xhr) => {
+				alert(xhr.responseText);
+			});
+		},
+		fetchPrograms: function() {
+			$.get('/programs', (programs) => {
+				this.programs = programs;
+			});
+		},
+		setProgram: function(program) {
+			this.programName = program.Name;
+			this.programVersion = program.Version;
+			this.query = program.Text;
+			this.params = program.Params || [];
+			var values = {};
+			this.params.forEach((param) => {
+				values[param.Name] = param.Default;
+			});
+			this.paramValues = values;
+		},
+		loadProgram: function(version) {
+			var data = {};
+			if (version) {
+				data.version = version;
+			}
+			$.get('/programs/' + this.programName, data, (program) => {
+				this.setProgram(program);
+			}).fail((xhr) => {
+				alert(xhr.responseText);
+			});
+		},
+		saveProgram: function() {
+			$.post('/programs/' + this.programName, {'text': this.query}, (program) => {
+				this.setProgram(program);
+				this.fetchPrograms();
+			}).fail((xhr) => {
+				alert(xhr.responseText);
+			});
+		},
+		deleteProgram: function() {
+			if (!confirm('Delete program ' + this.programName + ' and its versions?')) {
+				return;
+			}
+			$.ajax({url: '/programs/' + this.programName, type: 'DELETE'}).done(() => {
+				this.programName = '';
+				this.params = [];
+				this.paramValues = {};
+				this.fetchPrograms();
+			}).fail((xhr) => {
+				alert(xhr.responseText);
+			});
+		},
+		updateVisualization: function() {
+			$.post('/visualize', {'vis': this.visOptions}, () => {
+				this.visVersion++;
+				this.updateOverlay();
+			}).fail((xhr) => {
+				alert(xhr.responseText);
+			});
+		},
+		showMap: function() {
+			this.view = 'map';
+			if (this.map) {
+				this.$nextTick(() => this.map.invalidateSize());
+				return;
+			}
+			$.get('/tiles/info', (info) => {
+				// Tiles are in ortho-image pixel coordinates, where the
+				// maximum zoom level is at full resolution.
+				this.map = L.map('map', {
+					crs: L.CRS.Simple,
+					minZoom: 0,
+					maxZoom: info.MaxZoom + 2,
+				});
+				var bounds = L.latLngBounds(
+					this.map.unproject([0, info.Height], info.MaxZoom),
+					this.map.unproject([info.Width, 0], info.MaxZoom),
+				);
+				L.tileLayer('/tiles/ortho/{z}/{x}/{y}.jpg', {
+					tileSize: info.TileSize,
+					maxNativeZoom: info.MaxZoom,
+					maxZoom: info.MaxZoom + 2,
+					bounds: bounds,
+					noWrap: true,
+				}).addTo(this.map);
+				this.map.fitBounds(bounds);
+				this.updateOverlay();
+			});
+		},
+		updateOverlay: function() {
+			if (!this.map) {
+				return;
+			}
+			if (this.overlayLayer) {
+				this.map.removeLayer(this.overlayLayer);
+			}
+			var url = '/tiles/node/out/{z}/{x}/{y}.png?vis=' + encodeURIComponent(this.visOptions) + '&v=' + Date.now();
+			this.overlayLayer = L.tileLayer(url, {
+				tileSize: 256,
+				maxNativeZoom: this.map.getMaxZoom() - 2,
+				maxZoom: this.map.getMaxZoom(),
+				noWrap: true,
+			}).addTo(this.map);
+			this.updateFeatures();
+		},
+		updateFeatures: function() {
+			if (this.featureLayer) {
+				this.map.removeLayer(this.featureLayer);
+				this.featureLayer = null;
+			}
+			$.get('/features', {'node': 'out'}, (collection) => {
+				var maxZoom = this.map.getMaxZoom() - 2;
+				this.featureLayer = L.geoJSON(collection, {
+					// Coordinates are ortho-image pixels.
+					coordsToLatLng: (coords) => this.map.unproject([coords[0], coords[1]], maxZoom),
+					style: (feature) => {
+						if (feature.properties.Kind == 'cell') {
+							return {color: '#888', weight: 1, fillOpacity: 0};
+						}
+						return {color: '#ff0', weight: 2};
+					},
+					pointToLayer: (feature, latlng) => L.circleMarker(latlng, {radius: 3}),
+					onEachFeature: (feature, layer) => {
+						var lines = [];
+						for (var key in feature.properties) {
+							var value = feature.properties[key];
+							if (typeof value == 'number' && !Number.isInteger(value)) {
+								value = value.toFixed(2);
+							}
+							lines.push(key + ': ' + value);
+						}
+						layer.bindTooltip(lines.join('<br>'), {sticky: true});
+						layer.on('click', () => {
+							var props = feature.properties;
+							if (props.Frame !== undefined) {
+								this.selectedFrame = props.Frame;
+							} else if (props.StartFrame !== undefined) {
+								this.selectedFrame = props.StartFrame;
+							}
+						});
+					},
+				}).addTo(this.map);
+			});
+		},
+		fetchAudit: function() {
+			this.audit = null;
+			$.get('/merge-candidates', {'hash': this.auditHash, 'id': this.auditID}, (audit) => {
+				this.audit = audit;
+			}).fail((xhr) => {
+				alert(xhr.responseText);
+			});
+		},
+		formatSimilarity: function(similarity) {
+			return similarity == null ? '' : similarity.toFixed(3);
+		},
+		animate: function() {
+			this.animation = null;
+			$.post('/animate', {'anim': this.animOptions}, () => {
+				this.animVersion++;
+				$.get('/anim/index.json?v=' + this.animVersion, (index) => {
+					this.animFrame = 0;
+					this.animation = index;
+				});
+			}).fail((xhr) => {
+				alert(xhr.responseText);
+			});
 		},
 	},
 });
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"github.com/mitroadmaps/gomapinfer/common"
+
+	"fmt"
+	"math"
+)
+
+// A tessellation divides the ortho-image into the cells of a matrix.
+type Tessellation interface {
+	// Returns the cells containing the point. This is usually one cell, but
+	// points on a cell boundary may be in several cells.
+	CellsContaining(p common.Point) [][2]int
+	// Returns the cells that may intersect the rectangle.
+	CellsInRect(rect common.Rectangle) [][2]int
+	// Returns the outline of the cell, which may consist of several polygons.
+	CellPolygons(cell [2]int) []common.Polygon
+}
+
+// Specifies a tessellation in ToMatrix operands, and records the tessellation
+// of a matrix. Example operands:
+//	{"Type": "hex", "Size": 24}
+//	{"Type": "quadtree", "Size": 8, "MaxPoints": 50}
+type TessellationSpec struct {
+	// "square" (default), "hex", or "quadtree".
+	Type string
+	// The side length of square cells, the circumradius of hexagons, or the
+	// side length of the smallest quadtree cells.
+	Size int
+	// For quadtrees: the number of levels below the root, the maximum number
+	// of detections in a cell before it is split, and the leaves as (level, x,
+	// y). If Depth is zero, the root is large enough to cover every frame. The
+	// leaves are computed by ToMatrix.
+	Depth int `json:",omitempty"`
+	MaxPoints int `json:",omitempty"`
+	Leaves [][3]int `json:",omitempty"`
+}
+
+// Quadtrees can have at most this many levels below the root, and the root
+// side can be at most MaxQuadtreeSide pixels.
+const MaxQuadtreeDepth = 24
+const MaxQuadtreeSide = 1 << 24
+
+// Returns an error if the spec has a non-positive size, or for quadtrees, a
+// depth that is negative or so large that the root side is out of range.
+func (spec TessellationSpec) Validate() error {
+	if spec.Size <= 0 {
+		return fmt.Errorf("tessellation size must be positive")
+	}
+	if spec.Type != "quadtree" {
+		return nil
+	}
+	if spec.Depth < 0 || spec.Depth > MaxQuadtreeDepth {
+		return fmt.Errorf("quadtree depth must be between 0 and %d", MaxQuadtreeDepth)
+	}
+	if spec.Size > MaxQuadtreeSide >> uint(spec.Depth) {
+		return fmt.Errorf("quadtree root side %d << %d exceeds %d pixels", spec.Size, spec.Depth, MaxQuadtreeSide)
+	}
+	if spec.MaxPoints < 0 {
+		return fmt.Errorf("quadtree MaxPoints must not be negative")
+	}
+	for _, leaf := range spec.Leaves {
+		if leaf[0] < 0 || leaf[0] > spec.Depth {
+			return fmt.Errorf("quadtree leaf %v is not between level 0 and the depth", leaf)
+		}
+	}
+	return nil
+}
+
+func (spec TessellationSpec) Tessellation() (Tessellation, error) {
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	switch spec.Type {
+	case "", "square":
+		return SquareTessellation{float64(spec.Size)}, nil
+	case "hex":
+		return HexTessellation{float64(spec.Size)}, nil
+	case "quadtree":
+		return NewQuadtreeTessellation(spec), nil
+	}
+	return nil, fmt.Errorf("unknown tessellation type %s", spec.Type)
+}
+
+// Returns the minimum distance from the cell to the frame boundaries, or -1 if
+// the cell is not entirely in the frame.
+func GetCellDistanceInFrame(t Tessellation, cell [2]int, frame Frame) float64 {
+	var worstDistance float64 = -1
+	for _, poly := range t.CellPolygons(cell) {
+		d := GetPolygonDistanceInFrame(poly, frame)
+		if d == -1 {
+			return -1
+		}
+		if worstDistance == -1 || d < worstDistance {
+			worstDistance = d
+		}
+	}
+	return worstDistance
+}
+
+func IsCellInFrame(t Tessellation, cell [2]int, frame Frame) bool {
+	return GetCellDistanceInFrame(t, cell, frame) != -1
+}
+
+// Returns map from cells visible in current frame to the distances from
+// those cells to the frame boundaries
+func GetCellsInFrame(t Tessellation, frame Frame) map[[2]int]float64 {
+	frameCells := make(map[[2]int]float64)
+	for _, cell := range t.CellsInRect(frame.Polygon().Bounds()) {
+		d := GetCellDistanceInFrame(t, cell, frame)
+		if d == -1 {
+			continue
+		}
+		frameCells[cell] = d
+	}
+	return frameCells
+}
+
+// Square grid where cell (i, j) covers [i*size, (i+1)*size) x [j*size, (j+1)*size).
+type SquareTessellation struct {
+	Size float64
+}
+
+func (t SquareTessellation) CellsContaining(p common.Point) [][2]int {
+	return GetCellsContaining(p, t.Size)
+}
+
+func (t SquareTessellation) CellsInRect(rect common.Rectangle) [][2]int {
+	startCell := ToCell(rect.Min, t.Size)
+	endCell := ToCell(rect.Max, t.Size)
+	var cells [][2]int
+	for i := startCell[0]; i <= endCell[0]; i++ {
+		for j := startCell[1]; j <= endCell[1]; j++ {
+			cells = append(cells, [2]int{i, j})
+		}
+	}
+	return cells
+}
+
+func (t SquareTessellation) CellPolygons(cell [2]int) []common.Polygon {
+	return []common.Polygon{GetCellRect(cell, t.Size).ToPolygon()}
+}
+
+func ToCell(p common.Point, gridSize float64) [2]int {
+	return [2]int{
+		int(math.Floor(p.X / gridSize)),
+		int(math.Floor(p.Y / gridSize)),
+	}
+}
+
+func GetCellRect(cell [2]int, gridSize float64) common.Rectangle {
+	cellPoint := common.Point{float64(cell[0]), float64(cell[1])}
+	return common.Rectangle{
+		cellPoint.Scale(gridSize),
+		cellPoint.Add(common.Point{1, 1}).Scale(gridSize),
+	}
+}
+
+// Returns the cells whose rectangle contains the point. This is usually just
+// the cell from ToCell, but points on a cell boundary are in several cells.
+func GetCellsContaining(p common.Point, gridSize float64) [][2]int {
+	cell := ToCell(p, gridSize)
+	xs := []int{cell[0]}
+	if p.X == float64(cell[0]) * gridSize {
+		xs = append(xs, cell[0]-1)
+	}
+	ys := []int{cell[1]}
+	if p.Y == float64(cell[1]) * gridSize {
+		ys = append(ys, cell[1]-1)
+	}
+	var cells [][2]int
+	for _, i := range xs {
+		for _, j := range ys {
+			cells = append(cells, [2]int{i, j})
+		}
+	}
+	return cells
+}
+
+// Grid of pointy-top hexagons with the given circumradius. Cells are axial
+// coordinates (q, r), where the center of (0, 0) is at the origin.
+type HexTessellation struct {
+	Size float64
+}
+
+func (t HexTessellation) center(cell [2]int) common.Point {
+	q, r := float64(cell[0]), float64(cell[1])
+	return common.Point{
+		t.Size * math.Sqrt(3) * (q + r/2),
+		t.Size * 1.5 * r,
+	}
+}
+
+// Returns whether the point is in the closed hexagon.
+func (t HexTessellation) contains(cell [2]int, p common.Point) bool {
+	d := p.Sub(t.center(cell))
+	inradius := t.Size * math.Sqrt(3) / 2
+	for _, angle := range []float64{0, math.Pi/3, 2*math.Pi/3} {
+		if math.Abs(d.X*math.Cos(angle) + d.Y*math.Sin(angle)) > inradius + 1e-9 {
+			return false
+		}
+	}
+	return true
+}
+
+func (t HexTessellation) CellsContaining(p common.Point) [][2]int {
+	// Round the fractional cube coordinates to get the nearest hexagon, and
+	// then check its neighbors in case the point is on a boundary.
+	fq := (math.Sqrt(3)/3*p.X - p.Y/3) / t.Size
+	fr := (2.0/3*p.Y) / t.Size
+	fs := -fq - fr
+	q, r, s := math.Round(fq), math.Round(fr), math.Round(fs)
+	dq, dr, ds := math.Abs(q-fq), math.Abs(r-fr), math.Abs(s-fs)
+	if dq > dr && dq > ds {
+		q = -r - s
+	} else if dr > ds {
+		r = -q - s
+	}
+	cell := [2]int{int(q), int(r)}
+	cells := [][2]int{cell}
+	for _, offset := range [][2]int{{1, 0}, {1, -1}, {0, -1}, {-1, 0}, {-1, 1}, {0, 1}} {
+		neighbor := [2]int{cell[0] + offset[0], cell[1] + offset[1]}
+		if t.contains(neighbor, p) {
+			cells = append(cells, neighbor)
+		}
+	}
+	return cells
+}
+
+func (t HexTessellation) CellsInRect(rect common.Rectangle) [][2]int {
+	width := t.Size * math.Sqrt(3)
+	rowHeight := t.Size * 1.5
+	var cells [][2]int
+	for r := int(math.Floor(rect.Min.Y / rowHeight)) - 1; r <= int(math.Ceil(rect.Max.Y / rowHeight)) + 1; r++ {
+		offset := float64(r) / 2
+		for q := int(math.Floor(rect.Min.X / width - offset)) - 1; q <= int(math.Ceil(rect.Max.X / width - offset)) + 1; q++ {
+			cells = append(cells, [2]int{q, r})
+		}
+	}
+	return cells
+}
+
+func (t HexTessellation) CellPolygons(cell [2]int) []common.Polygon {
+	center := t.center(cell)
+	poly := common.Polygon{}
+	for i := 0; i < 6; i++ {
+		angle := math.Pi/6 + float64(i) * math.Pi/3
+		poly = append(poly, common.Point{
+			center.X + t.Size * math.Cos(angle),
+			center.Y + t.Size * math.Sin(angle),
+		})
+	}
+	return []common.Polygon{poly}
+}
+
+// Quadtree whose root is the square from the origin with side Size << Depth.
+// A cell at level l has side Size << (Depth - l), and its four children are
+// at level l+1. Cells are [leaf index, 0].
+type QuadtreeTessellation struct {
+	Spec TessellationSpec
+	leafIndex map[[3]int]int
+}
+
+func NewQuadtreeTessellation(spec TessellationSpec) QuadtreeTessellation {
+	t := QuadtreeTessellation{
+		Spec: spec,
+		leafIndex: make(map[[3]int]int),
+	}
+	for i, leaf := range spec.Leaves {
+		t.leafIndex[leaf] = i
+	}
+	return t
+}
+
+// Splits the quadtree until every leaf has at most spec.MaxPoints points, or
+// is at the maximum depth, and returns the spec with the leaves set.
+func BuildQuadtree(spec TessellationSpec, points []common.Point) TessellationSpec {
+	if spec.MaxPoints <= 0 {
+		spec.MaxPoints = 100
+	}
+	spec.Leaves = nil
+	var split func(level int, x int, y int, points []common.Point)
+	split = func(level int, x int, y int, points []common.Point) {
+		if level == spec.Depth || len(points) <= spec.MaxPoints {
+			spec.Leaves = append(spec.Leaves, [3]int{level, x, y})
+			return
+		}
+		childSide := float64(spec.Size << uint(spec.Depth - level - 1))
+		children := make([][]common.Point, 4)
+		for _, p := range points {
+			cx := int(math.Floor(p.X / childSide)) - 2*x
+			cy := int(math.Floor(p.Y / childSide)) - 2*y
+			children[cy*2 + cx] = append(children[cy*2 + cx], p)
+		}
+		for i, childPoints := range children {
+			split(level+1, 2*x + i%2, 2*y + i/2, childPoints)
+		}
+	}
+	rootSide := float64(spec.Size << uint(spec.Depth))
+	var rootPoints []common.Point
+	for _, p := range points {
+		if p.X >= 0 && p.Y >= 0 && p.X < rootSide && p.Y < rootSide {
+			rootPoints = append(rootPoints, p)
+		}
+	}
+	split(0, 0, 0, rootPoints)
+	return spec
+}
+
+func (t QuadtreeTessellation) leafRect(leaf [3]int) common.Rectangle {
+	side := float64(t.Spec.Size << uint(t.Spec.Depth - leaf[0]))
+	return GetCellRect([2]int{leaf[1], leaf[2]}, side)
+}
+
+func (t QuadtreeTessellation) CellsContaining(p common.Point) [][2]int {
+	var cells [][2]int
+	for level := 0; level <= t.Spec.Depth; level++ {
+		side := float64(t.Spec.Size << uint(t.Spec.Depth - level))
+		for _, cell := range GetCellsContaining(p, side) {
+			if idx, ok := t.leafIndex[[3]int{level, cell[0], cell[1]}]; ok {
+				cells = append(cells, [2]int{idx, 0})
+			}
+		}
+	}
+	return cells
+}
+
+func (t QuadtreeTessellation) CellsInRect(rect common.Rectangle) [][2]int {
+	var cells [][2]int
+	for i, leaf := range t.Spec.Leaves {
+		leafRect := t.leafRect(leaf)
+		if leafRect.Max.X < rect.Min.X || leafRect.Min.X > rect.Max.X || leafRect.Max.Y < rect.Min.Y || leafRect.Min.Y > rect.Max.Y {
+			continue
+		}
+		cells = append(cells, [2]int{i, 0})
+	}
+	return cells
+}
+
+func (t QuadtreeTessellation) CellPolygons(cell [2]int) []common.Polygon {
+	if cell[0] < 0 || cell[0] >= len(t.Spec.Leaves) {
+		return nil
+	}
+	return []common.Polygon{t.leafRect(t.Spec.Leaves[cell[0]]).ToPolygon()}
+}
+
+// Zones as a tessellation, where cells are [zone index, 0]. Zones may overlap
+// and need not cover the ortho-image.
+type ZoneTessellation []Zone
+
+func (zones ZoneTessellation) CellsContaining(p common.Point) [][2]int {
+	var cells [][2]int
+	for i, zone := range zones {
+		if zone.Contains(p) {
+			cells = append(cells, [2]int{i, 0})
+		}
+	}
+	return cells
+}
+
+func (zones ZoneTessellation) CellsInRect(rect common.Rectangle) [][2]int {
+	var cells [][2]int
+	for i := range zones {
+		cells = append(cells, [2]int{i, 0})
+	}
+	return cells
+}
+
+func (zones ZoneTessellation) CellPolygons(cell [2]int) []common.Polygon {
+	if cell[0] < 0 || cell[0] >= len(zones) {
+		return nil
+	}
+	return zones[cell[0]].Exteriors()
+}
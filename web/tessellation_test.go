@@ -0,0 +1,171 @@
+package main
+
+import (
+	"github.com/mitroadmaps/gomapinfer/common"
+
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// Returns the cells sorted, for comparison.
+func sortCells(cells [][2]int) [][2]int {
+	sort.Slice(cells, func(i, j int) bool {
+		return cells[i][0] < cells[j][0] || (cells[i][0] == cells[j][0] && cells[i][1] < cells[j][1])
+	})
+	return cells
+}
+
+func TestSquareCellsContaining(t *testing.T) {
+	tessellation := SquareTessellation{Size: 32}
+	for _, c := range []struct {
+		p common.Point
+		cells [][2]int
+	}{
+		{common.Point{10, 10}, [][2]int{{0, 0}}},
+		{common.Point{32, 10}, [][2]int{{0, 0}, {1, 0}}},
+		{common.Point{32, 64}, [][2]int{{0, 1}, {0, 2}, {1, 1}, {1, 2}}},
+		{common.Point{-1, 0}, [][2]int{{-1, -1}, {-1, 0}}},
+	} {
+		cells := sortCells(tessellation.CellsContaining(c.p))
+		if len(cells) != len(c.cells) {
+			t.Errorf("%v: expected cells %v, got %v", c.p, c.cells, cells)
+			continue
+		}
+		for i := range cells {
+			if cells[i] != c.cells[i] {
+				t.Errorf("%v: expected cells %v, got %v", c.p, c.cells, cells)
+				break
+			}
+		}
+	}
+}
+
+func TestHexCellsContaining(t *testing.T) {
+	tessellation := HexTessellation{Size: 10}
+	poly := tessellation.CellPolygons([2]int{2, -1})[0]
+	center := poly.Bounds().Center()
+	if cells := tessellation.CellsContaining(center); len(cells) != 1 || cells[0] != [2]int{2, -1} {
+		t.Errorf("expected center to be in one cell, got %v", cells)
+	}
+	// A vertex is shared by three hexagons, and the middle of an edge by two.
+	if cells := tessellation.CellsContaining(poly[0]); len(cells) != 3 {
+		t.Errorf("expected vertex to be in three cells, got %v", cells)
+	}
+	edge := poly[0].Add(poly[1]).Scale(0.5)
+	if cells := tessellation.CellsContaining(edge); len(cells) != 2 {
+		t.Errorf("expected edge to be in two cells, got %v", cells)
+	}
+	// Every point is in the hexagons returned for it.
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		p := common.Point{r.Float64()*200 - 100, r.Float64()*200 - 100}
+		cells := tessellation.CellsContaining(p)
+		if len(cells) == 0 {
+			t.Fatalf("no cell contains %v", p)
+		}
+		for _, cell := range cells {
+			if !tessellation.contains(cell, p) {
+				t.Fatalf("cell %v does not contain %v", cell, p)
+			}
+		}
+	}
+}
+
+// Checks that CellsInRect includes every cell containing points in the
+// rectangle.
+func checkCellsInRect(t *testing.T, name string, tessellation Tessellation, rect common.Rectangle) {
+	inRect := make(map[[2]int]bool)
+	for _, cell := range tessellation.CellsInRect(rect) {
+		inRect[cell] = true
+	}
+	r := rand.New(rand.NewSource(1))
+	size := rect.Max.Sub(rect.Min)
+	points := []common.Point{rect.Min, rect.Max, {rect.Min.X, rect.Max.Y}, {rect.Max.X, rect.Min.Y}}
+	for i := 0; i < 1000; i++ {
+		points = append(points, rect.Min.Add(common.Point{r.Float64()*size.X, r.Float64()*size.Y}))
+	}
+	for _, p := range points {
+		for _, cell := range tessellation.CellsContaining(p) {
+			if !inRect[cell] {
+				t.Fatalf("%s: cell %v contains %v but is not in the rectangle", name, cell, p)
+			}
+		}
+	}
+}
+
+func TestCellsInRect(t *testing.T) {
+	quadtree := BuildQuadtree(TessellationSpec{Type: "quadtree", Size: 8, Depth: 3, MaxPoints: 1}, []common.Point{{1, 1}, {2, 2}, {3, 3}, {40, 40}, {41, 41}})
+	quadtreeTessellation, err := quadtree.Tessellation()
+	if err != nil {
+		t.Fatal(err)
+	}
+	zones := ZoneTessellation{
+		{Name: "a", Polygons: [][][][2]float64{{{{0, 0}, {50, 0}, {50, 50}, {0, 50}}}}},
+		{Name: "b", Polygons: [][][][2]float64{{{{40, 40}, {90, 40}, {90, 90}, {40, 90}}}}},
+	}
+	rect := common.Rectangle{common.Point{5, 7}, common.Point{61, 45}}
+	for name, tessellation := range map[string]Tessellation{
+		"square": SquareTessellation{Size: 16},
+		"hex": HexTessellation{Size: 7},
+		"quadtree": quadtreeTessellation,
+		"zones": zones,
+	} {
+		checkCellsInRect(t, name, tessellation, rect)
+	}
+}
+
+func TestBuildQuadtree(t *testing.T) {
+	// Root side 32. Three points are in the top left 8x8 cell, and one in
+	// the bottom right quadrant.
+	points := []common.Point{{1, 1}, {2, 2}, {3, 3}, {20, 20}}
+	spec := BuildQuadtree(TessellationSpec{Type: "quadtree", Size: 8, Depth: 2, MaxPoints: 2}, points)
+	// The root splits into four level 1 cells, and the top left one splits
+	// again, but its 8x8 children are at the maximum depth.
+	leaves := make(map[[3]int]bool)
+	for _, leaf := range spec.Leaves {
+		leaves[leaf] = true
+	}
+	expected := [][3]int{{1, 1, 0}, {1, 0, 1}, {1, 1, 1}, {2, 0, 0}, {2, 1, 0}, {2, 0, 1}, {2, 1, 1}}
+	if len(spec.Leaves) != len(expected) {
+		t.Fatalf("expected leaves %v, got %v", expected, spec.Leaves)
+	}
+	for _, leaf := range expected {
+		if !leaves[leaf] {
+			t.Errorf("expected leaf %v, got %v", leaf, spec.Leaves)
+		}
+	}
+
+	tessellation, err := spec.Tessellation()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cells := tessellation.CellsContaining(common.Point{1, 1})
+	if len(cells) != 1 || spec.Leaves[cells[0][0]] != [3]int{2, 0, 0} {
+		t.Errorf("expected (1, 1) in leaf (2, 0, 0), got %v", cells)
+	}
+	// On the boundary between a level 1 leaf and two level 2 leaves.
+	if cells := tessellation.CellsContaining(common.Point{16, 4}); len(cells) != 2 {
+		t.Errorf("expected (16, 4) in two leaves, got %v", cells)
+	}
+}
+
+func TestTessellationSpecValidate(t *testing.T) {
+	for _, spec := range []TessellationSpec{
+		{Type: "square", Size: 0},
+		{Type: "hex", Size: -3},
+		{Type: "quadtree", Size: 8, Depth: -1},
+		{Type: "quadtree", Size: 8, Depth: 40},
+		{Type: "quadtree", Size: 1 << 20, Depth: 10},
+		{Type: "quadtree", Size: 8, Depth: 2, MaxPoints: -1},
+		{Type: "quadtree", Size: 8, Depth: 2, Leaves: [][3]int{{3, 0, 0}}},
+		{Type: "triangle", Size: 8},
+	} {
+		if _, err := spec.Tessellation(); err == nil {
+			t.Errorf("expected error for spec %+v", spec)
+		}
+	}
+	if _, err := (TessellationSpec{Type: "quadtree", Size: 8, Depth: 10}).Tessellation(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"github.com/mitroadmaps/gomapinfer/common"
+	gomapimage "github.com/mitroadmaps/gomapinfer/image"
+
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+/*
+TileServer serves the ortho-image and the outputs of operations as map
+tiles in the XYZ (slippy map) scheme, in ortho-image pixel coordinates rather
+than a geographic projection (e.g. Leaflet's CRS.Simple).
+
+At the maximum zoom level, one tile pixel is one ortho-image pixel, and each
+lower level halves the resolution. Ortho-image tiles are rendered once and
+stored under Config.DataDir/tiles/ortho/, where each tile below the maximum
+zoom level is averaged from the four tiles of the next level so that it does
+not alias. Overlay tiles of detections, sequences, and matrix heatmaps are
+transparent PNGs that are rendered on demand and kept in an in-memory cache.
+*/
+
+const TileSize = 256
+
+// Maximum number of node outputs to keep loaded for overlay tiles.
+const OverlayCacheSize = 8
+
+// Size in ortho-image pixels of the buckets that index sequence segments
+// and detection centers for overlay tiles.
+const overlayBucketSize = 256
+
+type TileInfo struct {
+	// Size of the ortho-image.
+	Width int
+	Height int
+	TileSize int
+	MaxZoom int
+}
+
+type TileServer struct {
+	// Maximum number of overlay tiles to keep in memory.
+	CacheSize int
+
+	mu sync.Mutex
+	info *TileInfo
+	// The ortho-image, only loaded when an ortho-image tile is not on disk.
+	ortho [][][3]uint8
+	// Overlay tables by output directory.
+	overlays map[string]*tileOverlay
+	// Directories in overlays ordered from least to most recently used.
+	overlayOrder []string
+	tiles map[string][]byte
+	// Keys in tiles ordered from least to most recently used.
+	order []string
+}
+
+// The output tables of a node that are drawn on overlay tiles. Only colors
+// is modified after the overlay is loaded, under TileServer.mu.
+type tileOverlay struct {
+	matrix *Matrix
+	// Heatmap colors by visualization options key.
+	colors map[string]MatrixColors
+	// Sequence segments and detection centers by the overlayBucketSize
+	// bucket they intersect.
+	segments map[[2]int][]common.Segment
+	points map[[2]int][]common.Point
+}
+
+// Returns the overlay buckets intersecting the rectangle.
+func getOverlayBuckets(rect common.Rectangle) [][2]int {
+	var buckets [][2]int
+	for i := int(math.Floor(rect.Min.X / overlayBucketSize)); i <= int(math.Floor(rect.Max.X / overlayBucketSize)); i++ {
+		for j := int(math.Floor(rect.Min.Y / overlayBucketSize)); j <= int(math.Floor(rect.Max.Y / overlayBucketSize)); j++ {
+			buckets = append(buckets, [2]int{i, j})
+		}
+	}
+	return buckets
+}
+
+// Returns the tables of a node, with sequences and detections indexed by
+// bucket.
+func loadTileOverlay(dir string) (*tileOverlay, error) {
+	overlay := &tileOverlay{
+		colors: make(map[string]MatrixColors),
+		segments: make(map[[2]int][]common.Segment),
+		points: make(map[[2]int][]common.Point),
+	}
+	if bytes, err := ioutil.ReadFile(filepath.Join(dir, "detect.json")); err == nil {
+		var detections [][]Detection
+		if err := json.Unmarshal(bytes, &detections); err != nil {
+			return nil, err
+		}
+		for _, dlist := range detections {
+			for _, d := range dlist {
+				p := d.Polygon().Bounds().Center()
+				bucket := [2]int{int(math.Floor(p.X / overlayBucketSize)), int(math.Floor(p.Y / overlayBucketSize))}
+				overlay.points[bucket] = append(overlay.points[bucket], p)
+			}
+		}
+	}
+	if bytes, err := ioutil.ReadFile(filepath.Join(dir, "sequences.json")); err == nil {
+		var sequences []*Sequence
+		if err := json.Unmarshal(bytes, &sequences); err != nil {
+			return nil, err
+		}
+		for _, seq := range sequences {
+			for i := 1; i < len(seq.Items); i++ {
+				segment := common.Segment{
+					Start: seq.Items[i-1].Detection.Polygon().Bounds().Center(),
+					End: seq.Items[i].Detection.Polygon().Bounds().Center(),
+				}
+				bounds := common.Rectangle{
+					common.Point{math.Min(segment.Start.X, segment.End.X), math.Min(segment.Start.Y, segment.End.Y)},
+					common.Point{math.Max(segment.Start.X, segment.End.X), math.Max(segment.Start.Y, segment.End.Y)},
+				}
+				for _, bucket := range getOverlayBuckets(bounds) {
+					overlay.segments[bucket] = append(overlay.segments[bucket], segment)
+				}
+			}
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "matrix.json")); err == nil {
+		matrix, err := LoadMatrix(dir)
+		if err != nil {
+			return nil, err
+		}
+		overlay.matrix = &matrix
+	}
+	return overlay, nil
+}
+
+func NewTileServer(cacheSize int) *TileServer {
+	return &TileServer{
+		CacheSize: cacheSize,
+		overlays: make(map[string]*tileOverlay),
+		tiles: make(map[string][]byte),
+	}
+}
+
+// Returns the size of the ortho-image and of the tile pyramid.
+func (s *TileServer) Info() (TileInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.getInfo()
+}
+
+func (s *TileServer) getInfo() (TileInfo, error) {
+	if s.info != nil {
+		return *s.info, nil
+	}
+	// Only decode the header, since the ortho-image may be large.
+	f, err := os.Open(filepath.Join(Config.DataDir, "ortho.jpg"))
+	if err != nil {
+		return TileInfo{}, fmt.Errorf("error opening ortho-image: %v", err)
+	}
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return TileInfo{}, fmt.Errorf("error decoding ortho-image: %v", err)
+	}
+	info := TileInfo{
+		Width: cfg.Width,
+		Height: cfg.Height,
+		TileSize: TileSize,
+	}
+	for TileSize << uint(info.MaxZoom) < cfg.Width || TileSize << uint(info.MaxZoom) < cfg.Height {
+		info.MaxZoom++
+	}
+	s.info = &info
+	return info, nil
+}
+
+// Returns the ortho-image rectangle covered by the tile, and the number of
+// tile pixels per ortho-image pixel.
+func (s *TileServer) tileRect(z int, x int, y int) (common.Rectangle, float64, error) {
+	info, err := s.getInfo()
+	if err != nil {
+		return common.Rectangle{}, 0, err
+	}
+	if z < 0 || z > info.MaxZoom {
+		return common.Rectangle{}, 0, fmt.Errorf("zoom %d out of range", z)
+	}
+	scale := math.Pow(2, float64(z - info.MaxZoom))
+	size := TileSize / scale
+	rect := common.Rectangle{
+		common.Point{float64(x) * size, float64(y) * size},
+		common.Point{float64(x+1) * size, float64(y+1) * size},
+	}
+	if x < 0 || y < 0 || rect.Min.X >= float64(info.Width) || rect.Min.Y >= float64(info.Height) {
+		return common.Rectangle{}, 0, fmt.Errorf("tile %d/%d/%d out of range", z, x, y)
+	}
+	return rect, scale, nil
+}
+
+// Returns a JPEG tile of the ortho-image. Parts of the tile outside the
+// ortho-image are black.
+func (s *TileServer) OrthoTile(z int, x int, y int) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, _, err := s.tileRect(z, x, y); err != nil {
+		return nil, err
+	}
+	return s.orthoTile(z, x, y)
+}
+
+func (s *TileServer) orthoTile(z int, x int, y int) ([]byte, error) {
+	fname := filepath.Join(Config.DataDir, "tiles", "ortho", fmt.Sprintf("%d/%d/%d.jpg", z, x, y))
+	if bytes, err := ioutil.ReadFile(fname); err == nil {
+		return bytes, nil
+	}
+	info, err := s.getInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	im := image.NewRGBA(image.Rect(0, 0, TileSize, TileSize))
+	if z == info.MaxZoom {
+		// Copy the ortho-image pixels.
+		if s.ortho == nil {
+			s.ortho = gomapimage.ReadImage(filepath.Join(Config.DataDir, "ortho.jpg"))
+		}
+		for i := 0; i < TileSize; i++ {
+			for j := 0; j < TileSize; j++ {
+				ox, oy := x*TileSize + i, y*TileSize + j
+				if ox >= len(s.ortho) || oy >= len(s.ortho[0]) {
+					im.SetRGBA(i, j, color.RGBA{0, 0, 0, 255})
+					continue
+				}
+				c := s.ortho[ox][oy]
+				im.SetRGBA(i, j, color.RGBA{c[0], c[1], c[2], 255})
+			}
+		}
+	} else {
+		// Average each 2x2 block of pixels of the four tiles at the next
+		// level. Tiles past the edge of the ortho-image are black.
+		for ci := 0; ci < 2; ci++ {
+			for cj := 0; cj < 2; cj++ {
+				if _, _, err := s.tileRect(z+1, 2*x+ci, 2*y+cj); err != nil {
+					for i := 0; i < TileSize/2; i++ {
+						for j := 0; j < TileSize/2; j++ {
+							im.SetRGBA(ci*TileSize/2 + i, cj*TileSize/2 + j, color.RGBA{0, 0, 0, 255})
+						}
+					}
+					continue
+				}
+				data, err := s.orthoTile(z+1, 2*x+ci, 2*y+cj)
+				if err != nil {
+					return nil, err
+				}
+				child, err := jpeg.Decode(bytes.NewReader(data))
+				if err != nil {
+					return nil, fmt.Errorf("error decoding ortho tile %d/%d/%d: %v", z+1, 2*x+ci, 2*y+cj, err)
+				}
+				for i := 0; i < TileSize/2; i++ {
+					for j := 0; j < TileSize/2; j++ {
+						var sum [3]uint32
+						for _, d := range [][2]int{{0, 0}, {1, 0}, {0, 1}, {1, 1}} {
+							r, g, b, _ := child.At(2*i + d[0], 2*j + d[1]).RGBA()
+							sum[0] += r >> 8
+							sum[1] += g >> 8
+							sum[2] += b >> 8
+						}
+						im.SetRGBA(ci*TileSize/2 + i, cj*TileSize/2 + j, color.RGBA{uint8(sum[0] / 4), uint8(sum[1] / 4), uint8(sum[2] / 4), 255})
+					}
+				}
+			}
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, im, nil); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(fname, buf.Bytes(), 0644); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Returns the overlay of the directory, loading it if needed, and evicting
+// the least recently used overlays beyond OverlayCacheSize.
+func (s *TileServer) getOverlay(dir string) (*tileOverlay, error) {
+	if overlay := s.overlays[dir]; overlay != nil {
+		s.overlayOrder = touchKey(s.overlayOrder, dir)
+		return overlay, nil
+	}
+	overlay, err := loadTileOverlay(dir)
+	if err != nil {
+		return nil, err
+	}
+	s.overlays[dir] = overlay
+	s.overlayOrder = append(s.overlayOrder, dir)
+	for len(s.overlayOrder) > OverlayCacheSize {
+		delete(s.overlays, s.overlayOrder[0])
+		s.overlayOrder = s.overlayOrder[1:]
+	}
+	return overlay, nil
+}
+
+// Returns a transparent PNG tile with the outputs stored in the directory.
+// Matrices are rendered as in Visualize, except that there is no legend.
+// optionsKey identifies the options in the cache.
+//
+// The lock is only held to look up caches, so that tiles render in parallel.
+func (s *TileServer) OverlayTile(dir string, options VisualizeOptions, optionsKey string, z int, x int, y int) ([]byte, error) {
+	s.mu.Lock()
+	key := fmt.Sprintf("%s/%s/%d/%d/%d", dir, optionsKey, z, x, y)
+	if bytes, ok := s.tiles[key]; ok {
+		s.order = touchKey(s.order, key)
+		s.mu.Unlock()
+		return bytes, nil
+	}
+	rect, scale, err := s.tileRect(z, x, y)
+	if err != nil {
+		s.mu.Unlock()
+		return nil, err
+	}
+	overlay, err := s.getOverlay(dir)
+	if err != nil {
+		s.mu.Unlock()
+		return nil, err
+	}
+	var colors *MatrixColors
+	if overlay.matrix != nil {
+		c, ok := overlay.colors[optionsKey]
+		if !ok {
+			frame, err := options.getFrame()
+			if err == nil {
+				c, err = GetMatrixColors(*overlay.matrix, options, frame, 0.6)
+			}
+			if err != nil {
+				s.mu.Unlock()
+				return nil, err
+			}
+			overlay.colors[optionsKey] = c
+		}
+		colors = &c
+	}
+	s.mu.Unlock()
+
+	im := image.NewNRGBA(image.Rect(0, 0, TileSize, TileSize))
+	// Converts an ortho-image point to tile pixels.
+	toTile := func(p common.Point) common.Point {
+		return common.Point{(p.X - rect.Min.X) * scale, (p.Y - rect.Min.Y) * scale}
+	}
+	drawPoint := func(p common.Point, r int, c color.NRGBA) {
+		p = toTile(p)
+		for i := int(p.X) - r; i <= int(p.X) + r; i++ {
+			for j := int(p.Y) - r; j <= int(p.Y) + r; j++ {
+				im.SetNRGBA(i, j, c)
+			}
+		}
+	}
+	drawLine := func(a common.Point, b common.Point, c color.NRGBA) {
+		if math.Max(a.X, b.X) < rect.Min.X || math.Min(a.X, b.X) > rect.Max.X || math.Max(a.Y, b.Y) < rect.Min.Y || math.Min(a.Y, b.Y) > rect.Max.Y {
+			return
+		}
+		a, b = toTile(a), toTile(b)
+		for _, p := range common.DrawLineOnCells(int(a.X), int(a.Y), int(b.X), int(b.Y), TileSize, TileSize) {
+			im.SetNRGBA(p[0], p[1], c)
+		}
+	}
+
+	if colors != nil {
+		renderMatrixTile(im, *colors, rect, scale)
+	}
+	yellow := color.NRGBA{255, 255, 0, 255}
+	for _, bucket := range getOverlayBuckets(rect) {
+		for _, segment := range overlay.segments[bucket] {
+			drawLine(segment.Start, segment.End, yellow)
+		}
+		for _, p := range overlay.points[bucket] {
+			if !rect.Contains(p) {
+				continue
+			}
+			drawPoint(p, 1, yellow)
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, im); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.tiles[key]; !ok {
+		s.tiles[key] = buf.Bytes()
+		s.order = append(s.order, key)
+	}
+	for len(s.order) > s.CacheSize {
+		delete(s.tiles, s.order[0])
+		s.order = s.order[1:]
+	}
+	return buf.Bytes(), nil
+}
+
+// Parses the z, x, and y coordinates from the end of a tile URL path like
+// "3/2/5.png".
+func ParseTilePath(path string) (int, int, int, error) {
+	var z, x, y int
+	var ext string
+	if _, err := fmt.Sscanf(strings.Replace(path, "/", " ", -1), "%d %d %d%s", &z, &x, &y, &ext); err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid tile path %s", path)
+	}
+	return z, x, y, nil
+}
+
+// Moves the key to the most recently used position of the order.
+func touchKey(order []string, key string) []string {
+	for i, k := range order {
+		if k != key {
+			continue
+		}
+		order = append(order[:i], order[i+1:]...)
+		break
+	}
+	return append(order, key)
+}
+
+// Renders the part of the matrix heatmap in the rectangle onto a tile.
+func renderMatrixTile(im *image.NRGBA, colors MatrixColors, rect common.Rectangle, scale float64) {
+	alpha := uint8(math.Round(colors.Alpha * 255))
+	for _, cell := range colors.Tessellation.CellsInRect(rect) {
+		c, ok := colors.Colors[cell]
+		if !ok {
+			continue
+		}
+		fill := color.NRGBA{c[0], c[1], c[2], alpha}
+		for _, poly := range colors.Tessellation.CellPolygons(cell) {
+			bounds := poly.Bounds()
+			minI := int(math.Max(0, math.Floor((bounds.Min.X - rect.Min.X) * scale)))
+			maxI := int(math.Min(TileSize - 1, math.Ceil((bounds.Max.X - rect.Min.X) * scale)))
+			minJ := int(math.Max(0, math.Floor((bounds.Min.Y - rect.Min.Y) * scale)))
+			maxJ := int(math.Min(TileSize - 1, math.Ceil((bounds.Max.Y - rect.Min.Y) * scale)))
+			for i := minI; i <= maxI; i++ {
+				for j := minJ; j <= maxJ; j++ {
+					// Test the ortho-image point at the center of the tile pixel.
+					p := common.Point{rect.Min.X + (float64(i) + 0.5) / scale, rect.Min.Y + (float64(j) + 0.5) / scale}
+					if poly.Contains(p) {
+						im.SetNRGBA(i, j, fill)
+					}
+				}
+			}
+		}
+	}
+}
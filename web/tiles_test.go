@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Writes a 600x300 ortho-image of alternating black and white columns, which
+// aliases if low zoom tiles are sampled from it.
+func writeStripedOrtho(t *testing.T) {
+	Config.DataDir = t.TempDir()
+	im := image.NewRGBA(image.Rect(0, 0, 600, 300))
+	for x := 0; x < 600; x++ {
+		for y := 0; y < 300; y++ {
+			c := color.RGBA{0, 0, 0, 255}
+			if x % 2 == 1 {
+				c = color.RGBA{255, 255, 255, 255}
+			}
+			im.SetRGBA(x, y, c)
+		}
+	}
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, im); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(Config.DataDir, "ortho.jpg"), buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOrthoTilePyramid(t *testing.T) {
+	writeStripedOrtho(t)
+	s := NewTileServer(16)
+	info, err := s.Info()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.MaxZoom != 2 {
+		t.Fatalf("expected max zoom 2, got %d", info.MaxZoom)
+	}
+	data, err := s.OrthoTile(0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	im, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The zoom 0 tile is a quarter of the resolution, so the ortho-image is
+	// 150x75 pixels of gray.
+	r, _, _, _ := im.At(50, 50).RGBA()
+	if r >>= 8; r < 100 || r > 155 {
+		t.Errorf("expected gray in the ortho-image, got %d", r)
+	}
+	r, _, _, _ = im.At(200, 50).RGBA()
+	if r >>= 8; r > 20 {
+		t.Errorf("expected black outside the ortho-image, got %d", r)
+	}
+	if _, err := os.Stat(filepath.Join(Config.DataDir, "tiles", "ortho", "1", "0", "0.jpg")); err != nil {
+		t.Errorf("expected zoom 1 tile to be stored: %v", err)
+	}
+}
+
+func TestOverlayEviction(t *testing.T) {
+	writeStripedOrtho(t)
+	s := NewTileServer(16)
+	for i := 0; i <= OverlayCacheSize; i++ {
+		dir := filepath.Join(Config.DataDir, fmt.Sprintf("node%d", i))
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		seq := makeMergeTestSequence(i, 0, [2]int{10, 10}, [2]int{100, 100})
+		if err := ioutil.WriteFile(filepath.Join(dir, "sequences.json"), JsonMarshal([]*Sequence{seq}), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.OverlayTile(dir, VisualizeOptions{}, "", 2, 0, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(s.overlays) != OverlayCacheSize || len(s.overlayOrder) != OverlayCacheSize {
+		t.Errorf("expected %d overlays, got %d", OverlayCacheSize, len(s.overlays))
+	}
+	if s.overlays[filepath.Join(Config.DataDir, "node0")] != nil {
+		t.Error("expected least recently used overlay to be evicted")
+	}
+}
@@ -5,13 +5,49 @@ import (
 	"github.com/mitroadmaps/gomapinfer/image"
 
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"math"
 	"path/filepath"
 )
 
+// Options for rendering matrices as heatmaps.
+type VisualizeOptions struct {
+	// Colormap name (default "viridis", see Colormaps).
+	Colormap string
+	// Value range, computed from the rendered values if unset. For diverging
+	// colormaps, the automatic range is symmetric around Center.
+	Min *float64
+	Max *float64
+	Center float64
+	// Opacity of the heatmap over the ortho-image, from 0 to 1 (default 0.6).
+	Alpha *float64
+	// Whether to draw a legend (default true).
+	Legend *bool
+	// Render the matrix as of this time (see Window for the format), instead
+	// of the last observation at each cell.
+	Frame string
+	StartClock string
+	// The channel to render (default "value").
+	Channel string
+}
+
+// Decodes visualization options from JSON, where the empty string gives the
+// default options.
+func ParseVisualizeOptions(s string) (VisualizeOptions, error) {
+	var options VisualizeOptions
+	if s == "" {
+		return options, nil
+	}
+	if err := json.Unmarshal([]byte(s), &options); err != nil {
+		return options, fmt.Errorf("error decoding visualization options %s: %v", s, err)
+	}
+	return options, nil
+}
+
 // Visualize the outputs of an operation that are stored in the given directory.
-func Visualize(dir string) error {
+func Visualize(dir string, options VisualizeOptions) error {
 	log.Printf("[visualize] loading ortho-image")
 	ortho := image.ReadImage(filepath.Join(Config.DataDir, "ortho.jpg"))
 
@@ -65,68 +101,177 @@ func Visualize(dir string) error {
 			}
 		} else if fi.Name() == "matrix.json" {
 			log.Printf("[visualize] drawing matrix")
-			var matrix Matrix
-			bytes, err := ioutil.ReadFile(filepath.Join(dir, fi.Name()))
+			matrix, err := LoadMatrix(dir)
 			if err != nil {
 				return err
 			}
-			if err := json.Unmarshal(bytes, &matrix); err != nil {
+
+			if err := RenderMatrix(ortho, matrix, options); err != nil {
 				return err
 			}
+		}
+	}
 
-			cells := make(map[[2]int]int)
-			for i := 0; i <= len(ortho)/matrix.GridSize; i++ {
-				for j := 0; j <= len(ortho[0])/matrix.GridSize; j++ {
-					cells[[2]int{i, j}] = 0
-				}
-			}
+	log.Printf("[visualize] saving visualization")
+	image.WriteImage(filepath.Join(Config.DataDir, "out.jpg"), ortho)
+	return nil
+}
 
-			// Populate cells with observations in the matrix.
-			var min, max int
-			for _, obs := range matrix.Observations {
-				cells[obs.Cell] = obs.Value
-				min = obs.Value
-				max = obs.Value
-			}
-			for _, val := range cells {
-				if val < min {
-					min = val
-				}
-				if val > max {
-					max = val
-				}
-			}
-			min = 0
-			max = 1
-
-			// Returns color given value by normalized based on min/max.
-			normalize := func(val int) uint8 {
-				norm := float64(val - min) / float64(max - min)
-				if norm < 0 {
-					norm = 0
-				} else if norm > 1 {
-					norm = 1
-				}
-				return uint8(norm * 255)
-			}
+// Returns the latest observation at each cell as of the given frame, or as of
+// the end if frame is -1.
+func GetMatrixAt(matrix Matrix, frame int) map[[2]int]MatrixObservation {
+	cells := make(map[[2]int]MatrixObservation)
+	for _, obs := range matrix.Observations {
+		if frame != -1 && obs.Frame > frame {
+			continue
+		}
+		if prev, ok := cells[obs.Cell]; ok && prev.Frame > obs.Frame {
+			continue
+		}
+		cells[obs.Cell] = obs
+	}
+	return cells
+}
 
-			// Draw rectangles.
-			for cell, val := range cells {
-				normVal := normalize(val)
-				center := [2]int{
-					cell[0]*matrix.GridSize + matrix.GridSize/2,
-					cell[1]*matrix.GridSize + matrix.GridSize/2,
-				}
-				//image.DrawRect(ortho, center[0], center[1], matrix.GridSize/2, [3]uint8{normVal, normVal, normVal})
-				//image.DrawTransparent(ortho, center[0], center[1], matrix.GridSize/2, [3]int{int(normVal), -1, -1})
-				if normVal > 200 {
-					image.DrawRect(ortho, center[0], center[1], matrix.GridSize/2, [3]uint8{255, 0, 0})
+// Renders the matrix as a heatmap over the image. Cells without observations
+// are left unpainted.
+func RenderMatrix(pix [][][3]uint8, matrix Matrix, options VisualizeOptions) error {
+	frame, err := options.getFrame()
+	if err != nil {
+		return err
+	}
+	return renderMatrix(pix, matrix, options, frame, 1)
+}
+
+// Returns the frame to render the matrix at, or -1 for the end.
+func (options VisualizeOptions) getFrame() (int, error) {
+	if options.Frame == "" {
+		return -1, nil
+	}
+	return ParseFrameSpec(options.Frame, options.StartClock)
+}
+
+// Returns the value range for the colormap, given statistics of the values
+// that are rendered.
+func (options VisualizeOptions) getRange(cmap Colormap, values Accumulator) (float64, float64) {
+	min, max := values.Min, values.Max
+	if cmap.Diverging {
+		d := math.Max(math.Abs(min - options.Center), math.Abs(max - options.Center))
+		min, max = options.Center - d, options.Center + d
+	}
+	if options.Min != nil {
+		min = *options.Min
+	}
+	if options.Max != nil {
+		max = *options.Max
+	}
+	return min, max
+}
+
+// The colors of the cells of a matrix heatmap, shared by the visualization,
+// animations, map tiles, and frame views.
+type MatrixColors struct {
+	Tessellation Tessellation
+	// Colors of the cells with observations.
+	Colors map[[2]int][3]uint8
+	Colormap Colormap
+	Min float64
+	Max float64
+	// Opacity of the heatmap.
+	Alpha float64
+}
+
+// Returns the heatmap colors of the matrix as of the given frame (or the end
+// if -1). The value range is computed over every cell, unless it is set in
+// the options. defaultAlpha is the opacity if options.Alpha is not set.
+func GetMatrixColors(matrix Matrix, options VisualizeOptions, frame int, defaultAlpha float64) (MatrixColors, error) {
+	if options.Colormap == "" {
+		options.Colormap = "viridis"
+	}
+	cmap, err := GetColormap(options.Colormap)
+	if err != nil {
+		return MatrixColors{}, err
+	}
+	alpha := defaultAlpha
+	if options.Alpha != nil {
+		alpha = *options.Alpha
+		if alpha < 0 || alpha > 1 {
+			return MatrixColors{}, fmt.Errorf("alpha %v must be between 0 and 1", alpha)
+		}
+	}
+	if !matrix.HasChannel(options.Channel) {
+		return MatrixColors{}, fmt.Errorf("matrix has no channel %s", options.Channel)
+	}
+	tessellation, err := matrix.GetTessellation()
+	if err != nil {
+		return MatrixColors{}, err
+	}
+
+	// Get the values to render and their range.
+	values := make(map[[2]int]float64)
+	var valueRange Accumulator
+	for cell, obs := range GetMatrixAt(matrix, frame) {
+		values[cell] = obs.Get(options.Channel)
+		valueRange.Add(values[cell])
+	}
+	min, max := options.getRange(cmap, valueRange)
+
+	colors := MatrixColors{
+		Tessellation: tessellation,
+		Colors: make(map[[2]int][3]uint8),
+		Colormap: cmap,
+		Min: min,
+		Max: max,
+		Alpha: alpha,
+	}
+	for cell, val := range values {
+		t := 0.5
+		if max != min {
+			t = (val - min) / (max - min)
+		}
+		colors.Colors[cell] = cmap.Color(t)
+	}
+	return colors, nil
+}
+
+// Renders the matrix as of the given frame (or the end if -1) over an image
+// that is the ortho-image scaled by scale.
+func renderMatrix(pix [][][3]uint8, matrix Matrix, options VisualizeOptions, frame int, scale float64) error {
+	colors, err := GetMatrixColors(matrix, options, frame, 0.6)
+	if err != nil {
+		return err
+	}
+	for cell, c := range colors.Colors {
+		for _, poly := range colors.Tessellation.CellPolygons(cell) {
+			if scale != 1 {
+				scaled := make(common.Polygon, len(poly))
+				for i, p := range poly {
+					scaled[i] = p.Scale(scale)
 				}
+				poly = scaled
 			}
+			fillPolygon(pix, poly, c, colors.Alpha)
 		}
 	}
-
-	log.Printf("[visualize] saving visualization")
-	image.WriteImage(filepath.Join(Config.DataDir, "out.jpg"), ortho)
+	if options.Legend == nil || *options.Legend {
+		drawLegend(pix, colors.Colormap, colors.Min, colors.Max)
+	}
 	return nil
 }
+
+// Blends color c over the pixels inside the polygon.
+func fillPolygon(pix [][][3]uint8, poly common.Polygon, c [3]uint8, alpha float64) {
+	bounds := poly.Bounds()
+	minX := int(math.Max(0, bounds.Min.X))
+	maxX := int(math.Min(float64(len(pix) - 1), bounds.Max.X))
+	minY := int(math.Max(0, bounds.Min.Y))
+	maxY := int(math.Min(float64(len(pix[0]) - 1), bounds.Max.Y))
+	for x := minX; x <= maxX; x++ {
+		for y := minY; y <= maxY; y++ {
+			if !poly.Contains(common.Point{float64(x), float64(y)}) {
+				continue
+			}
+			blendPixel(pix, x, y, c, alpha)
+		}
+	}
+}
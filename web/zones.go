@@ -0,0 +1,203 @@
+package main
+
+import (
+	"github.com/mitroadmaps/gomapinfer/common"
+
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+)
+
+// Zones are named polygons, such as a parking lot or a crosswalk. They are
+// stored as GeoJSON in Config.DataDir/zones/NAME.geojson, where coordinates are
+// in the same pixel space as the ortho-image (and detection Points). Each
+// feature must have a Polygon or MultiPolygon geometry, and should have a
+// "name" property. Zone table names are restricted to letters, digits, "_"
+// and "-", like program names.
+
+var zonesNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+type Zone struct {
+	Name string
+	Properties map[string]interface{} `json:",omitempty"`
+	// Polygons, each a list of rings where the first ring is the exterior and
+	// any other rings are holes (same as GeoJSON MultiPolygon coordinates).
+	Polygons [][][][2]float64
+}
+
+func ringToPolygon(ring [][2]float64) common.Polygon {
+	poly := common.Polygon{}
+	for _, p := range ring {
+		poly = append(poly, common.Point{p[0], p[1]})
+	}
+	// GeoJSON rings repeat the first point at the end.
+	if len(poly) > 1 && poly[0] == poly[len(poly)-1] {
+		poly = poly[:len(poly)-1]
+	}
+	return poly
+}
+
+// Returns the exterior rings of the zone.
+func (zone Zone) Exteriors() []common.Polygon {
+	var polys []common.Polygon
+	for _, rings := range zone.Polygons {
+		polys = append(polys, ringToPolygon(rings[0]))
+	}
+	return polys
+}
+
+func (zone Zone) Contains(p common.Point) bool {
+	for _, rings := range zone.Polygons {
+		if !ringToPolygon(rings[0]).Contains(p) {
+			continue
+		}
+		inHole := false
+		for _, hole := range rings[1:] {
+			if ringToPolygon(hole).Contains(p) {
+				inHole = true
+				break
+			}
+		}
+		if !inHole {
+			return true
+		}
+	}
+	return false
+}
+
+func (zone Zone) Bounds() common.Rectangle {
+	var poly common.Polygon
+	for _, exterior := range zone.Exteriors() {
+		poly = append(poly, exterior...)
+	}
+	return poly.Bounds()
+}
+
+// Returns the minimum distance from the polygon to the frame boundaries, or
+// -1 if the polygon is not entirely in the frame.
+func GetPolygonDistanceInFrame(poly common.Polygon, frame Frame) float64 {
+	framePoly := frame.Polygon()
+	for _, p := range poly {
+		if !framePoly.Contains(p) {
+			return -1
+		}
+	}
+	var worstDistance float64 = -1
+	for _, segment := range poly.Segments() {
+		for _, frameSegment := range framePoly.Segments() {
+			d := segment.DistanceToSegment(frameSegment)
+			if worstDistance == -1 || d < worstDistance {
+				worstDistance = d
+			}
+		}
+	}
+	return worstDistance
+}
+
+// Reads zones from a GeoJSON FeatureCollection.
+func ReadGeoJSONZones(fname string) ([]Zone, error) {
+	bytes, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, fmt.Errorf("error loading zones from %s: %v", fname, err)
+	}
+	var collection struct {
+		Features []struct {
+			Properties map[string]interface{}
+			Geometry struct {
+				Type string
+				Coordinates json.RawMessage
+			}
+		}
+	}
+	if err := json.Unmarshal(bytes, &collection); err != nil {
+		return nil, fmt.Errorf("error decoding zones from %s: %v", fname, err)
+	}
+	var zones []Zone
+	for i, feature := range collection.Features {
+		zone := Zone{
+			Name: fmt.Sprintf("%d", i),
+			Properties: feature.Properties,
+		}
+		if name, ok := feature.Properties["name"].(string); ok {
+			zone.Name = name
+		}
+		if feature.Geometry.Type == "Polygon" {
+			var rings [][][2]float64
+			if err := json.Unmarshal(feature.Geometry.Coordinates, &rings); err != nil {
+				return nil, fmt.Errorf("error decoding polygon of zone %s: %v", zone.Name, err)
+			}
+			zone.Polygons = [][][][2]float64{rings}
+		} else if feature.Geometry.Type == "MultiPolygon" {
+			if err := json.Unmarshal(feature.Geometry.Coordinates, &zone.Polygons); err != nil {
+				return nil, fmt.Errorf("error decoding polygons of zone %s: %v", zone.Name, err)
+			}
+		} else {
+			return nil, fmt.Errorf("zone %s has unsupported geometry type %s", zone.Name, feature.Geometry.Type)
+		}
+		for _, rings := range zone.Polygons {
+			if len(rings) == 0 || len(rings[0]) < 3 {
+				return nil, fmt.Errorf("zone %s has a polygon with fewer than three points", zone.Name)
+			}
+		}
+		zones = append(zones, zone)
+	}
+	return zones, nil
+}
+
+// Loads the zones.json in the given directory.
+func LoadZones(dir string) ([]Zone, error) {
+	var zones []Zone
+	inputPath := filepath.Join(dir, "zones.json")
+	bytes, err := ioutil.ReadFile(inputPath)
+	if err != nil {
+		return nil, fmt.Errorf("error loading zones from %s: %v", inputPath, err)
+	}
+	if err := json.Unmarshal(bytes, &zones); err != nil {
+		return nil, fmt.Errorf("error decoding zones: %v", err)
+	}
+	return zones, nil
+}
+
+// Returns the path of the GeoJSON file of the named zone table.
+func getZonesPath(name string) (string, error) {
+	if !zonesNameRegexp.MatchString(name) {
+		return "", fmt.Errorf("invalid zone table name %s", name)
+	}
+	return filepath.Join(Config.DataDir, "zones", name + ".geojson"), nil
+}
+
+// Source operator that loads a zone table from the data directory.
+func ZonesOp(args []OpArgument, outDir string) error {
+	fname, err := getZonesPath(args[0].String)
+	if err != nil {
+		return err
+	}
+	zones, err := ReadGeoJSONZones(fname)
+	if err != nil {
+		return err
+	}
+	bytes, err := json.Marshal(zones)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(outDir, "zones.json"), bytes, 0644); err != nil {
+		return err
+	}
+	return nil
+}
+
+func init() {
+	Ops["Zones"] = ZonesOp
+	OpSignatures["Zones"] = OpSignature{MinArgs: 1, MaxArgs: 1}
+	// The GeoJSON file can be edited, so its contents are part of the node
+	// hash.
+	OpSources["Zones"] = func(args []Argument) []string {
+		fname, err := getZonesPath(args[0].String)
+		if err != nil {
+			return nil
+		}
+		return []string{fname}
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestZonesName(t *testing.T) {
+	for _, name := range []string{"../programs/x", "a/b", "", "a.b"} {
+		if _, err := getZonesPath(name); err == nil {
+			t.Errorf("expected error for zone table name %q", name)
+		}
+	}
+	if _, err := getZonesPath("parking_lot-2"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestZonesHash(t *testing.T) {
+	Config.DataDir = t.TempDir()
+	if err := os.Mkdir(filepath.Join(Config.DataDir, "zones"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	graph := Graph{"z": &Node{
+		Name: "z",
+		Operation: "Zones",
+		Arguments: []Argument{{Type: "string", String: "lot"}},
+	}}
+	getHash := func(geojson string) string {
+		if err := ioutil.WriteFile(filepath.Join(Config.DataDir, "zones", "lot.geojson"), []byte(geojson), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return graph.GetHashStrings()["z"]
+	}
+	hash1 := getHash(`{"features": []}`)
+	hash2 := getHash(`{"features": [{"properties": {"name": "a"}, "geometry": {"type": "Polygon", "coordinates": [[[0, 0], [1, 0], [1, 1]]]}}]}`)
+	if hash1 == hash2 {
+		t.Error("expected node hash to change with the GeoJSON file")
+	}
+}